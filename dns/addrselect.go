@@ -0,0 +1,192 @@
+// Copyright 2015 Felipe A. Cavani. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dns
+
+import (
+	"net"
+	"sort"
+)
+
+// sourceAddr returns the source address the system would use to reach
+// dst, or nil if dst isn't reachable. Connecting an udp socket doesn't send
+// packets.
+var sourceAddr = func(dst net.IP) net.IP {
+	conn, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: dst, Port: 9})
+	if err != nil {
+		return nil
+	}
+	defer conn.Close()
+	if addr, ok := conn.LocalAddr().(*net.UDPAddr); ok {
+		return addr.IP
+	}
+	return nil
+}
+
+// sortAddrs orders the addresses using the destination address selection
+// rules of RFC 6724 and then interleaves the address families as RFC 8305
+// recommends, so the first address is the best one to connect to and a
+// failing family doesn't delay the other.
+func sortAddrs(addrs []string) []string {
+	if len(addrs) < 2 {
+		return addrs
+	}
+	dsts := make([]*destination, 0, len(addrs))
+	for _, addr := range addrs {
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			continue
+		}
+		d := &destination{ip: ip, src: sourceAddr(ip)}
+		d.policy = policyOf(ip)
+		d.scope = scopeOf(ip)
+		if d.src != nil {
+			d.srcPolicy = policyOf(d.src)
+			d.srcScope = scopeOf(d.src)
+		}
+		dsts = append(dsts, d)
+	}
+	if len(dsts) != len(addrs) {
+		return addrs
+	}
+	sort.Stable(byRFC6724(dsts))
+	dsts = interleave(dsts)
+	out := make([]string, len(dsts))
+	for i, d := range dsts {
+		out[i] = d.ip.String()
+	}
+	return out
+}
+
+type destination struct {
+	ip        net.IP
+	src       net.IP
+	policy    policy
+	srcPolicy policy
+	scope     int
+	srcScope  int
+}
+
+type byRFC6724 []*destination
+
+func (s byRFC6724) Len() int      { return len(s) }
+func (s byRFC6724) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+
+func (s byRFC6724) Less(i, j int) bool {
+	da, db := s[i], s[j]
+	// Rule 1: avoid unusable destinations.
+	if (da.src == nil) != (db.src == nil) {
+		return da.src != nil
+	}
+	if da.src == nil {
+		return false
+	}
+	// Rule 2: prefer matching scope.
+	ma, mb := da.scope == da.srcScope, db.scope == db.srcScope
+	if ma != mb {
+		return ma
+	}
+	// Rule 5: prefer matching label.
+	ma, mb = da.policy.label == da.srcPolicy.label, db.policy.label == db.srcPolicy.label
+	if ma != mb {
+		return ma
+	}
+	// Rule 6: prefer higher precedence.
+	if da.policy.precedence != db.policy.precedence {
+		return da.policy.precedence > db.policy.precedence
+	}
+	// Rule 8: prefer smaller scope.
+	if da.scope != db.scope {
+		return da.scope < db.scope
+	}
+	// Rule 10: leave the order unchanged.
+	return false
+}
+
+// interleave alternates the address families starting with the family of
+// the first address, RFC 8305 section 4.
+func interleave(dsts []*destination) []*destination {
+	first, second := make([]*destination, 0, len(dsts)), make([]*destination, 0, len(dsts))
+	v4 := dsts[0].ip.To4() != nil
+	for _, d := range dsts {
+		if (d.ip.To4() != nil) == v4 {
+			first = append(first, d)
+		} else {
+			second = append(second, d)
+		}
+	}
+	out := make([]*destination, 0, len(dsts))
+	for i := 0; i < len(first) || i < len(second); i++ {
+		if i < len(first) {
+			out = append(out, first[i])
+		}
+		if i < len(second) {
+			out = append(out, second[i])
+		}
+	}
+	return out
+}
+
+type policy struct {
+	prefix     *net.IPNet
+	precedence int
+	label      int
+}
+
+// The default policy table of RFC 6724 section 2.1. The longest prefix
+// comes first.
+var policyTable = []policy{
+	{mustCIDR("::1/128"), 50, 0},
+	{mustCIDR("::ffff:0:0/96"), 35, 4},
+	{mustCIDR("::/96"), 1, 3},
+	{mustCIDR("2001::/32"), 5, 5},
+	{mustCIDR("2002::/16"), 30, 2},
+	{mustCIDR("3ffe::/16"), 1, 12},
+	{mustCIDR("fec0::/10"), 1, 11},
+	{mustCIDR("fc00::/7"), 3, 13},
+	{mustCIDR("::/0"), 40, 1},
+}
+
+func mustCIDR(s string) *net.IPNet {
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		panic(err)
+	}
+	return n
+}
+
+func policyOf(ip net.IP) policy {
+	// IPv4 addresses are matched as IPv4-mapped IPv6 addresses.
+	ip = ip.To16()
+	for _, p := range policyTable {
+		if p.prefix.Contains(ip) {
+			return p
+		}
+	}
+	return policyTable[len(policyTable)-1]
+}
+
+// Scopes of RFC 4291 and RFC 6724 section 3.2.
+const (
+	scopeInterfaceLocal = 0x1
+	scopeLinkLocal      = 0x2
+	scopeSiteLocal      = 0x5
+	scopeGlobal         = 0xe
+)
+
+func scopeOf(ip net.IP) int {
+	if ip.IsLoopback() || ip.IsLinkLocalUnicast() {
+		return scopeLinkLocal
+	}
+	if ip.To4() == nil {
+		if ip.IsMulticast() {
+			return int(ip[1] & 0xf)
+		}
+		// Site-local, fec0::/10.
+		if ip[0] == 0xfe && ip[1]&0xc0 == 0xc0 {
+			return scopeSiteLocal
+		}
+	}
+	return scopeGlobal
+}
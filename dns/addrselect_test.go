@@ -0,0 +1,61 @@
+// Copyright 2015 Felipe A. Cavani. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dns
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestSortAddrs(t *testing.T) {
+	old := sourceAddr
+	defer func() { sourceAddr = old }()
+
+	tests := []struct {
+		v6    bool
+		addrs []string
+		want  []string
+	}{
+		// Dual stack: IPv6 first, then alternate the families.
+		{
+			v6:    true,
+			addrs: []string{"192.0.2.1", "192.0.2.2", "192.0.2.3", "2001:db8::1", "2001:db8::2"},
+			want:  []string{"2001:db8::1", "192.0.2.1", "2001:db8::2", "192.0.2.2", "192.0.2.3"},
+		},
+		// No IPv6 route: IPv4 first.
+		{
+			v6:    false,
+			addrs: []string{"2001:db8::1", "2001:db8::2", "192.0.2.1", "192.0.2.2"},
+			want:  []string{"192.0.2.1", "2001:db8::1", "192.0.2.2", "2001:db8::2"},
+		},
+		// Loopback first.
+		{
+			v6:    true,
+			addrs: []string{"192.0.2.1", "::1", "127.0.0.1"},
+			want:  []string{"::1", "127.0.0.1", "192.0.2.1"},
+		},
+	}
+	for i, test := range tests {
+		v6 := test.v6
+		sourceAddr = func(dst net.IP) net.IP {
+			switch {
+			case dst.IsLoopback() && dst.To4() != nil:
+				return net.ParseIP("127.0.0.1")
+			case dst.IsLoopback():
+				return net.ParseIP("::1")
+			case dst.To4() != nil:
+				return net.ParseIP("198.51.100.1")
+			case v6:
+				return net.ParseIP("2001:db8:1::1")
+			}
+			return nil
+		}
+		got := sortAddrs(test.addrs)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%v: got %v, want %v", i, got, test.want)
+		}
+	}
+}
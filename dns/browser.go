@@ -0,0 +1,61 @@
+// Copyright 2015 Felipe A. Cavani. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dns
+
+import (
+	"context"
+	"strings"
+
+	"github.com/fcavani/e"
+	mdns "github.com/grandcat/zeroconf"
+	"github.com/miekg/dns"
+)
+
+// Browser browses for the multicast DNS services. Like the zeroconf
+// resolver, Browse sends the entries found until ctx is done and then
+// closes entries. An entry with TTL 0 is a goodbye.
+type Browser interface {
+	Browse(ctx context.Context, service, domain string, entries chan<- *mdns.ServiceEntry) error
+}
+
+// WithBrowser uses b to browse for the multicast names instead of
+// zeroconf, for example to test without the network.
+func WithBrowser(b Browser) Option {
+	return func(r *Resolver) error {
+		if b == nil {
+			return e.New("invalid browser")
+		}
+		r.browser = b
+		return nil
+	}
+}
+
+// zeroconfBrowser browses with a new zeroconf resolver each time, the
+// zeroconf resolvers can't be reused.
+type zeroconfBrowser []mdns.ClientOption
+
+func (opts zeroconfBrowser) Browse(ctx context.Context, service, domain string, entries chan<- *mdns.ServiceEntry) error {
+	resolver, err := mdns.NewResolver(opts...)
+	if err != nil {
+		return e.Push(err, "failed to initialize the multicast resolver")
+	}
+	return resolver.Browse(ctx, service, domain, entries)
+}
+
+// multicast returns the browser of the resolver.
+func (r *Resolver) multicast() Browser {
+	if r.browser != nil {
+		return r.browser
+	}
+	r.lck.Lock()
+	defer r.lck.Unlock()
+	return zeroconfBrowser(r.mdnsOpts)
+}
+
+// isService returns true if name is a service type, like _ipp._tcp.local.
+func isService(name string) bool {
+	labels := dns.SplitDomainName(name)
+	return len(labels) >= 2 && strings.HasPrefix(labels[0], "_") && (labels[1] == "_tcp" || labels[1] == "_udp")
+}
@@ -5,7 +5,11 @@
 package dns
 
 import (
+	"context"
+	"hash/fnv"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/fcavani/e"
@@ -18,6 +22,10 @@ var Sleep = 3600 * time.Second
 // Time of life of one entry, in seconds. Is query is a hit this time is reseted.
 var DefaultExpire = 24 * 60 * 60 * time.Second
 
+// Time of life of a failed query without a SOA record to tell the negative
+// TTL. RFC 2308 limits it to five minutes.
+var ServFailExpire = 5 * 60 * time.Second
+
 const ErrNotFound = "entry not found"
 const ErrDupEntry = "duplicated entry"
 const ErrIterStop = "iter stop"
@@ -26,19 +34,31 @@ const ErrServFail = "serv fail"
 type Host struct {
 	Addrs    []string
 	ServFail bool
+	// Negative is the error constant of a negative entry, like ErrNXDomain.
+	// Empty for the entries put with PutServFail.
+	Negative string `json:",omitempty"`
 	Expire   time.Time
+	hits     uint32
+}
+
+// err returns the error of a negative entry.
+func (h *Host) err() error {
+	if h.Negative == "" {
+		return e.New(ErrServFail)
+	}
+	return negativeErr(h.Negative)
 }
 
 func (h *Host) ReturnPtr() (string, error) {
 	if h.ServFail {
-		return "", e.New(ErrServFail)
+		return "", h.err()
 	}
 	return h.Addrs[0], nil
 }
 
 func (h *Host) ReturnAddrs() ([]string, error) {
 	if h.ServFail {
-		return nil, e.New(ErrServFail)
+		return nil, h.err()
 	}
 	return h.Addrs, nil
 }
@@ -50,21 +70,39 @@ type Storer interface {
 	Iter(f func(key string, data *Host) error) error
 }
 
+// Number of shards of Mem, each one with its own lock.
+const memShards = 32
+
+// Mem is a Storer that keeps the entries in memory. The entries are spread
+// between shards to reduce the contention of the locks.
 type Mem struct {
+	shards [memShards]memShard
+}
+
+type memShard struct {
 	m   map[string]*Host
 	lck sync.RWMutex
 }
 
 func NewMem() Storer {
-	return &Mem{
-		m: make(map[string]*Host),
+	m := new(Mem)
+	for i := range m.shards {
+		m.shards[i].m = make(map[string]*Host)
 	}
+	return m
+}
+
+func (m *Mem) shard(key string) *memShard {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return &m.shards[h.Sum32()%memShards]
 }
 
 func (m *Mem) Get(key string) (*Host, error) {
-	m.lck.RLock()
-	defer m.lck.RUnlock()
-	data, found := m.m[key]
+	s := m.shard(key)
+	s.lck.RLock()
+	defer s.lck.RUnlock()
+	data, found := s.m[key]
 	if !found {
 		return nil, e.New(ErrNotFound)
 	}
@@ -72,41 +110,72 @@ func (m *Mem) Get(key string) (*Host, error) {
 }
 
 func (m *Mem) Put(key string, data *Host) error {
-	m.lck.Lock()
-	defer m.lck.Unlock()
-	_, found := m.m[key]
+	s := m.shard(key)
+	s.lck.Lock()
+	defer s.lck.Unlock()
+	_, found := s.m[key]
 	if found {
 		return e.New(ErrDupEntry)
 	}
-	m.m[key] = data
+	s.m[key] = data
 	return nil
 }
 
 func (m *Mem) Del(key string) error {
-	m.lck.Lock()
-	defer m.lck.Unlock()
-	_, found := m.m[key]
+	s := m.shard(key)
+	s.lck.Lock()
+	defer s.lck.Unlock()
+	_, found := s.m[key]
 	if !found {
 		return e.New(ErrNotFound)
 	}
-	delete(m.m, key)
+	delete(s.m, key)
 	return nil
 }
 
+// Len returns the number of entries.
+func (m *Mem) Len() int {
+	n := 0
+	for i := range m.shards {
+		s := &m.shards[i]
+		s.lck.RLock()
+		n += len(s.m)
+		s.lck.RUnlock()
+	}
+	return n
+}
+
+// Iter calls f for the entries of one shard at time. The entries of the
+// shard are copied before f is called, so f can call the other methods,
+// like Del, and the other goroutines aren't blocked while f runs.
 func (m *Mem) Iter(f func(key string, data *Host) error) error {
-	var err error
-	for k, v := range m.m {
-		err = f(k, v)
-		if e.Equal(err, ErrIterStop) {
-			return nil
-		} else if err != nil {
-			return e.Forward(err)
+	var keys []string
+	var hosts []*Host
+	for i := range m.shards {
+		s := &m.shards[i]
+		s.lck.RLock()
+		keys = keys[:0]
+		hosts = hosts[:0]
+		for k, v := range s.m {
+			keys = append(keys, k)
+			hosts = append(hosts, v)
+		}
+		s.lck.RUnlock()
+
+		for j, k := range keys {
+			err := f(k, hosts[j])
+			if e.Equal(err, ErrIterStop) {
+				return nil
+			} else if err != nil {
+				return e.Forward(err)
+			}
 		}
 	}
 	return nil
 }
 
 type Cacher interface {
+	// Get returns the entry or nil if it isn't in the cache or is expired.
 	Get(key string) *Host
 	PutAddrs(key string, ips []string) error
 	PutPtr(key, ptr string) error
@@ -114,29 +183,239 @@ type Cacher interface {
 	Close() error
 }
 
+// TTLCacher is implemented by the caches that keep the entries for the TTL
+// of the records. The caches without it keep all entries for the same time.
+type TTLCacher interface {
+	// PutAddrsTTL puts the addresses with the TTL of the records.
+	PutAddrsTTL(key string, ips []string, ttl time.Duration) error
+	// PutPtrTTL puts the pointer with the TTL of the record.
+	PutPtrTTL(key, ptr string, ttl time.Duration) error
+	// PutServFailTTL puts a negative entry that lives for ttl, the negative
+	// TTL of RFC 2308.
+	PutServFailTTL(key string, ttl time.Duration) error
+}
+
+// NegativeCacher is implemented by the caches that remember the kind of
+// the negative entries, so a cached NXDOMAIN is returned as NXDOMAIN. The
+// caches without it put a PutServFail entry.
+type NegativeCacher interface {
+	// PutNegative puts a negative entry of kind, an error constant like
+	// ErrNXDomain.
+	PutNegative(key, kind string) error
+	// PutNegativeTTL puts a negative entry of kind that lives for ttl.
+	PutNegativeTTL(key, kind string, ttl time.Duration) error
+}
+
+// Flusher is implemented by the caches that can remove entries.
+type Flusher interface {
+	// Delete removes the entry.
+	Delete(key string) error
+	// Flush removes all entries.
+	Flush() error
+}
+
+// Snapshotter is implemented by the caches that can copy their entries.
+type Snapshotter interface {
+	// Snapshot returns a copy of the entries.
+	Snapshot() ([]Entry, error)
+}
+
+// StatsCacher is implemented by the caches that count their hits and
+// misses.
+type StatsCacher interface {
+	// Stats returns the cache's counters.
+	Stats() Stats
+}
+
+// putAddrsTTL puts the addresses in c with the TTL if c is a TTLCacher.
+func putAddrsTTL(c Cacher, key string, ips []string, ttl time.Duration) error {
+	if tc, ok := c.(TTLCacher); ok {
+		return e.Forward(tc.PutAddrsTTL(key, ips, ttl))
+	}
+	return e.Forward(c.PutAddrs(key, ips))
+}
+
+// remaining returns the time of life left of the entry of key if c is a
+// Cache. It doesn't count as a hit.
+func remaining(c Cacher, key string) (time.Duration, bool) {
+	cache, ok := c.(*Cache)
+	if !ok {
+		return 0, false
+	}
+	h, err := cache.s.Get(key)
+	if err != nil || h.Expire.IsZero() {
+		return 0, false
+	}
+	ttl := time.Until(h.Expire)
+	if ttl <= 0 {
+		return 0, false
+	}
+	return ttl, true
+}
+
+// putPtrTTL puts the pointer in c with the TTL if c is a TTLCacher.
+func putPtrTTL(c Cacher, key, ptr string, ttl time.Duration) error {
+	if tc, ok := c.(TTLCacher); ok {
+		return e.Forward(tc.PutPtrTTL(key, ptr, ttl))
+	}
+	return e.Forward(c.PutPtr(key, ptr))
+}
+
+// putNegative puts a negative entry of kind in c, or a serv fail entry if
+// c isn't a NegativeCacher.
+func putNegative(c Cacher, key, kind string) error {
+	if nc, ok := c.(NegativeCacher); ok {
+		return e.Forward(nc.PutNegative(key, kind))
+	}
+	return e.Forward(c.PutServFail(key))
+}
+
+// putNegativeTTL is like putNegative with the negative TTL.
+func putNegativeTTL(c Cacher, key, kind string, ttl time.Duration) error {
+	if nc, ok := c.(NegativeCacher); ok {
+		return e.Forward(nc.PutNegativeTTL(key, kind, ttl))
+	}
+	if tc, ok := c.(TTLCacher); ok {
+		return e.Forward(tc.PutServFailTTL(key, ttl))
+	}
+	return e.Forward(c.PutServFail(key))
+}
+
+// Entry is a copy of one cache entry.
+type Entry struct {
+	Key      string    `json:"key"`
+	Addrs    []string  `json:"addrs"`
+	ServFail bool      `json:"servfail"`
+	Negative string    `json:"negative,omitempty"`
+	Expire   time.Time `json:"expire"`
+}
+
+// Stats are the counters of a cache.
+type Stats struct {
+	// Hits is the number of entries found, including the negative and the
+	// stale ones.
+	Hits uint64 `json:"hits"`
+	// Misses is the number of keys not found or expired.
+	Misses uint64 `json:"misses"`
+	// NegativeHits is the number of negative entries found.
+	NegativeHits uint64 `json:"negative_hits"`
+	// StaleHits is the number of expired entries returned in the grace time.
+	StaleHits uint64 `json:"stale_hits"`
+	// Refreshes is the number of entries refreshed in background, stale or
+	// prefetched.
+	Refreshes uint64 `json:"refreshes"`
+	// ServFails is the number of negative entries put.
+	ServFails uint64 `json:"servfails"`
+	// Expired is the number of entries removed by the cleanup.
+	Expired uint64 `json:"expired"`
+	// Evictions is the number of entries evicted by the storer, if it
+	// limits its size.
+	Evictions uint64 `json:"evictions"`
+	// Entries is the number of entries in the storer.
+	Entries int `json:"entries"`
+}
+
+// CacheOption configures the cache in NewCache.
+type CacheOption func(c *Cache)
+
+// WithTTLBounds limits the TTLs of the entries to min and max. Zero
+// disables the limit.
+func WithTTLBounds(min, max time.Duration) CacheOption {
+	return func(c *Cache) {
+		c.min = min
+		c.max = max
+	}
+}
+
+// WithServFailExpire sets the time of life of the negative entries put
+// with PutServFail. The default is ServFailExpire.
+func WithServFailExpire(d time.Duration) CacheOption {
+	return func(c *Cache) {
+		c.neg = d
+	}
+}
+
+// WithGrace makes the cache return the expired entries for d after they
+// expire, while they are refreshed in background.
+func WithGrace(d time.Duration) CacheOption {
+	return func(c *Cache) {
+		c.grace = d
+	}
+}
+
+// WithPrefetch refreshes in background the entries with at least hits
+// hits, when they are about to expire in less than d.
+func WithPrefetch(d time.Duration, hits int) CacheOption {
+	return func(c *Cache) {
+		c.prefetch = d
+		c.prefetchHits = hits
+	}
+}
+
+// Refresher is implemented by the caches that can refresh stale entries and
+// prefetch entries before they expire. The resolvers set the refresh
+// function of their caches.
+type Refresher interface {
+	SetRefresh(f func(key string) error)
+}
+
 type Cache struct {
-	s      Storer
-	d      time.Duration
-	chstop chan chan struct{}
+	// Counters, first to be aligned to 64 bits.
+	hits         uint64
+	misses       uint64
+	negativeHits uint64
+	staleHits    uint64
+	refreshes    uint64
+	servFails    uint64
+	expired      uint64
+
+	s            Storer
+	d            time.Duration
+	neg          time.Duration
+	min          time.Duration
+	max          time.Duration
+	grace        time.Duration
+	prefetch     time.Duration
+	prefetchHits int
+	refresh      func(key string) error
+	lck          sync.Mutex
+	flight       flight
+	chstop       chan chan struct{}
 }
 
-func NewCache(s Storer, d, cleanup time.Duration) Cacher {
+// NewCache creates a cache that stores the entries in s. d is the time of
+// life of the entries put without a TTL and cleanup is the interval between
+// the removal of expired entries.
+func NewCache(s Storer, d, cleanup time.Duration, opts ...CacheOption) Cacher {
 	c := &Cache{
 		s:      s,
 		d:      d,
+		neg:    ServFailExpire,
 		chstop: make(chan chan struct{}),
 	}
+	for _, opt := range opts {
+		opt(c)
+	}
 	go func() {
 		for {
 			select {
 			case <-time.After(cleanup):
 				err := c.s.Iter(func(key string, data *Host) error {
-					if data.Expire.Before(time.Now()) {
-						er := c.s.Del(key)
-						if er != nil {
-							return e.Forward(er)
-						}
+					if !data.Expire.Add(c.grace).Before(time.Now()) {
+						return nil
+					}
+					// The entry may have been replaced after the copy.
+					cur, er := c.s.Get(key)
+					if er != nil || cur != data {
+						return nil
 					}
+					er = c.s.Del(key)
+					if e.Equal(er, ErrNotFound) {
+						return nil
+					} else if er != nil {
+						return e.Forward(er)
+					}
+					atomic.AddUint64(&c.expired, 1)
 					return nil
 				})
 				if err != nil {
@@ -158,38 +437,199 @@ func (c *Cache) Close() error {
 	return nil
 }
 
+// SetRefresh sets the function that refreshes the entries. Without it the
+// cache doesn't return the stale entries neither prefetch.
+func (c *Cache) SetRefresh(f func(key string) error) {
+	c.lck.Lock()
+	defer c.lck.Unlock()
+	c.refresh = f
+}
+
 func (c *Cache) Get(key string) *Host {
 	h, err := c.s.Get(key)
 	if err != nil {
+		atomic.AddUint64(&c.misses, 1)
 		return nil
 	}
+	now := time.Now()
+	if h.Expire.Before(now) {
+		if c.grace <= 0 || h.Expire.Add(c.grace).Before(now) {
+			atomic.AddUint64(&c.misses, 1)
+			return nil
+		}
+		if !c.revalidate(key) {
+			atomic.AddUint64(&c.misses, 1)
+			return nil
+		}
+		atomic.AddUint64(&c.staleHits, 1)
+		c.hit(h)
+		return h
+	}
+	c.hit(h)
+	hits := atomic.AddUint32(&h.hits, 1)
+	if c.prefetch > 0 && int(hits) >= c.prefetchHits && h.Expire.Sub(now) < c.prefetch {
+		c.revalidate(key)
+	}
 	return h
 }
 
+func (c *Cache) hit(h *Host) {
+	atomic.AddUint64(&c.hits, 1)
+	if h.ServFail {
+		atomic.AddUint64(&c.negativeHits, 1)
+	}
+}
+
+// revalidate refreshes key in background, once for all concurrent calls.
+// Returns false if there is no refresh function.
+func (c *Cache) revalidate(key string) bool {
+	c.lck.Lock()
+	refresh := c.refresh
+	c.lck.Unlock()
+	if refresh == nil {
+		return false
+	}
+	if c.flight.inFlight(key) {
+		return true
+	}
+	atomic.AddUint64(&c.refreshes, 1)
+	go c.flight.do(context.Background(), key, func() (interface{}, error) {
+		err := refresh(key)
+		if err != nil {
+			log.DebugLevel().Tag("dns", "cache", "refresh").Printf("Refresh %v failed: %v", key, err)
+		}
+		return nil, err
+	})
+	return true
+}
+
+// expire returns the expiration time of an entry with ttl bounded by the
+// cache's limits.
+func (c *Cache) expire(ttl time.Duration) time.Time {
+	if c.min > 0 && ttl < c.min {
+		ttl = c.min
+	}
+	if c.max > 0 && ttl > c.max {
+		ttl = c.max
+	}
+	return time.Now().Add(ttl)
+}
+
+// put replaces the entry of key. Concurrent puts of the same key may make
+// the storer's Put fail with ErrDupEntry, in this case try again.
+func (c *Cache) put(key string, h *Host) error {
+	for {
+		c.s.Del(key)
+		err := c.s.Put(key, h)
+		if !e.Equal(err, ErrDupEntry) {
+			return e.Forward(err)
+		}
+	}
+}
+
 func (c *Cache) PutAddrs(key string, ips []string) error {
-	c.s.Del(key)
+	return e.Forward(c.PutAddrsTTL(key, ips, c.d))
+}
+
+func (c *Cache) PutAddrsTTL(key string, ips []string, ttl time.Duration) error {
 	h := &Host{
 		Addrs:  ips,
-		Expire: time.Now().Add(c.d),
+		Expire: c.expire(ttl),
 	}
-	return e.Forward(c.s.Put(key, h))
+	return e.Forward(c.put(key, h))
 }
 
 func (c *Cache) PutPtr(key, ptr string) error {
-	c.s.Del(key)
+	return e.Forward(c.PutPtrTTL(key, ptr, c.d))
+}
+
+func (c *Cache) PutPtrTTL(key, ptr string, ttl time.Duration) error {
 	h := &Host{
 		Addrs:  []string{ptr},
-		Expire: time.Now().Add(c.d),
+		Expire: c.expire(ttl),
 	}
-	return e.Forward(c.s.Put(key, h))
+	return e.Forward(c.put(key, h))
 }
 
 func (c *Cache) PutServFail(key string) error {
-	c.s.Del(key)
+	return e.Forward(c.PutServFailTTL(key, c.neg))
+}
+
+func (c *Cache) PutServFailTTL(key string, ttl time.Duration) error {
+	return e.Forward(c.PutNegativeTTL(key, "", ttl))
+}
+
+func (c *Cache) PutNegative(key, kind string) error {
+	return e.Forward(c.PutNegativeTTL(key, kind, c.neg))
+}
+
+func (c *Cache) PutNegativeTTL(key, kind string, ttl time.Duration) error {
+	atomic.AddUint64(&c.servFails, 1)
 	h := &Host{
 		Addrs:    []string{""},
 		ServFail: true,
-		Expire:   time.Now().Add(c.d),
+		Negative: kind,
+		Expire:   c.expire(ttl),
+	}
+	return e.Forward(c.put(key, h))
+}
+
+func (c *Cache) Delete(key string) error {
+	return e.Forward(c.s.Del(key))
+}
+
+func (c *Cache) Flush() error {
+	err := c.s.Iter(func(key string, data *Host) error {
+		er := c.s.Del(key)
+		if er != nil && !e.Equal(er, ErrNotFound) {
+			return e.Forward(er)
+		}
+		return nil
+	})
+	return e.Forward(err)
+}
+
+func (c *Cache) Snapshot() ([]Entry, error) {
+	entries := make([]Entry, 0)
+	err := c.s.Iter(func(key string, data *Host) error {
+		entries = append(entries, Entry{
+			Key:      key,
+			Addrs:    append([]string(nil), data.Addrs...),
+			ServFail: data.ServFail,
+			Negative: data.Negative,
+			Expire:   data.Expire,
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, e.Forward(err)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Key < entries[j].Key
+	})
+	return entries, nil
+}
+
+func (c *Cache) Stats() Stats {
+	s := Stats{
+		Hits:         atomic.LoadUint64(&c.hits),
+		Misses:       atomic.LoadUint64(&c.misses),
+		NegativeHits: atomic.LoadUint64(&c.negativeHits),
+		StaleHits:    atomic.LoadUint64(&c.staleHits),
+		Refreshes:    atomic.LoadUint64(&c.refreshes),
+		ServFails:    atomic.LoadUint64(&c.servFails),
+		Expired:      atomic.LoadUint64(&c.expired),
+	}
+	if ev, ok := c.s.(interface{ Evictions() uint64 }); ok {
+		s.Evictions = ev.Evictions()
+	}
+	if l, ok := c.s.(interface{ Len() int }); ok {
+		s.Entries = l.Len()
+	} else {
+		c.s.Iter(func(key string, data *Host) error {
+			s.Entries++
+			return nil
+		})
 	}
-	return e.Forward(c.s.Put(key, h))
+	return s
 }
@@ -4,6 +4,17 @@
 
 package dns
 
+import (
+	"context"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fcavani/e"
+	"github.com/fcavani/net/dns/dnstest"
+)
+
 // func TestLocalHost(t *testing.T) {
 // 	addrs, err := LookupHostCache("localhost")
 // 	if err != nil {
@@ -17,3 +28,196 @@ package dns
 // 	}
 //
 // }
+
+func TestCacheTTL(t *testing.T) {
+	c := NewCache(NewMem(), DefaultExpire, Sleep, WithTTLBounds(time.Minute, time.Hour), WithServFailExpire(time.Minute)).(*Cache)
+	defer c.Close()
+
+	c.PutAddrsTTL("short", []string{"192.0.2.1"}, time.Second)
+	c.PutAddrsTTL("long", []string{"192.0.2.2"}, 48*time.Hour)
+	c.PutPtrTTL("192.0.2.3", "ptr.example", 10*time.Minute)
+	c.PutServFail("fail")
+	c.PutServFailTTL("nx", 0)
+
+	tests := []struct {
+		key    string
+		expire time.Duration
+	}{
+		{"short", time.Minute},
+		{"long", time.Hour},
+		{"192.0.2.3", 10 * time.Minute},
+		{"fail", time.Minute},
+		{"nx", time.Minute},
+	}
+	for _, test := range tests {
+		h := c.Get(test.key)
+		if h == nil {
+			t.Fatal("entry not found", test.key)
+		}
+		d := time.Until(h.Expire)
+		if d > test.expire || d < test.expire-time.Second {
+			t.Fatalf("%v: wrong expire %v, want %v", test.key, d, test.expire)
+		}
+	}
+
+	c = NewCache(NewMem(), DefaultExpire, Sleep).(*Cache)
+	defer c.Close()
+	c.PutAddrsTTL("zero", []string{"192.0.2.1"}, 0)
+	time.Sleep(time.Millisecond)
+	if c.Get("zero") != nil {
+		t.Fatal("expired entry returned")
+	}
+}
+
+func TestCacheStats(t *testing.T) {
+	c := NewCache(NewLRU(2, 0), DefaultExpire, Sleep).(*Cache)
+	defer c.Close()
+
+	c.PutAddrs("a.example", []string{"192.0.2.1"})
+	c.PutServFail("b.example")
+	c.Get("a.example")
+	c.Get("b.example")
+	c.Get("c.example")
+	c.PutAddrs("c.example", []string{"192.0.2.3"})
+
+	s := c.Stats()
+	if s.Hits != 2 || s.Misses != 1 || s.NegativeHits != 1 || s.ServFails != 1 || s.Evictions != 1 || s.Entries != 2 {
+		t.Fatalf("wrong stats %+v", s)
+	}
+
+	entries, err := c.Snapshot()
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+	if len(entries) != 2 || entries[0].Key != "b.example" || !entries[0].ServFail || entries[1].Addrs[0] != "192.0.2.3" {
+		t.Fatalf("wrong snapshot %+v", entries)
+	}
+
+	err = c.Delete("b.example")
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+	if c.Get("b.example") != nil {
+		t.Fatal("entry not deleted")
+	}
+	if err = c.Delete("b.example"); !e.Equal(err, ErrNotFound) {
+		t.Fatal("wrong error", err)
+	}
+	err = c.Flush()
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+	if s = c.Stats(); s.Entries != 0 {
+		t.Fatal("cache not flushed", s.Entries)
+	}
+}
+
+func TestMemConcurrent(t *testing.T) {
+	m := NewMem()
+	c := NewCache(m, DefaultExpire, time.Millisecond).(*Cache)
+	defer c.Close()
+
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for n := 0; ; n++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				key := strconv.Itoa(n % 100)
+				switch (n + i) % 4 {
+				case 0:
+					c.PutAddrsTTL(key, []string{"192.0.2.1"}, time.Duration(n%3)*time.Millisecond)
+				case 1:
+					c.PutServFail(key)
+				case 2:
+					c.Get(key)
+				case 3:
+					m.Iter(func(key string, data *Host) error {
+						m.Del(key)
+						return nil
+					})
+				}
+			}
+		}(i)
+	}
+	time.Sleep(200 * time.Millisecond)
+	close(stop)
+	wg.Wait()
+}
+
+// plainCache implements only the Cacher interface.
+type plainCache struct {
+	lck     sync.Mutex
+	entries map[string]*Host
+}
+
+func (p *plainCache) Get(key string) *Host {
+	p.lck.Lock()
+	defer p.lck.Unlock()
+	return p.entries[key]
+}
+
+func (p *plainCache) put(key string, h *Host) error {
+	p.lck.Lock()
+	defer p.lck.Unlock()
+	p.entries[key] = h
+	return nil
+}
+
+func (p *plainCache) PutAddrs(key string, ips []string) error {
+	return p.put(key, &Host{Addrs: ips})
+}
+
+func (p *plainCache) PutPtr(key, ptr string) error {
+	return p.put(key, &Host{Addrs: []string{ptr}})
+}
+
+func (p *plainCache) PutServFail(key string) error {
+	return p.put(key, &Host{Addrs: []string{""}, ServFail: true})
+}
+
+func (p *plainCache) Close() error { return nil }
+
+func TestPlainCacher(t *testing.T) {
+	var _ TTLCacher = (*Cache)(nil)
+	var _ NegativeCacher = (*Cache)(nil)
+	var _ Flusher = (*Cache)(nil)
+	var _ Snapshotter = (*Cache)(nil)
+	var _ StatsCacher = (*Cache)(nil)
+
+	s, err := dnstest.NewServer(
+		"example.com. 60 IN SOA ns.example.com. admin.example.com. 1 7200 900 1209600 60",
+		"www.example.com. 60 IN A 192.0.2.1",
+	)
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+	defer s.Close()
+	c := &plainCache{entries: make(map[string]*Host)}
+	r, err := NewResolver(WithServers(s.Host()), WithPort(s.Port()), WithHostsFile(""), WithCache(c))
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+	defer r.Close()
+
+	addrs, err := r.LookupHostContext(context.Background(), "www.example.com.")
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+	if len(addrs) != 1 || c.Get("www.example.com.") == nil {
+		t.Fatal("not cached", addrs, c.entries)
+	}
+	_, err = r.LookupHostContext(context.Background(), "nx.example.com.")
+	if err == nil {
+		t.Fatal("nx.example.com resolved")
+	}
+	if h := c.Get("nx.example.com."); h == nil || !h.ServFail {
+		t.Fatal("negative entry not cached", c.entries)
+	}
+}
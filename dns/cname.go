@@ -0,0 +1,124 @@
+// Copyright 2015 Felipe A. Cavani. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dns
+
+import (
+	"context"
+	"strings"
+
+	"github.com/fcavani/e"
+	"github.com/miekg/dns"
+)
+
+const ErrCNAMELoop = "cname loop"
+const ErrCNAMEDepth = "cname chain too long"
+
+// chain is the result of a query that followed a CNAME chain.
+type chain struct {
+	// resp is the last response.
+	resp *Response
+	// name is the canonical name, the end of the chain.
+	name string
+	// cnames are the links of the chain, in order.
+	cnames []dns.RR
+	// rrs are the records of the canonical name.
+	rrs []dns.RR
+}
+
+func (r *Resolver) cnameDepth() int {
+	if r.maxCNAME > 0 {
+		return r.maxCNAME
+	}
+	return MaxCNAME
+}
+
+// queryChain asks for the records of type qtype of name and follows the
+// CNAME chain, in the same response or with new queries.
+func (r *Resolver) queryChain(ctx context.Context, config *dns.ClientConfig, name string, qtype uint16) (*chain, error) {
+	c := &chain{name: dns.Fqdn(name)}
+	seen := map[string]bool{strings.ToLower(c.name): true}
+	for {
+		resp, err := r.query(ctx, config, c.name, qtype)
+		if err != nil {
+			return nil, e.Forward(err)
+		}
+		c.resp = resp
+		if resp.Rcode != dns.RcodeSuccess {
+			return c, nil
+		}
+
+		followed := false
+		for {
+			next := findCNAME(resp.Answer, c.name)
+			if next == nil {
+				break
+			}
+			target := strings.ToLower(next.Target)
+			if seen[target] {
+				return nil, e.New(ErrCNAMELoop)
+			}
+			if len(c.cnames) >= r.cnameDepth() {
+				return nil, e.New(ErrCNAMEDepth)
+			}
+			seen[target] = true
+			c.cnames = append(c.cnames, next)
+			c.name = next.Target
+			followed = true
+		}
+
+		for _, rr := range resp.Answer {
+			if rr.Header().Rrtype == qtype && strings.EqualFold(rr.Header().Name, c.name) {
+				c.rrs = append(c.rrs, rr)
+			}
+		}
+		if len(c.rrs) > 0 || !followed {
+			return c, nil
+		}
+		// Only the chain came, ask for the records of its end.
+	}
+}
+
+// findCNAME finds the CNAME record of name in rrs.
+func findCNAME(rrs []dns.RR, name string) *dns.CNAME {
+	for _, rr := range rrs {
+		if cname, ok := rr.(*dns.CNAME); ok && strings.EqualFold(cname.Hdr.Name, name) {
+			return cname
+		}
+	}
+	return nil
+}
+
+// putChain caches the links of the chain like the records of LookupCNAME.
+func (r *Resolver) putChain(c *chain) {
+	for _, rr := range c.cnames {
+		ttl, _ := minTTL([]dns.RR{rr})
+		putAddrsTTL(r.cache, recordKey(rr.Header().Name, dns.TypeCNAME), []string{rr.String()}, ttl)
+	}
+}
+
+// cachedCanonical follows the chain of host in the cache.
+func (r *Resolver) cachedCanonical(host string) string {
+	name := dns.Fqdn(host)
+	for i := 0; i < r.cnameDepth(); i++ {
+		h := r.cache.Get(recordKey(name, dns.TypeCNAME))
+		if h == nil {
+			break
+		}
+		texts, err := h.ReturnAddrs()
+		if err != nil {
+			break
+		}
+		rrs, err := parseRecords(texts)
+		if err != nil {
+			break
+		}
+		cname := findCNAME(rrs, name)
+		if cname == nil {
+			break
+		}
+		name = cname.Target
+	}
+	return strings.TrimSuffix(name, ".")
+}
@@ -0,0 +1,89 @@
+// Copyright 2015 Felipe A. Cavani. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dns
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"testing"
+
+	"github.com/fcavani/e"
+	"github.com/miekg/dns"
+)
+
+func TestCNAMEChain(t *testing.T) {
+	zone := map[string]string{
+		"www.example.":   "a.example.",
+		"a.example.":     "b.example.",
+		"loop1.example.": "loop2.example.",
+		"loop2.example.": "loop1.example.",
+	}
+	for i := 0; i < 10; i++ {
+		zone[fmt.Sprintf("d%v.example.", i)] = fmt.Sprintf("d%v.example.", i+1)
+	}
+	var count int32
+	// The server answers one link at a time.
+	addr, shutdown := startServer(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		atomic.AddInt32(&count, 1)
+		m := new(dns.Msg)
+		m.SetReply(req)
+		q := req.Question[0]
+		if target, ok := zone[q.Name]; ok {
+			rr, _ := dns.NewRR(q.Name + " 300 IN CNAME " + target)
+			m.Answer = append(m.Answer, rr)
+		} else if q.Name == "b.example." && q.Qtype == dns.TypeA {
+			rr, _ := dns.NewRR(q.Name + " 60 IN A 192.0.2.10")
+			m.Answer = append(m.Answer, rr)
+		}
+		w.WriteMsg(m)
+	})
+	defer shutdown()
+
+	host, port, _ := net.SplitHostPort(addr)
+	r, err := NewResolver(WithServers(host), WithPort(port), WithMaxCNAME(5))
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+	defer r.Close()
+	ctx := context.Background()
+
+	canonical, addrs, err := r.LookupCanonical(ctx, "www.example")
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+	if canonical != "b.example" || len(addrs) != 1 || addrs[0] != "192.0.2.10" {
+		t.Fatal("wrong answer", canonical, addrs)
+	}
+
+	n := atomic.LoadInt32(&count)
+	canonical, addrs, err = r.LookupCanonical(ctx, "www.example")
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+	if canonical != "b.example" || len(addrs) != 1 {
+		t.Fatal("wrong cached answer", canonical, addrs)
+	}
+	cname, err := r.LookupCNAME(ctx, "a.example")
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+	if cname != "b.example" {
+		t.Fatal("wrong cname", cname)
+	}
+	if atomic.LoadInt32(&count) != n {
+		t.Fatal("chain not cached")
+	}
+
+	_, err = r.LookupHostNoCacheContext(ctx, "loop1.example")
+	if !e.Equal(err, ErrCNAMELoop) {
+		t.Fatal("loop not detected", err)
+	}
+	_, err = r.LookupHostNoCacheContext(ctx, "d0.example")
+	if !e.Equal(err, ErrCNAMEDepth) {
+		t.Fatal("depth not limited", err)
+	}
+}
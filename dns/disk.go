@@ -0,0 +1,300 @@
+// Copyright 2015 Felipe A. Cavani. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dns
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/fcavani/e"
+	log "github.com/fcavani/slog"
+)
+
+// Minimum number of records in the log before it is compacted.
+const diskCompactMin = 1024
+
+// Disk is a Storer that keeps the entries in memory and in an append-only
+// log file, so the cache survives restarts. Every line of the log is one
+// put or delete with a checksum; a corrupt line, like one partially written
+// during a crash, is detected and skipped when the file is loaded. The log is compacted,
+// in a new file renamed over the old one, when it is loaded and when the
+// deleted records dominate it.
+type Disk struct {
+	path    string
+	f       *os.File
+	m       map[string]*Host
+	records int
+	lck     sync.Mutex
+}
+
+type diskRecord struct {
+	Del  bool   `json:"del,omitempty"`
+	Key  string `json:"key"`
+	Host *Host  `json:"host,omitempty"`
+}
+
+// NewDisk opens or creates the log in path and loads the entries that
+// aren't expired.
+func NewDisk(path string) (*Disk, error) {
+	d := &Disk{
+		path: path,
+		m:    make(map[string]*Host),
+	}
+	err := d.load()
+	if err != nil {
+		return nil, e.Forward(err)
+	}
+	err = d.compact()
+	if err != nil {
+		return nil, e.Forward(err)
+	}
+	return d, nil
+}
+
+// load reads the log. The lines that can't be decoded, like a line
+// partially written during a crash, are skipped; NewDisk compacts the log
+// after it, so they are gone from the file too.
+func (d *Disk) load() error {
+	f, err := os.Open(d.path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return e.New(err)
+	}
+	defer f.Close()
+
+	now := time.Now()
+	r := bufio.NewReader(f)
+	line := 0
+	for {
+		data, err := r.ReadBytes('\n')
+		if len(data) > 0 {
+			line++
+			d.apply(bytes.TrimSuffix(data, []byte{'\n'}), line, now)
+		}
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			log.ErrorLevel().Tag("dns", "cache", "disk").Printf("Discarding %v from line %v: %v", d.path, line+1, err)
+			break
+		}
+	}
+	return nil
+}
+
+// apply applies the record in the line of the log.
+func (d *Disk) apply(data []byte, line int, now time.Time) {
+	rec, err := decodeRecord(data)
+	if err != nil {
+		log.ErrorLevel().Tag("dns", "cache", "disk").Printf("Skipping line %v of %v: %v", line, d.path, err)
+		return
+	}
+	if rec.Del || rec.Host == nil || rec.Host.Expire.Before(now) {
+		delete(d.m, rec.Key)
+		return
+	}
+	d.m[rec.Key] = rec.Host
+}
+
+func encodeRecord(rec *diskRecord) ([]byte, error) {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return nil, e.New(err)
+	}
+	line := make([]byte, 0, len(data)+10)
+	line = append(line, fmt.Sprintf("%08x ", crc32.ChecksumIEEE(data))...)
+	line = append(line, data...)
+	line = append(line, '\n')
+	return line, nil
+}
+
+func decodeRecord(line []byte) (*diskRecord, error) {
+	i := bytes.IndexByte(line, ' ')
+	if i != 8 {
+		return nil, e.New("invalid record")
+	}
+	var sum uint32
+	_, err := fmt.Sscanf(string(line[:i]), "%08x", &sum)
+	if err != nil {
+		return nil, e.New("invalid checksum")
+	}
+	data := line[i+1:]
+	if crc32.ChecksumIEEE(data) != sum {
+		return nil, e.New("checksum mismatch")
+	}
+	rec := new(diskRecord)
+	err = json.Unmarshal(data, rec)
+	if err != nil {
+		return nil, e.New(err)
+	}
+	return rec, nil
+}
+
+// compact writes the entries in a new log and replaces the old one.
+func (d *Disk) compact() error {
+	tmp := d.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return e.New(err)
+	}
+	w := bufio.NewWriter(f)
+	now := time.Now()
+	records := 0
+	for key, h := range d.m {
+		if h.Expire.Before(now) {
+			delete(d.m, key)
+			continue
+		}
+		line, err := encodeRecord(&diskRecord{Key: key, Host: h})
+		if err != nil {
+			f.Close()
+			return e.Forward(err)
+		}
+		_, err = w.Write(line)
+		if err != nil {
+			f.Close()
+			return e.New(err)
+		}
+		records++
+	}
+	err = w.Flush()
+	if err == nil {
+		err = f.Sync()
+	}
+	if err != nil {
+		f.Close()
+		return e.New(err)
+	}
+	err = f.Close()
+	if err != nil {
+		return e.New(err)
+	}
+	err = os.Rename(tmp, d.path)
+	if err != nil {
+		return e.New(err)
+	}
+
+	if d.f != nil {
+		d.f.Close()
+	}
+	d.f, err = os.OpenFile(d.path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		d.f = nil
+		return e.New(err)
+	}
+	d.records = records
+	return nil
+}
+
+// append writes one record in the log, with one write call.
+func (d *Disk) append(rec *diskRecord) error {
+	if d.f == nil {
+		return e.New("disk storer closed")
+	}
+	line, err := encodeRecord(rec)
+	if err != nil {
+		return e.Forward(err)
+	}
+	_, err = d.f.Write(line)
+	if err != nil {
+		return e.New(err)
+	}
+	d.records++
+	if d.records > diskCompactMin && d.records > 2*len(d.m) {
+		return e.Forward(d.compact())
+	}
+	return nil
+}
+
+func (d *Disk) Get(key string) (*Host, error) {
+	d.lck.Lock()
+	defer d.lck.Unlock()
+	data, found := d.m[key]
+	if !found {
+		return nil, e.New(ErrNotFound)
+	}
+	return data, nil
+}
+
+func (d *Disk) Put(key string, data *Host) error {
+	d.lck.Lock()
+	defer d.lck.Unlock()
+	_, found := d.m[key]
+	if found {
+		return e.New(ErrDupEntry)
+	}
+	d.m[key] = data
+	return e.Forward(d.append(&diskRecord{Key: key, Host: data}))
+}
+
+func (d *Disk) Del(key string) error {
+	d.lck.Lock()
+	defer d.lck.Unlock()
+	_, found := d.m[key]
+	if !found {
+		return e.New(ErrNotFound)
+	}
+	delete(d.m, key)
+	return e.Forward(d.append(&diskRecord{Del: true, Key: key}))
+}
+
+// Len returns the number of entries.
+func (d *Disk) Len() int {
+	d.lck.Lock()
+	defer d.lck.Unlock()
+	return len(d.m)
+}
+
+// Iter calls f for a copy of the entries, so f can call the other methods.
+func (d *Disk) Iter(f func(key string, data *Host) error) error {
+	d.lck.Lock()
+	keys := make([]string, 0, len(d.m))
+	hosts := make([]*Host, 0, len(d.m))
+	for k, v := range d.m {
+		keys = append(keys, k)
+		hosts = append(hosts, v)
+	}
+	d.lck.Unlock()
+
+	for i, k := range keys {
+		err := f(k, hosts[i])
+		if e.Equal(err, ErrIterStop) {
+			return nil
+		} else if err != nil {
+			return e.Forward(err)
+		}
+	}
+	return nil
+}
+
+// Sync commits the log to the disk.
+func (d *Disk) Sync() error {
+	d.lck.Lock()
+	defer d.lck.Unlock()
+	if d.f == nil {
+		return e.New("disk storer closed")
+	}
+	return e.Forward(d.f.Sync())
+}
+
+// Close compacts the log and closes it.
+func (d *Disk) Close() error {
+	d.lck.Lock()
+	defer d.lck.Unlock()
+	if d.f == nil {
+		return nil
+	}
+	err := d.compact()
+	d.f.Close()
+	d.f = nil
+	return e.Forward(err)
+}
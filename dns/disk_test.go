@@ -0,0 +1,99 @@
+// Copyright 2015 Felipe A. Cavani. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dns
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/fcavani/e"
+)
+
+func TestDisk(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dnsdisk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "cache.log")
+
+	d, err := NewDisk(path)
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+	c := NewCache(d, DefaultExpire, Sleep).(*Cache)
+	c.PutAddrs("disk.example", []string{"192.0.2.1", "2001:db8::1"})
+	c.PutAddrs("deleted.example", []string{"192.0.2.2"})
+	c.PutAddrsTTL("expired.example", []string{"192.0.2.3"}, time.Millisecond)
+	c.PutServFail("fail.example")
+	c.PutAddrs("stale.example", []string{"192.0.2.4"})
+	d.Del("deleted.example")
+	c.Close()
+	// Simulates a crash: no Close and a partial record.
+	err = d.Sync()
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A corrupt line doesn't hide the records after it.
+	f.WriteString("0badc0de {\"key\":\"corrupt.example\"}\n")
+	for _, rec := range []*diskRecord{
+		{Key: "after.example", Host: &Host{Addrs: []string{"192.0.2.5"}, Expire: time.Now().Add(time.Hour)}},
+		{Del: true, Key: "stale.example"},
+	} {
+		line, err := encodeRecord(rec)
+		if err != nil {
+			t.Fatal(e.Trace(e.Forward(err)))
+		}
+		f.Write(line)
+	}
+	f.WriteString(`0badc0de {"key":"partial.exa`)
+	f.Close()
+	time.Sleep(2 * time.Millisecond)
+
+	d2, err := NewDisk(path)
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+	defer d2.Close()
+	h, err := d2.Get("disk.example")
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+	if len(h.Addrs) != 2 || h.Addrs[1] != "2001:db8::1" || h.Expire.Before(time.Now()) {
+		t.Fatal("wrong entry", h)
+	}
+	h, err = d2.Get("fail.example")
+	if err != nil || !h.ServFail {
+		t.Fatal("negative entry not loaded", err)
+	}
+	if h, err = d2.Get("after.example"); err != nil || h.Addrs[0] != "192.0.2.5" {
+		t.Fatal("entry after the corrupt line not loaded", err)
+	}
+	for _, key := range []string{"deleted.example", "expired.example", "stale.example", "corrupt.example", "partial.example"} {
+		if _, err = d2.Get(key); !e.Equal(err, ErrNotFound) {
+			t.Fatal("entry must not be loaded:", key)
+		}
+	}
+	if d2.records != 3 {
+		t.Fatal("log not compacted", d2.records)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range bytes.Split(bytes.TrimSuffix(data, []byte{'\n'}), []byte{'\n'}) {
+		if _, err = decodeRecord(line); err != nil {
+			t.Fatal("corrupt line kept:", string(line))
+		}
+	}
+}
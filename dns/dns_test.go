@@ -5,11 +5,14 @@
 package dns
 
 import (
+	"context"
 	"net/url"
 	"testing"
 	"time"
 
 	"github.com/fcavani/e"
+	"github.com/fcavani/net/dns/dnstest"
+	"github.com/miekg/dns"
 )
 
 func TestResolveUrl(t *testing.T) {
@@ -31,7 +34,29 @@ func TestResolveUrl(t *testing.T) {
 	t.Log(u)
 }
 
+// useServer points the default resolver at s, the returned function
+// restores it.
+func useServer(t *testing.T, s *dnstest.Server) func() {
+	r, err := NewResolver(WithServers(s.Host()), WithPort(s.Port()), WithHostsFile(""), WithBrowser(s), WithMulticastAddrs(s.Addr))
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+	old := defaultResolver
+	defaultResolver = r
+	return func() {
+		defaultResolver = old
+		r.Close()
+	}
+}
+
 func TestPtr(t *testing.T) {
+	s, err := dnstest.NewServer("183.119.149.200.in-addr.arpa. 60 IN PTR 183.119.149.200.in-addr.arpa.telemar.net.br.")
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+	defer s.Close()
+	defer useServer(t, s)()
+
 	host, err := LookupIp("200.149.119.183")
 	if err != nil {
 		t.Fatal(err)
@@ -40,7 +65,7 @@ func TestPtr(t *testing.T) {
 		t.Fatal("wrong host")
 	}
 	host, err = LookupIp("2800:3f0:4004:800::1013")
-	if err != nil && !e.Contains(err, "can't resolve") {
+	if err != nil && !e.Equal(err, ErrCantResolve) {
 		t.Fatal(err)
 	}
 
@@ -54,31 +79,53 @@ func TestPtr(t *testing.T) {
 }
 
 func TestLookupHostWithServers(t *testing.T) {
-	addrs, err := LookupHostWithServers("www.google.com", []string{"8.8.8.8", "8.8.4.4"}, 5, 30)
+	s, err := dnstest.NewServer(
+		"www.google.com. 60 IN A 192.0.2.1",
+		"www.google.com. 60 IN AAAA 2001:db8::1",
+	)
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+	defer s.Close()
+	defer useServer(t, s)()
+
+	addrs, err := LookupHostWithServers("www.google.com", []string{s.Host()}, 5, 30)
 	if err != nil {
 		t.Fatal(err)
 	}
-	if len(addrs) <= 0 {
+	if len(addrs) != 2 {
 		t.Fatal("LookupHostWithServers fail")
 	}
 }
 
 func TestMDNS(t *testing.T) {
-	// addrs, err := querymDNS("_workstation._tcp", false)
-	addrs, err := querymDNS("_companion-link._tcp.local", true)
+	s, err := dnstest.NewServer(
+		"_companion-link._tcp.local. 120 IN PTR mac._companion-link._tcp.local.",
+		"mac._companion-link._tcp.local. 120 IN SRV 0 0 49152 mac.local.",
+		"mac.local. 120 IN A 192.0.2.10",
+		"mac.local. 120 IN AAAA fe80::10",
+	)
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+	defer s.Close()
+	defer useServer(t, s)()
+
+	addrs, err := LookupService(context.Background(), "_companion-link._tcp")
 	if err != nil {
 		t.Fatal(err)
 	}
-	if len(addrs) == 0 {
+	if len(addrs) != 2 {
 		t.Fatal("no response")
 	}
 	t.Log(addrs)
 	// Cache
-	addrs, err = querymDNS("_companion-link._tcp.local", true)
+	s.Remove("_companion-link._tcp.local.", dns.TypePTR)
+	addrs, err = LookupService(context.Background(), "_companion-link._tcp")
 	if err != nil {
 		t.Fatal(e.Trace(err))
 	}
-	if len(addrs) == 0 {
+	if len(addrs) != 2 {
 		t.Fatal("no response")
 	}
 	t.Log(addrs)
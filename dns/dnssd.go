@@ -0,0 +1,640 @@
+// Copyright 2015 Felipe A. Cavani. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dns
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/fcavani/e"
+	log "github.com/fcavani/slog"
+	mdns "github.com/grandcat/zeroconf"
+	"github.com/miekg/dns"
+)
+
+// ServiceInstance is an instance of a DNS-SD service, RFC 6763.
+type ServiceInstance struct {
+	// Instance is the name of the instance, like "Office Printer".
+	Instance string
+	// Service is the service type, like "_ipp._tcp".
+	Service string
+	// Domain is the domain of the service, "local".
+	Domain string
+	// Host is the target of the SRV record of the instance.
+	Host string
+	Port int
+	// Addrs are the addresses of Host.
+	Addrs []string
+	// Text holds the key/value pairs of the TXT record. The keys are in
+	// lower case and the keys without value have an empty value.
+	Text map[string]string
+	// TTL is the time of life of the records of the instance.
+	TTL time.Duration
+}
+
+// Name returns the full domain name of the instance.
+func (s *ServiceInstance) Name() string {
+	return escapeLabel(s.Instance) + "." + s.Service + "." + s.Domain + "."
+}
+
+func (s *ServiceInstance) String() string {
+	return fmt.Sprintf("%v %v:%v %v", s.Name(), s.Host, s.Port, s.Addrs)
+}
+
+// equal compares the instances, without the TTLs.
+func (s *ServiceInstance) equal(other *ServiceInstance) bool {
+	a, b := *s, *other
+	a.TTL, b.TTL = 0, 0
+	return reflect.DeepEqual(a, b)
+}
+
+// newServiceInstance converts the entry of the browser.
+func newServiceInstance(entry *mdns.ServiceEntry) *ServiceInstance {
+	s := &ServiceInstance{
+		Instance: unescapeLabel(entry.Instance),
+		Service:  strings.Trim(entry.Service, "."),
+		Domain:   strings.Trim(entry.Domain, "."),
+		Port:     entry.Port,
+		Text:     parseText(entry.Text),
+		TTL:      time.Duration(entry.TTL) * time.Second,
+	}
+	if s.Domain == "" {
+		s.Domain = "local"
+	}
+	if entry.HostName != "" {
+		s.Host = dns.Fqdn(entry.HostName)
+	}
+	for _, ip := range entry.AddrIPv4 {
+		s.Addrs = append(s.Addrs, ip.String())
+	}
+	for _, ip := range entry.AddrIPv6 {
+		s.Addrs = append(s.Addrs, ip.String())
+	}
+	return s
+}
+
+// merge adds the addresses of other, the same instance seen in other
+// interface.
+func (s *ServiceInstance) merge(other *ServiceInstance) {
+	for _, addr := range other.Addrs {
+		found := false
+		for _, a := range s.Addrs {
+			if a == addr {
+				found = true
+				break
+			}
+		}
+		if !found {
+			s.Addrs = append(s.Addrs, addr)
+		}
+	}
+	if other.TTL < s.TTL {
+		s.TTL = other.TTL
+	}
+}
+
+// records returns the PTR, SRV, TXT, A and AAAA records of the instance,
+// the form of the instances in the cache.
+func (s *ServiceInstance) records() []dns.RR {
+	ttl := uint32(s.TTL / time.Second)
+	hdr := func(name string, rrtype uint16) dns.RR_Header {
+		return dns.RR_Header{Name: name, Rrtype: rrtype, Class: dns.ClassINET, Ttl: ttl}
+	}
+	name := s.Name()
+	rrs := []dns.RR{&dns.PTR{Hdr: hdr(s.Service+"."+s.Domain+".", dns.TypePTR), Ptr: name}}
+	if len(s.Text) > 0 {
+		txt := make([]string, 0, len(s.Text))
+		for k, v := range s.Text {
+			txt = append(txt, k+"="+v)
+		}
+		sort.Strings(txt)
+		rrs = append(rrs, &dns.TXT{Hdr: hdr(name, dns.TypeTXT), Txt: txt})
+	}
+	if s.Host == "" {
+		return rrs
+	}
+	rrs = append(rrs, &dns.SRV{Hdr: hdr(name, dns.TypeSRV), Port: uint16(s.Port), Target: s.Host})
+	for _, addr := range s.Addrs {
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			continue
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			rrs = append(rrs, &dns.A{Hdr: hdr(s.Host, dns.TypeA), A: ip4})
+			continue
+		}
+		rrs = append(rrs, &dns.AAAA{Hdr: hdr(s.Host, dns.TypeAAAA), AAAA: ip})
+	}
+	return rrs
+}
+
+// instancesFromRecords is the reverse of records.
+func instancesFromRecords(rrs []dns.RR) []*ServiceInstance {
+	instances := make([]*ServiceInstance, 0, len(rrs))
+	for _, rr := range rrs {
+		ptr, ok := rr.(*dns.PTR)
+		if !ok {
+			continue
+		}
+		labels := dns.SplitDomainName(ptr.Hdr.Name)
+		n := len(ptr.Ptr) - len(ptr.Hdr.Name) - 1
+		if len(labels) < 3 || n <= 0 || !strings.EqualFold(ptr.Ptr[n+1:], ptr.Hdr.Name) {
+			continue
+		}
+		s := &ServiceInstance{
+			Instance: unescapeLabel(ptr.Ptr[:n]),
+			Service:  labels[0] + "." + labels[1],
+			Domain:   strings.Join(labels[2:], "."),
+			TTL:      time.Duration(ptr.Hdr.Ttl) * time.Second,
+		}
+		var txt []string
+		for _, rr := range rrs {
+			if !strings.EqualFold(rr.Header().Name, ptr.Ptr) {
+				continue
+			}
+			switch rr := rr.(type) {
+			case *dns.SRV:
+				s.Host = rr.Target
+				s.Port = int(rr.Port)
+			case *dns.TXT:
+				txt = append(txt, rr.Txt...)
+			}
+		}
+		s.Text = parseText(txt)
+		for _, rr := range rrs {
+			if s.Host == "" || !strings.EqualFold(rr.Header().Name, s.Host) {
+				continue
+			}
+			switch rr := rr.(type) {
+			case *dns.A:
+				s.Addrs = append(s.Addrs, rr.A.String())
+			case *dns.AAAA:
+				s.Addrs = append(s.Addrs, rr.AAAA.String())
+			}
+		}
+		instances = append(instances, s)
+	}
+	return instances
+}
+
+// parseText parses the key/value pairs of a TXT record. Like RFC 6763
+// section 6.4 says, the keys are case insensitive and only the first
+// occurrence of a key counts.
+func parseText(txt []string) map[string]string {
+	m := make(map[string]string, len(txt))
+	for _, t := range txt {
+		k, v := t, ""
+		if i := strings.Index(t, "="); i >= 0 {
+			k, v = t[:i], t[i+1:]
+		}
+		if k == "" {
+			continue
+		}
+		k = strings.ToLower(k)
+		if _, ok := m[k]; !ok {
+			m[k] = v
+		}
+	}
+	return m
+}
+
+// escapeLabel escapes the instance name to be the first label of a domain
+// name in the presentation format.
+func escapeLabel(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case strings.IndexByte(". \\\"();@$", c) >= 0:
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c < ' ' || c > '~':
+			fmt.Fprintf(&b, "\\%03d", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// unescapeLabel is the reverse of escapeLabel.
+func unescapeLabel(s string) string {
+	b := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' || i+1 == len(s) {
+			b = append(b, s[i])
+			continue
+		}
+		if i+3 < len(s) && isDigit(s[i+1]) && isDigit(s[i+2]) && isDigit(s[i+3]) {
+			n := int(s[i+1]-'0')*100 + int(s[i+2]-'0')*10 + int(s[i+3]-'0')
+			if n < 256 {
+				b = append(b, byte(n))
+				i += 3
+				continue
+			}
+		}
+		b = append(b, s[i+1])
+		i++
+	}
+	return string(b)
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// serviceName returns the name of service in .local.
+func serviceName(service string) string {
+	return strings.TrimSuffix(strings.TrimSuffix(service, "."), ".local") + ".local"
+}
+
+// LookupService finds the addresses of the instances of the service type,
+// like "_ipp._tcp", browsing for at most MulticastTimeout. The ".local"
+// suffix is optional.
+func (r *Resolver) LookupService(ctx context.Context, service string) ([]string, error) {
+	instances, err := r.LookupServiceInstances(ctx, service)
+	if err != nil {
+		return nil, e.Forward(err)
+	}
+	addrs := make([]string, 0, len(instances))
+	for _, s := range instances {
+		addrs = append(addrs, s.Addrs...)
+	}
+	return addrs, nil
+}
+
+// LookupServiceInstances finds the instances of the service type, like
+// "_ipp._tcp", browsing for at most MulticastTimeout. The ".local" suffix
+// is optional.
+func (r *Resolver) LookupServiceInstances(ctx context.Context, service string) (instances []*ServiceInstance, err error) {
+	if service == "" {
+		return nil, e.New("invalid service")
+	}
+	return r.lookupServiceInstances(ctx, serviceName(service), true)
+}
+
+// LookupServiceInstance finds the instance of the service type, like
+// LookupServiceInstances does. If the instance isn't in the cache the
+// service is browsed again.
+func (r *Resolver) LookupServiceInstance(ctx context.Context, instance, service string) (*ServiceInstance, error) {
+	if instance == "" {
+		return nil, e.New("invalid instance")
+	}
+	if service == "" {
+		return nil, e.New("invalid service")
+	}
+	service = serviceName(service)
+	for _, useCache := range []bool{true, false} {
+		instances, err := r.lookupServiceInstances(ctx, service, useCache)
+		if err != nil && e.Find(err, ErrNXDomain) < 0 {
+			return nil, e.Forward(err)
+		}
+		for _, s := range instances {
+			if strings.EqualFold(s.Instance, instance) {
+				return s, nil
+			}
+		}
+	}
+	return nil, negativeErr(ErrNXDomain)
+}
+
+func (r *Resolver) lookupServiceInstances(ctx context.Context, service string, useCache bool) (instances []*ServiceInstance, err error) {
+	start := time.Now()
+	defer func() {
+		log.DebugLevel().Tag("dns", "mdns").Printf("LookupService %v took: %v", service, time.Since(start))
+	}()
+
+	if useCache {
+		h := r.cache.Get(service)
+		if h != nil {
+			// The negative entries aren't cached for long.
+			texts, err := h.ReturnAddrs()
+			if err == nil {
+				rrs, err := parseRecords(texts)
+				if err == nil {
+					return instancesFromRecords(rrs), nil
+				}
+			}
+		}
+	}
+
+	for {
+		v, err, shared := r.flight.do(ctx, "service "+service, func() (interface{}, error) {
+			return r.browseService(ctx, service)
+		})
+		if shared && isCtxErr(err) && !ctxDone(ctx) {
+			// The first caller gave up, try again.
+			continue
+		}
+		if err != nil {
+			return nil, e.Forward(err)
+		}
+		return v.([]*ServiceInstance), nil
+	}
+}
+
+// browseService browses for service and caches the records of the
+// instances found, and the addresses of their hosts.
+func (r *Resolver) browseService(ctx context.Context, service string) (instances []*ServiceInstance, err error) {
+	defer func() {
+		if ctxDone(ctx) {
+			return
+		}
+		if len(instances) == 0 {
+			putNegative(r.cache, service, ErrNXDomain)
+			return
+		}
+		r.cacheInstances(service, instances)
+	}()
+
+	browse, cancel := context.WithTimeout(ctx, MulticastTimeout)
+	defer cancel()
+	entries := make(chan *mdns.ServiceEntry, 10)
+	err = r.multicast().Browse(browse, strings.TrimSuffix(service, ".local"), "local.", entries)
+	if err != nil {
+		return nil, e.Push(err, "failed to browse")
+	}
+
+	// The browser closes entries when browse is done. After the first
+	// entry the others are waited for multicastGrace.
+	found := make(map[string]*ServiceInstance)
+	var grace <-chan time.Time
+loop:
+	for {
+		select {
+		case entry, ok := <-entries:
+			if !ok {
+				break loop
+			}
+			log.DebugLevel().Tag("dns", "mdns").Println("mDNS entry:", entry)
+			grace = time.After(multicastGrace)
+			if entry.TTL == 0 {
+				// A goodbye.
+				continue
+			}
+			s := newServiceInstance(entry)
+			key := strings.ToLower(s.Instance)
+			if old, ok := found[key]; ok {
+				old.merge(s)
+				continue
+			}
+			found[key] = s
+			instances = append(instances, s)
+		case <-grace:
+			break loop
+		}
+	}
+	cancel()
+	for range entries {
+	}
+	log.DebugLevel().Tag("dns", "mdns").Println("No more entries.")
+
+	if len(instances) == 0 {
+		if ctxDone(ctx) {
+			return nil, ctxErr(ctx, nil)
+		}
+		return nil, negativeErr(ErrNXDomain)
+	}
+	sort.Slice(instances, func(i, j int) bool {
+		return instances[i].Instance < instances[j].Instance
+	})
+	for _, s := range instances {
+		if len(s.Addrs) > 1 {
+			s.Addrs = sortAddrs(s.Addrs)
+		}
+	}
+	return instances, nil
+}
+
+// cacheInstances puts the records of the instances in the entry of
+// service and the addresses of the hosts in .local in their entries.
+func (r *Resolver) cacheInstances(service string, instances []*ServiceInstance) {
+	var rrs []dns.RR
+	for _, s := range instances {
+		rrs = append(rrs, s.records()...)
+		if len(s.Addrs) == 0 || !isLocal(s.Host) {
+			continue
+		}
+		host := strings.TrimSuffix(s.Host, ".")
+		if s.TTL == 0 {
+			r.cache.PutAddrs(host, s.Addrs)
+			continue
+		}
+		putAddrsTTL(r.cache, host, s.Addrs, s.TTL)
+	}
+	texts := make([]string, 0, len(rrs))
+	for _, rr := range rrs {
+		texts = append(texts, rr.String())
+	}
+	ttl, _ := minTTL(rrs)
+	if ttl == 0 {
+		r.cache.PutAddrs(service, texts)
+		return
+	}
+	putAddrsTTL(r.cache, service, texts, ttl)
+}
+
+// ServiceEventType is the kind of a ServiceEvent.
+type ServiceEventType int
+
+const (
+	// ServiceAdded is sent for a new instance.
+	ServiceAdded ServiceEventType = iota
+	// ServiceUpdated is sent when the host, the port, the addresses or the
+	// text of an instance change.
+	ServiceUpdated
+	// ServiceRemoved is sent when an instance isn't found anymore and its
+	// TTL is over.
+	ServiceRemoved
+)
+
+func (t ServiceEventType) String() string {
+	switch t {
+	case ServiceAdded:
+		return "added"
+	case ServiceUpdated:
+		return "updated"
+	case ServiceRemoved:
+		return "removed"
+	default:
+		return "unknown"
+	}
+}
+
+// ServiceEvent is a change of the instances of a service.
+type ServiceEvent struct {
+	Type     ServiceEventType
+	Instance *ServiceInstance
+}
+
+// BrowseServices browses for the service type, like "_ipp._tcp", until ctx
+// is done, and sends the changes of its instances to events. An instance is
+// removed with its goodbye, or when its TTL is over and it doesn't answer
+// once more. Like Browser, it returns at once and closes events when ctx is
+// done. The instances found update the cache.
+func (r *Resolver) BrowseServices(ctx context.Context, service string, events chan<- *ServiceEvent) error {
+	if service == "" {
+		return e.New("invalid service")
+	}
+	if events == nil {
+		return e.New("invalid events channel")
+	}
+	entries := make(chan *mdns.ServiceEntry, 10)
+	err := r.multicast().Browse(ctx, strings.TrimSuffix(serviceName(service), ".local"), "local.", entries)
+	if err != nil {
+		return e.Push(err, "failed to browse")
+	}
+	go r.watch(ctx, serviceName(service), entries, events)
+	return nil
+}
+
+// watch sends the events of the entries of the browse of service. The
+// browser doesn't send the entries again while they are alive, so when the
+// TTL of an instance is over the service is asked once more, RFC 6762
+// section 5.2.
+func (r *Resolver) watch(ctx context.Context, service string, entries <-chan *mdns.ServiceEntry, events chan<- *ServiceEvent) {
+	defer close(events)
+	defer func() {
+		// The browser sends the entries until it is done.
+		go func() {
+			for range entries {
+			}
+		}()
+	}()
+	send := func(t ServiceEventType, s *ServiceInstance) bool {
+		select {
+		case events <- &ServiceEvent{Type: t, Instance: s}:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+
+	known := make(map[string]*ServiceInstance)
+	expire := make(map[string]time.Time)
+	lifetime := func(s *ServiceInstance) time.Duration {
+		if s.TTL < time.Second {
+			return time.Second
+		}
+		return s.TTL
+	}
+	update := func(s *ServiceInstance) bool {
+		if len(s.Addrs) > 1 {
+			s.Addrs = sortAddrs(s.Addrs)
+		}
+		key := strings.ToLower(s.Instance)
+		expire[key] = time.Now().Add(lifetime(s))
+		old, ok := known[key]
+		known[key] = s
+		if !ok {
+			return send(ServiceAdded, s)
+		} else if !old.equal(s) {
+			return send(ServiceUpdated, s)
+		}
+		return true
+	}
+	remove := func(key string) bool {
+		s, ok := known[key]
+		if !ok {
+			return true
+		}
+		delete(known, key)
+		delete(expire, key)
+		return send(ServiceRemoved, s)
+	}
+	cache := func() {
+		if len(known) == 0 {
+			putNegative(r.cache, service, ErrNXDomain)
+			return
+		}
+		instances := make([]*ServiceInstance, 0, len(known))
+		for _, s := range known {
+			instances = append(instances, s)
+		}
+		sort.Slice(instances, func(i, j int) bool {
+			return instances[i].Instance < instances[j].Instance
+		})
+		r.cacheInstances(service, instances)
+	}
+
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
+	var wake <-chan time.Time
+	schedule := func() {
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		wake = nil
+		var first time.Time
+		for _, t := range expire {
+			if first.IsZero() || t.Before(first) {
+				first = t
+			}
+		}
+		if first.IsZero() {
+			return
+		}
+		timer.Reset(time.Until(first))
+		wake = timer.C
+	}
+	schedule()
+
+	for {
+		select {
+		case entry, ok := <-entries:
+			if !ok {
+				return
+			}
+			log.DebugLevel().Tag("dns", "mdns").Println("mDNS entry:", entry)
+			s := newServiceInstance(entry)
+			if entry.TTL == 0 {
+				if !remove(strings.ToLower(s.Instance)) {
+					return
+				}
+			} else if !update(s) {
+				return
+			}
+		case <-wake:
+			instances, err := r.lookupServiceInstances(ctx, service, false)
+			if ctxDone(ctx) {
+				return
+			}
+			now := time.Now()
+			if err != nil && e.Find(err, ErrNXDomain) < 0 {
+				log.DebugLevel().Tag("dns", "mdns").Printf("Browse %v failed: %v", service, err)
+				for key, t := range expire {
+					if !t.After(now) {
+						expire[key] = now.Add(lifetime(known[key]))
+					}
+				}
+			} else {
+				found := make(map[string]bool, len(instances))
+				for _, s := range instances {
+					found[strings.ToLower(s.Instance)] = true
+					if !update(s) {
+						return
+					}
+				}
+				for key, t := range expire {
+					if !found[key] && !t.After(now) && !remove(key) {
+						return
+					}
+				}
+			}
+		case <-ctx.Done():
+			return
+		}
+		cache()
+		schedule()
+	}
+}
@@ -0,0 +1,262 @@
+// Copyright 2015 Felipe A. Cavani. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dns
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fcavani/e"
+	"github.com/fcavani/net/dns/dnstest"
+	mdns "github.com/grandcat/zeroconf"
+	"github.com/miekg/dns"
+)
+
+func TestServiceInstanceRecords(t *testing.T) {
+	s := &ServiceInstance{
+		Instance: "Felipe's Printer (2.0) é",
+		Service:  "_ipp._tcp",
+		Domain:   "local",
+		Host:     "printer.local.",
+		Port:     631,
+		Addrs:    []string{"192.0.2.30", "fe80::30"},
+		Text:     map[string]string{"rp": "ipp/print", "color": ""},
+		TTL:      120 * time.Second,
+	}
+	texts := make([]string, 0)
+	for _, rr := range s.records() {
+		texts = append(texts, rr.String())
+	}
+	rrs, err := parseRecords(texts)
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+	instances := instancesFromRecords(rrs)
+	if len(instances) != 1 {
+		t.Fatal("wrong instances", instances)
+	}
+	if !instances[0].equal(s) || instances[0].TTL != s.TTL {
+		t.Fatal("wrong instance", instances[0])
+	}
+	if unescapeLabel(escapeLabel(s.Instance)) != s.Instance {
+		t.Fatal("wrong escape")
+	}
+
+	text := parseText([]string{"Key=a", "key=b", "flag", "=c", "empty="})
+	if len(text) != 3 || text["key"] != "a" || text["flag"] != "" || text["empty"] != "" {
+		t.Fatal("wrong text", text)
+	}
+}
+
+func TestServiceInstances(t *testing.T) {
+	s, err := dnstest.NewServer(
+		"_ipp._tcp.local. 120 IN PTR Office\\ Printer._ipp._tcp.local.",
+		"Office\\ Printer._ipp._tcp.local. 120 IN SRV 0 0 631 printer.local.",
+		"Office\\ Printer._ipp._tcp.local. 120 IN TXT \"rp=ipp/print\" \"Color=T\"",
+		"printer.local. 120 IN A 192.0.2.30",
+		"_ipp._tcp.local. 120 IN PTR Lab._ipp._tcp.local.",
+		"Lab._ipp._tcp.local. 120 IN SRV 0 0 8631 lab.local.",
+		"lab.local. 120 IN A 192.0.2.31",
+	)
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+	defer s.Close()
+	defer useServer(t, s)()
+	ctx := context.Background()
+
+	instances, err := LookupServiceInstances(ctx, "_ipp._tcp")
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+	if len(instances) != 2 {
+		t.Fatal("wrong instances", instances)
+	}
+	lab, office := instances[0], instances[1]
+	if office.Instance != "Office Printer" || office.Service != "_ipp._tcp" || office.Domain != "local" {
+		t.Fatal("wrong instance", office)
+	}
+	if office.Host != "printer.local." || office.Port != 631 || len(office.Addrs) != 1 || office.Addrs[0] != "192.0.2.30" {
+		t.Fatal("wrong instance", office)
+	}
+	if office.Text["rp"] != "ipp/print" || office.Text["color"] != "T" || office.TTL != 120*time.Second {
+		t.Fatal("wrong instance", office, office.Text)
+	}
+	if lab.Instance != "Lab" || lab.Port != 8631 {
+		t.Fatal("wrong instance", lab)
+	}
+
+	// The instances and the hosts are cached.
+	n := s.Queries()
+	s.Remove("_ipp._tcp.local.", dns.TypePTR)
+	instances, err = LookupServiceInstances(ctx, "_ipp._tcp.local.")
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+	if len(instances) != 2 || !instances[1].equal(office) {
+		t.Fatal("not cached", instances)
+	}
+	addrs, err := LookupHostContext(ctx, "lab.local")
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+	if len(addrs) != 1 || addrs[0] != "192.0.2.31" || s.Queries() != n {
+		t.Fatal("host not cached", addrs)
+	}
+
+	si, err := LookupServiceInstance(ctx, "office printer", "_ipp._tcp")
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+	if si.Port != 631 {
+		t.Fatal("wrong instance", si)
+	}
+	_, err = LookupServiceInstance(ctx, "Other", "_ipp._tcp")
+	if e.Find(err, ErrNXDomain) < 0 {
+		t.Fatal("wrong error", err)
+	}
+}
+
+func TestBrowseServices(t *testing.T) {
+	s, err := dnstest.NewServer(
+		"_http._tcp.local. 120 IN PTR web._http._tcp.local.",
+		"web._http._tcp.local. 120 IN SRV 0 0 80 web.local.",
+		"web.local. 120 IN A 192.0.2.40",
+	)
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+	defer s.Close()
+	defer useServer(t, s)()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events := make(chan *ServiceEvent)
+	err = BrowseServices(ctx, "_http._tcp", events)
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+	next := func(want ServiceEventType, instance string) *ServiceInstance {
+		select {
+		case ev := <-events:
+			if ev.Type != want || ev.Instance.Instance != instance {
+				t.Fatal("wrong event", ev.Type, ev.Instance)
+			}
+			return ev.Instance
+		case <-time.After(5 * time.Second):
+			t.Fatal("no event", want, instance)
+		}
+		return nil
+	}
+
+	next(ServiceAdded, "web")
+	err = s.Add(
+		"_http._tcp.local. 120 IN PTR api._http._tcp.local.",
+		"api._http._tcp.local. 120 IN SRV 0 0 8080 web.local.",
+	)
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+	next(ServiceAdded, "api")
+	s.Remove("api._http._tcp.local.", dns.TypeSRV)
+	err = s.Add("api._http._tcp.local. 120 IN SRV 0 0 8081 web.local.")
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+	// The SRV record may be seen removed before the new one.
+	if si := next(ServiceUpdated, "api"); si.Port != 8081 {
+		if si = next(ServiceUpdated, "api"); si.Port != 8081 {
+			t.Fatal("wrong port", si)
+		}
+	}
+	s.Remove("_http._tcp.local.", dns.TypeANY)
+	removed := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		select {
+		case ev := <-events:
+			if ev.Type != ServiceRemoved {
+				t.Fatal("wrong event", ev.Type, ev.Instance)
+			}
+			removed[ev.Instance.Instance] = true
+		case <-time.After(5 * time.Second):
+			t.Fatal("no event")
+		}
+	}
+	if !removed["web"] || !removed["api"] {
+		t.Fatal("wrong removed instances", removed)
+	}
+
+	cancel()
+	for range events {
+	}
+}
+
+// onceBrowser sends its entries only in the first browse, like a responder
+// that went away without a goodbye.
+type onceBrowser struct {
+	lck     sync.Mutex
+	entries []*mdns.ServiceEntry
+}
+
+func (b *onceBrowser) Browse(ctx context.Context, service, domain string, entries chan<- *mdns.ServiceEntry) error {
+	b.lck.Lock()
+	send := b.entries
+	b.entries = nil
+	b.lck.Unlock()
+	go func() {
+		defer close(entries)
+		for _, entry := range send {
+			select {
+			case entries <- entry:
+			case <-ctx.Done():
+				return
+			}
+		}
+		<-ctx.Done()
+	}()
+	return nil
+}
+
+func TestBrowseServicesExpire(t *testing.T) {
+	entry := mdns.NewServiceEntry("web", "_http._tcp", "local.")
+	entry.HostName = "web.local."
+	entry.Port = 80
+	entry.TTL = 1
+	r, err := NewResolver(WithHostsFile(""), WithBrowser(&onceBrowser{entries: []*mdns.ServiceEntry{entry}}))
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+	defer r.Close()
+	old := MulticastTimeout
+	MulticastTimeout = 100 * time.Millisecond
+	defer func() { MulticastTimeout = old }()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events := make(chan *ServiceEvent)
+	err = r.BrowseServices(ctx, "_http._tcp", events)
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+	start := time.Now()
+	for _, want := range []ServiceEventType{ServiceAdded, ServiceRemoved} {
+		select {
+		case ev := <-events:
+			if ev.Type != want || ev.Instance.Instance != "web" {
+				t.Fatal("wrong event", ev.Type, ev.Instance)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("no event", want)
+		}
+	}
+	if time.Since(start) < time.Second {
+		t.Fatal("removed before the TTL")
+	}
+	cancel()
+	for range events {
+	}
+}
@@ -0,0 +1,846 @@
+// Copyright 2015 Felipe A. Cavani. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dns
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/fcavani/e"
+	log "github.com/fcavani/slog"
+	"github.com/miekg/dns"
+)
+
+// Security is the DNSSEC status of an answer.
+type Security int
+
+const (
+	// Insecure means the answer isn't signed because a zone in the chain
+	// from the trust anchor isn't signed, or the name isn't below a trust
+	// anchor.
+	Insecure Security = iota
+	// Secure means the signatures of the answer were validated up to a
+	// trust anchor.
+	Secure
+	// Bogus means the answer should be signed but the signatures are
+	// missing or invalid.
+	Bogus
+)
+
+func (s Security) String() string {
+	switch s {
+	case Insecure:
+		return "insecure"
+	case Secure:
+		return "secure"
+	case Bogus:
+		return "bogus"
+	}
+	return "unknown"
+}
+
+// worse returns the status of an answer with the parts a and b.
+func worse(a, b Security) Security {
+	if a == Bogus || b == Bogus {
+		return Bogus
+	}
+	if a == Insecure || b == Insecure {
+		return Insecure
+	}
+	return Secure
+}
+
+const (
+	ErrBogus         = "dnssec validation failed"
+	ErrNoDNSSEC      = "dnssec is disabled"
+	ErrInvalidAnchor = "invalid trust anchor"
+)
+
+// RootAnchor is the DS record of the root zone key signing key, the trust
+// anchor used if WithDNSSEC has none.
+var RootAnchor = ". 172800 IN DS 20326 8 2 E06D44B80B8F1D39A95C0B0D7C65D08458E880409BBC683457104237C7F8EC8D"
+
+// WithDNSSEC sets the DO bit in the queries and enables the secure
+// lookups, which validate the answers up to the trust anchors. The anchors
+// are DS or DNSKEY records, without them RootAnchor is used.
+func WithDNSSEC(anchors ...dns.RR) Option {
+	return func(r *Resolver) error {
+		if len(anchors) == 0 {
+			rr, err := dns.NewRR(RootAnchor)
+			if err != nil || rr == nil {
+				return e.Push(e.New(err), ErrInvalidAnchor)
+			}
+			anchors = []dns.RR{rr}
+		}
+		r.anchors = make(map[string][]dns.RR, len(anchors))
+		for _, rr := range anchors {
+			switch rr.(type) {
+			case *dns.DS, *dns.DNSKEY:
+			default:
+				return e.New(ErrInvalidAnchor)
+			}
+			zone := strings.ToLower(dns.Fqdn(rr.Header().Name))
+			r.anchors[zone] = append(r.anchors[zone], rr)
+		}
+		r.dnssec = true
+		return nil
+	}
+}
+
+// LookupRecordsSecure finds the records of type qtype of name, like
+// LookupRecords, and validates them. The answers aren't cached. A bogus
+// answer returns ErrBogus and no records.
+func (r *Resolver) LookupRecordsSecure(ctx context.Context, name string, qtype uint16) (rrs []dns.RR, status Security, err error) {
+	start := time.Now()
+	defer func() {
+		log.DebugLevel().Tag("dns", "dnssec").Printf("LookupRecordsSecure %v %v is %v, took: %v", name, dns.TypeToString[qtype], status, time.Since(start))
+	}()
+
+	if !r.dnssec {
+		return nil, Insecure, e.New(ErrNoDNSSEC)
+	}
+	if name == "" {
+		return nil, Insecure, e.New("invalid name")
+	}
+	if _, ok := dns.TypeToString[qtype]; !ok {
+		return nil, Insecure, e.New("invalid record type %v", qtype)
+	}
+
+	v := newValidator(ctx, r)
+	var resp *Response
+	err = negativeErr(ErrNXDomain)
+	for _, fqdn := range r.config().NameList(name) {
+		resp, err = r.querySecure(ctx, fqdn, qtype)
+		if err != nil {
+			return nil, Insecure, e.Forward(err)
+		}
+		if resp.Rcode != dns.RcodeSuccess && resp.Rcode != dns.RcodeNameError {
+			err = rcodeErr(resp.Rcode)
+			continue
+		}
+		status, err = v.response(resp.Msg)
+		if status == Bogus {
+			err = v.bogus(err)
+			if !e.Equal(err, ErrBogus) {
+				return nil, Insecure, err
+			}
+			return nil, Bogus, err
+		}
+		if resp.Rcode != dns.RcodeSuccess {
+			err = rcodeErr(resp.Rcode)
+			continue
+		}
+		rrs = make([]dns.RR, 0, len(resp.Answer))
+		for _, rr := range resp.Answer {
+			if rr.Header().Rrtype == qtype {
+				rrs = append(rrs, rr)
+			}
+		}
+		if len(rrs) == 0 {
+			err = negativeErr(ErrNoData)
+			continue
+		}
+		return rrs, status, nil
+	}
+	return nil, status, e.Forward(err)
+}
+
+// LookupHostSecure finds the addresses of host, like LookupHost, and
+// validates them. The status is the worse of the A and AAAA answers.
+func (r *Resolver) LookupHostSecure(ctx context.Context, host string) (addrs []string, status Security, err error) {
+	type result struct {
+		rrs    []dns.RR
+		status Security
+		err    error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		rrs, status, err := r.LookupRecordsSecure(ctx, host, dns.TypeAAAA)
+		ch <- result{rrs, status, err}
+	}()
+	rrs, status, err := r.LookupRecordsSecure(ctx, host, dns.TypeA)
+	res := <-ch
+	for _, res := range []result{{rrs, status, err}, res} {
+		if res.status == Bogus {
+			return nil, Bogus, e.Forward(res.err)
+		}
+		if res.err != nil && !definitive(res.err) {
+			return nil, Insecure, e.Forward(res.err)
+		}
+	}
+	status = worse(status, res.status)
+	for _, rr := range append(rrs, res.rrs...) {
+		switch rr := rr.(type) {
+		case *dns.A:
+			addrs = append(addrs, rr.A.String())
+		case *dns.AAAA:
+			addrs = append(addrs, rr.AAAA.String())
+		}
+	}
+	if len(addrs) == 0 {
+		return nil, status, e.Forward(err)
+	}
+	return addrs, status, nil
+}
+
+// querySecure asks for the records and signatures of name. The checking
+// disabled bit makes validating servers return the bogus answers too.
+func (r *Resolver) querySecure(ctx context.Context, name string, qtype uint16) (*Response, error) {
+	m := r.question(dns.Fqdn(name), qtype)
+	m.CheckingDisabled = true
+	return r.exchange(ctx, nil, m)
+}
+
+// rrset is a set of records with the same name and type, and its
+// signatures.
+type rrset struct {
+	name   string
+	rrtype uint16
+	rrs    []dns.RR
+	sigs   []*dns.RRSIG
+}
+
+// rrsets groups the records and the signatures in sets.
+func rrsets(rrs []dns.RR) []*rrset {
+	var sets []*rrset
+	index := make(map[string]*rrset)
+	for _, rr := range rrs {
+		h := rr.Header()
+		rrtype := h.Rrtype
+		sig, isSig := rr.(*dns.RRSIG)
+		if isSig {
+			rrtype = sig.TypeCovered
+		}
+		if rrtype == dns.TypeOPT {
+			continue
+		}
+		key := recordKey(h.Name, rrtype)
+		set := index[key]
+		if set == nil {
+			set = &rrset{name: h.Name, rrtype: rrtype}
+			index[key] = set
+			sets = append(sets, set)
+		}
+		if isSig {
+			set.sigs = append(set.sigs, sig)
+		} else {
+			set.rrs = append(set.rrs, rr)
+		}
+	}
+	return sets
+}
+
+// zoneKeys are the keys of a zone and their status.
+type zoneKeys struct {
+	keys   []*dns.DNSKEY
+	status Security
+	err    error
+}
+
+// zoneCut is the zone of a name and its status.
+type zoneCut struct {
+	zone   string
+	status Security
+	err    error
+}
+
+// proof is a validated NSEC or NSEC3 record and the zone that signed it.
+type proof struct {
+	rr   dns.RR
+	zone string
+}
+
+// validator validates the answers of one lookup. It remembers the keys of
+// the zones and the zones of the names it has validated.
+type validator struct {
+	ctx   context.Context
+	r     *Resolver
+	now   time.Time
+	zones map[string]*zoneKeys
+	cuts  map[string]*zoneCut
+}
+
+func newValidator(ctx context.Context, r *Resolver) *validator {
+	return &validator{
+		ctx:   ctx,
+		r:     r,
+		now:   time.Now(),
+		zones: make(map[string]*zoneKeys),
+		cuts:  make(map[string]*zoneCut),
+	}
+}
+
+// bogus adds ErrBogus to the validation error err. The failures to get the
+// keys, like timeouts, aren't validation errors and are returned as they
+// are.
+func (v *validator) bogus(err error) error {
+	if err == nil {
+		return e.New(ErrBogus)
+	}
+	if isCtxErr(err) || Kind(err) != "" {
+		return e.Forward(err)
+	}
+	return e.Push(err, ErrBogus)
+}
+
+// response validates the answer and, if the answer doesn't have the
+// records asked, the denial of existence in the authority section. The
+// records expanded from a wildcard need the proof that their name doesn't
+// exist.
+func (v *validator) response(m *dns.Msg) (Security, error) {
+	q := m.Question[0]
+	status := Secure
+	found := false
+	var wildcards []*dns.RRSIG
+	for _, set := range rrsets(m.Answer) {
+		if len(set.rrs) == 0 {
+			continue
+		}
+		if set.rrtype == q.Qtype {
+			found = true
+		}
+		sig, s, err := v.verify(set)
+		if s == Bogus {
+			return Bogus, e.Forward(err)
+		}
+		status = worse(status, s)
+		if s == Secure && int(sig.Labels) < dns.CountLabel(set.name) && !strings.HasPrefix(set.name, "*.") {
+			wildcards = append(wildcards, sig)
+		}
+	}
+	if len(wildcards) > 0 {
+		proofs, err := v.proofs(m.Ns)
+		if err != nil {
+			return Bogus, e.Forward(err)
+		}
+		for _, sig := range wildcards {
+			if !expanded(proofs, sig.Hdr.Name, int(sig.Labels)) {
+				return Bogus, e.New("wildcard expansion of %v isn't proved", sig.Hdr.Name)
+			}
+		}
+	}
+	if found {
+		return status, nil
+	}
+	// The denial is about the end of the CNAME chain.
+	name := q.Name
+	for i := 0; i < v.r.cnameDepth(); i++ {
+		cname := findCNAME(m.Answer, name)
+		if cname == nil {
+			break
+		}
+		name = cname.Target
+	}
+	s, err := v.denial(m, name, q.Qtype)
+	return worse(status, s), e.Forward(err)
+}
+
+// denial validates the authority section of a negative answer for name and
+// qtype. In a secure zone the NSEC or NSEC3 records must prove the denial.
+func (v *validator) denial(m *dns.Msg, name string, qtype uint16) (Security, error) {
+	zone := name
+	if qtype == dns.TypeDS {
+		zone = parentName(name)
+	}
+	_, status, err := v.zoneOf(zone)
+	if status != Secure {
+		return status, e.Forward(err)
+	}
+	proofs, err := v.proofs(m.Ns)
+	if err != nil {
+		return Bogus, e.Forward(err)
+	}
+	if qtype == dns.TypeDS && m.Rcode == dns.RcodeSuccess && optOut(proofs, name) {
+		// An unsigned delegation in an opt-out span, RFC 5155 section 8.6.
+		return Insecure, nil
+	}
+	if !denies(proofs, name, qtype, m.Rcode == dns.RcodeNameError) {
+		return Bogus, e.New("denial of %v %v isn't proved", name, dns.TypeToString[qtype])
+	}
+	return Secure, nil
+}
+
+// proofs validates the record sets in rrs and returns the NSEC and NSEC3
+// records of the secure zones.
+func (v *validator) proofs(rrs []dns.RR) ([]proof, error) {
+	var proofs []proof
+	for _, set := range rrsets(rrs) {
+		if len(set.rrs) == 0 {
+			continue
+		}
+		sig, s, err := v.verify(set)
+		if s == Bogus {
+			return nil, e.Forward(err)
+		}
+		if s != Secure || (set.rrtype != dns.TypeNSEC && set.rrtype != dns.TypeNSEC3) {
+			continue
+		}
+		for _, rr := range set.rrs {
+			proofs = append(proofs, proof{rr: rr, zone: strings.ToLower(sig.SignerName)})
+		}
+	}
+	return proofs, nil
+}
+
+// denies returns true if the proofs show that name doesn't exist, if nx, or
+// that it doesn't have records of qtype. The closest encloser and the
+// wildcards are checked as in RFC 4035 section 5.4 and RFC 5155 section 8.
+func denies(proofs []proof, name string, qtype uint16, nx bool) bool {
+	if qtype == dns.TypeDS {
+		// Only the zone above has the DS records.
+		above := make([]proof, 0, len(proofs))
+		for _, p := range proofs {
+			if !strings.EqualFold(p.zone, name) {
+				above = append(above, p)
+			}
+		}
+		proofs = above
+	}
+	if nx {
+		if nsec := covering(proofs, name); nsec != nil {
+			return covering(proofs, wildcard(encloser(nsec, name))) != nil
+		}
+		ce, _, ok := closestEncloser(proofs, name)
+		return ok && covering3(proofs, wildcard(ce)) != nil
+	}
+	if bitmap, ok := matching(proofs, name); ok {
+		return nodata(bitmap, qtype)
+	}
+	if nsec := covering(proofs, name); nsec != nil {
+		if dns.IsSubDomain(name, nsec.NextDomain) && !strings.EqualFold(name, nsec.NextDomain) {
+			// An empty non-terminal.
+			return true
+		}
+		bitmap, ok := matching(proofs, wildcard(encloser(nsec, name)))
+		return ok && nodata(bitmap, qtype)
+	}
+	if ce, _, ok := closestEncloser(proofs, name); ok {
+		bitmap, ok := matching(proofs, wildcard(ce))
+		return ok && nodata(bitmap, qtype)
+	}
+	return false
+}
+
+// expanded returns true if the proofs show that name, the owner of records
+// expanded from a wildcard with labels labels, doesn't exist.
+func expanded(proofs []proof, name string, labels int) bool {
+	if covering(proofs, name) != nil {
+		return true
+	}
+	l := dns.SplitDomainName(name)
+	return covering3(proofs, dns.Fqdn(strings.Join(l[len(l)-labels-1:], "."))) != nil
+}
+
+// nodata returns true if the type bitmap of a name proves that it doesn't
+// have records of qtype. The bitmap of a delegation is from the zone above
+// and proves only the absence of DS records.
+func nodata(bitmap []uint16, qtype uint16) bool {
+	if hasType(bitmap, qtype) || hasType(bitmap, dns.TypeCNAME) {
+		return false
+	}
+	if qtype == dns.TypeDS {
+		return !hasType(bitmap, dns.TypeSOA)
+	}
+	return !hasType(bitmap, dns.TypeNS) || hasType(bitmap, dns.TypeSOA)
+}
+
+// matching returns the type bitmap of the NSEC or NSEC3 record of name.
+func matching(proofs []proof, name string) ([]uint16, bool) {
+	for _, p := range proofs {
+		if nsec, ok := p.rr.(*dns.NSEC); ok && dns.IsSubDomain(p.zone, name) && strings.EqualFold(nsec.Hdr.Name, name) {
+			return nsec.TypeBitMap, true
+		}
+	}
+	if nsec3 := matching3(proofs, name); nsec3 != nil {
+		return nsec3.TypeBitMap, true
+	}
+	return nil, false
+}
+
+// covering returns the NSEC record that proves that name doesn't exist.
+// The NSEC records of a delegation or a DNAME don't prove anything about
+// the names below them.
+func covering(proofs []proof, name string) *dns.NSEC {
+	for _, p := range proofs {
+		nsec, ok := p.rr.(*dns.NSEC)
+		if !ok || !dns.IsSubDomain(p.zone, name) || !covers(nsec.Hdr.Name, nsec.NextDomain, name) {
+			continue
+		}
+		cut := !strings.EqualFold(nsec.Hdr.Name, p.zone) && hasType(nsec.TypeBitMap, dns.TypeNS)
+		if dns.IsSubDomain(nsec.Hdr.Name, name) && (cut || hasType(nsec.TypeBitMap, dns.TypeDNAME)) {
+			continue
+		}
+		return nsec
+	}
+	return nil
+}
+
+// matching3 returns the NSEC3 record with the hash of name.
+func matching3(proofs []proof, name string) *dns.NSEC3 {
+	for _, p := range proofs {
+		nsec3, ok := p.rr.(*dns.NSEC3)
+		if ok && nsec3.Hash == dns.SHA1 && dns.IsSubDomain(p.zone, name) && nsec3.Match(name) {
+			return nsec3
+		}
+	}
+	return nil
+}
+
+// covering3 returns the NSEC3 record that proves that name doesn't exist.
+func covering3(proofs []proof, name string) *dns.NSEC3 {
+	for _, p := range proofs {
+		nsec3, ok := p.rr.(*dns.NSEC3)
+		if ok && nsec3.Hash == dns.SHA1 && dns.IsSubDomain(p.zone, name) && !nsec3.Match(name) && nsec3.Cover(name) {
+			return nsec3
+		}
+	}
+	return nil
+}
+
+// closestEncloser finds with the NSEC3 records the closest encloser of name
+// and the record that covers the next closer name, RFC 5155 section 8.3.
+func closestEncloser(proofs []proof, name string) (string, *dns.NSEC3, bool) {
+	labels := dns.SplitDomainName(name)
+	for i := 1; i <= len(labels); i++ {
+		ce := dns.Fqdn(strings.Join(labels[i:], "."))
+		nsec3 := matching3(proofs, ce)
+		if nsec3 == nil {
+			continue
+		}
+		bitmap := nsec3.TypeBitMap
+		if (hasType(bitmap, dns.TypeNS) && !hasType(bitmap, dns.TypeSOA)) || hasType(bitmap, dns.TypeDNAME) {
+			return "", nil, false
+		}
+		next := covering3(proofs, dns.Fqdn(strings.Join(labels[i-1:], ".")))
+		return ce, next, next != nil
+	}
+	return "", nil, false
+}
+
+// optOut returns true if name may be an unsigned delegation in an opt-out
+// span of NSEC3 records.
+func optOut(proofs []proof, name string) bool {
+	_, next, ok := closestEncloser(proofs, name)
+	return ok && next.Flags&1 != 0
+}
+
+// encloser returns the closest encloser of name, which doesn't exist, from
+// the NSEC record that covers it.
+func encloser(nsec *dns.NSEC, name string) string {
+	n := dns.CompareDomainName(name, nsec.Hdr.Name)
+	if m := dns.CompareDomainName(name, nsec.NextDomain); m > n {
+		n = m
+	}
+	labels := dns.SplitDomainName(name)
+	return dns.Fqdn(strings.Join(labels[len(labels)-n:], "."))
+}
+
+// wildcard returns the wildcard name of the closest encloser ce.
+func wildcard(ce string) string {
+	if ce == "." {
+		return "*."
+	}
+	return "*." + ce
+}
+
+// parentName returns name without its first label.
+func parentName(name string) string {
+	labels := dns.SplitDomainName(name)
+	if len(labels) <= 1 {
+		return "."
+	}
+	return dns.Fqdn(strings.Join(labels[1:], "."))
+}
+
+// hasType returns true if the type bitmap has qtype.
+func hasType(bitmap []uint16, qtype uint16) bool {
+	for _, t := range bitmap {
+		if t == qtype {
+			return true
+		}
+	}
+	return false
+}
+
+// covers returns true if name is between owner and next in the canonical
+// order. The last NSEC of a zone points to the apex.
+func covers(owner, next, name string) bool {
+	if !canonicalLess(owner, name) {
+		return false
+	}
+	return canonicalLess(name, next) || !canonicalLess(owner, next)
+}
+
+// canonicalLess compares the names in the canonical order of RFC 4034,
+// label by label from the right.
+func canonicalLess(a, b string) bool {
+	la := dns.SplitDomainName(strings.ToLower(a))
+	lb := dns.SplitDomainName(strings.ToLower(b))
+	for i := 1; i <= len(la) && i <= len(lb); i++ {
+		x, y := la[len(la)-i], lb[len(lb)-i]
+		if x != y {
+			return x < y
+		}
+	}
+	return len(la) < len(lb)
+}
+
+// verify validates set with the keys of its zone. The DS records are in the
+// zone above their name, and the NSEC3 records in the zone of their parent.
+// The NSEC record of a delegation is in the zone above too. A set is
+// insecure only if its zone is proved insecure.
+func (v *validator) verify(set *rrset) (*dns.RRSIG, Security, error) {
+	name := set.name
+	if set.rrtype == dns.TypeDS || set.rrtype == dns.TypeNSEC3 {
+		name = parentName(name)
+	}
+	zone, status, err := v.zoneOf(name)
+	if set.rrtype == dns.TypeNSEC && strings.EqualFold(zone, name) && name != "." {
+		if above, s, _ := v.zoneOf(parentName(name)); s == Secure {
+			if sig, s, _ := v.verifyIn(set, above); s == Secure {
+				return sig, Secure, nil
+			}
+		}
+	}
+	if status != Secure {
+		return nil, status, e.Forward(err)
+	}
+	return v.verifyIn(set, zone)
+}
+
+// verifyIn validates set with the signatures made by zone, and returns the
+// valid signature.
+func (v *validator) verifyIn(set *rrset, zone string) (*dns.RRSIG, Security, error) {
+	keys, status, err := v.keys(zone)
+	if status != Secure {
+		return nil, status, e.Forward(err)
+	}
+	err = e.New("%v %v isn't signed by %v", set.name, dns.TypeToString[set.rrtype], zone)
+	for _, sig := range set.sigs {
+		if !strings.EqualFold(sig.SignerName, zone) || !dns.IsSubDomain(zone, set.name) || int(sig.Labels) > dns.CountLabel(set.name) {
+			continue
+		}
+		err = verifySig(sig, keys, set.rrs, v.now)
+		if err == nil {
+			return sig, Secure, nil
+		}
+	}
+	return nil, Bogus, e.Forward(err)
+}
+
+// verifySig checks sig with the keys.
+func verifySig(sig *dns.RRSIG, keys []*dns.DNSKEY, rrs []dns.RR, now time.Time) error {
+	if !sig.ValidityPeriod(now) {
+		return e.New("signature of %v %v expired", sig.Hdr.Name, dns.TypeToString[sig.TypeCovered])
+	}
+	for _, key := range keys {
+		if key.KeyTag() != sig.KeyTag || key.Algorithm != sig.Algorithm {
+			continue
+		}
+		if sig.Verify(key, rrs) == nil {
+			return nil
+		}
+	}
+	return e.New("invalid signature of %v %v", sig.Hdr.Name, dns.TypeToString[sig.TypeCovered])
+}
+
+// zoneOf finds the zone of name going down from its trust anchor, the
+// names without an anchor are insecure. The zone above each name proves if
+// the name is a secure delegation, an insecure one or not a delegation.
+func (v *validator) zoneOf(name string) (string, Security, error) {
+	name = strings.ToLower(dns.Fqdn(name))
+	if c, ok := v.cuts[name]; ok {
+		return c.zone, c.status, c.err
+	}
+	c := &zoneCut{zone: name}
+	if _, ok := v.r.anchors[name]; ok {
+		_, c.status, c.err = v.keys(name)
+	} else if name == "." {
+		c.zone, c.status = "", Insecure
+	} else {
+		c.zone, c.status, c.err = v.zoneOf(parentName(name))
+		if c.status == Secure {
+			c.zone, c.status, c.err = v.cut(c.zone, name)
+		}
+	}
+	if c.err != nil {
+		log.DebugLevel().Tag("dns", "dnssec").Printf("Zone of %v is %v: %v", name, c.status, c.err)
+	}
+	v.cuts[name] = c
+	return c.zone, c.status, c.err
+}
+
+// Kinds of names in the zone above them.
+const (
+	cutUnproved = iota
+	cutNone
+	cutInsecure
+)
+
+// cut asks zone, the secure zone above name, for the DS records of name
+// and returns the zone of name. The DS records are validated with the keys
+// of zone, and they validate the keys of name.
+func (v *validator) cut(zone, name string) (string, Security, error) {
+	resp, err := v.r.querySecure(v.ctx, name, dns.TypeDS)
+	if err != nil {
+		return name, Bogus, e.Forward(err)
+	}
+	if resp.Rcode != dns.RcodeSuccess && resp.Rcode != dns.RcodeNameError {
+		return name, Bogus, e.Forward(rcodeErr(resp.Rcode))
+	}
+	var proofs []proof
+	for _, set := range rrsets(append(resp.Answer, resp.Ns...)) {
+		if len(set.rrs) == 0 {
+			continue
+		}
+		switch {
+		case set.rrtype == dns.TypeDS && strings.EqualFold(set.name, name):
+			if _, s, err := v.verifyIn(set, zone); s != Secure {
+				return name, Bogus, e.Forward(err)
+			}
+			ds := make([]*dns.DS, 0, len(set.rrs))
+			for _, rr := range set.rrs {
+				ds = append(ds, rr.(*dns.DS))
+			}
+			keys, status, err := v.loadKeys(name, ds, nil)
+			v.zones[name] = &zoneKeys{keys: keys, status: status, err: err}
+			return name, status, e.Forward(err)
+		case set.rrtype == dns.TypeNSEC || set.rrtype == dns.TypeNSEC3:
+			if _, s, _ := v.verifyIn(set, zone); s == Secure {
+				for _, rr := range set.rrs {
+					proofs = append(proofs, proof{rr: rr, zone: zone})
+				}
+			}
+		}
+	}
+	switch delegated(proofs, name, resp.Rcode == dns.RcodeNameError) {
+	case cutNone:
+		return zone, Secure, nil
+	case cutInsecure:
+		return name, Insecure, nil
+	}
+	return name, Bogus, e.New("delegation of %v isn't proved", name)
+}
+
+// delegated tells from the proofs of the zone above name if name is a
+// delegation. An insecure delegation has NS records and no SOA and DS
+// records in the type bitmap, RFC 4035 section 5.2.
+func delegated(proofs []proof, name string, nx bool) int {
+	if nx {
+		if denies(proofs, name, dns.TypeDS, true) {
+			return cutNone
+		}
+	} else if bitmap, ok := matching(proofs, name); ok {
+		switch {
+		case hasType(bitmap, dns.TypeSOA) || hasType(bitmap, dns.TypeDS):
+			return cutUnproved
+		case hasType(bitmap, dns.TypeNS):
+			return cutInsecure
+		}
+		return cutNone
+	} else if denies(proofs, name, dns.TypeDS, false) {
+		// An empty non-terminal.
+		return cutNone
+	}
+	if optOut(proofs, name) {
+		return cutInsecure
+	}
+	return cutUnproved
+}
+
+// keys returns the validated keys of zone, a trust anchor or a zone found
+// by zoneOf.
+func (v *validator) keys(zone string) ([]*dns.DNSKEY, Security, error) {
+	zone = strings.ToLower(dns.Fqdn(zone))
+	if zk, ok := v.zones[zone]; ok {
+		return zk.keys, zk.status, zk.err
+	}
+	var keys []*dns.DNSKEY
+	var status Security
+	var err error
+	if anchors, ok := v.r.anchors[zone]; ok {
+		var ds []*dns.DS
+		var trusted []*dns.DNSKEY
+		for _, rr := range anchors {
+			switch rr := rr.(type) {
+			case *dns.DS:
+				ds = append(ds, rr)
+			case *dns.DNSKEY:
+				trusted = append(trusted, rr)
+			}
+		}
+		keys, status, err = v.loadKeys(zone, ds, trusted)
+	} else {
+		var found string
+		found, status, err = v.zoneOf(zone)
+		if zk, ok := v.zones[zone]; ok && status == Secure {
+			return zk.keys, zk.status, zk.err
+		}
+		if status == Secure && found != zone {
+			status, err = Bogus, e.New("%v isn't a zone", zone)
+		}
+	}
+	if err != nil {
+		log.DebugLevel().Tag("dns", "dnssec").Printf("Keys of %v are %v: %v", zone, status, err)
+	}
+	v.zones[zone] = &zoneKeys{keys: keys, status: status, err: err}
+	return keys, status, err
+}
+
+// loadKeys gets the keys of zone and validates them with the trusted keys
+// or the DS records of the trust anchor or of the zone above.
+func (v *validator) loadKeys(zone string, ds []*dns.DS, trusted []*dns.DNSKEY) ([]*dns.DNSKEY, Security, error) {
+	resp, err := v.r.querySecure(v.ctx, zone, dns.TypeDNSKEY)
+	if err != nil {
+		return nil, Bogus, e.Forward(err)
+	}
+	var set *rrset
+	for _, s := range rrsets(resp.Answer) {
+		if s.rrtype == dns.TypeDNSKEY && strings.EqualFold(s.name, zone) {
+			set = s
+		}
+	}
+	if set == nil || len(set.rrs) == 0 {
+		return nil, Bogus, e.New("zone %v has no keys", zone)
+	}
+	keys := make([]*dns.DNSKEY, 0, len(set.rrs))
+	var entry []*dns.DNSKEY
+	for _, rr := range set.rrs {
+		key := rr.(*dns.DNSKEY)
+		if key.Flags&dns.ZONE == 0 || key.Protocol != 3 {
+			continue
+		}
+		keys = append(keys, key)
+		for _, d := range ds {
+			if key.KeyTag() != d.KeyTag || key.Algorithm != d.Algorithm {
+				continue
+			}
+			if kd := key.ToDS(d.DigestType); kd != nil && strings.EqualFold(kd.Digest, d.Digest) {
+				entry = append(entry, key)
+			}
+		}
+		for _, t := range trusted {
+			if key.Algorithm == t.Algorithm && key.PublicKey == t.PublicKey {
+				entry = append(entry, key)
+			}
+		}
+	}
+	if len(entry) == 0 {
+		return nil, Bogus, e.New("no key of %v matches the trust anchor or the ds records", zone)
+	}
+	// The key set must be signed by a key trusted by the parent.
+	err = e.New("keys of %v aren't signed", zone)
+	for _, sig := range set.sigs {
+		if !strings.EqualFold(sig.SignerName, zone) {
+			continue
+		}
+		err = verifySig(sig, entry, set.rrs, v.now)
+		if err == nil {
+			return keys, Secure, nil
+		}
+	}
+	return nil, Bogus, e.Forward(err)
+}
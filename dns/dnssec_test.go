@@ -0,0 +1,532 @@
+// Copyright 2015 Felipe A. Cavani. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dns
+
+import (
+	"context"
+	"crypto"
+	"net"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/fcavani/e"
+	"github.com/miekg/dns"
+)
+
+// testZone is a zone served by the dnssec test server.
+type testZone struct {
+	name string
+	key  *dns.DNSKEY
+	rrs  []dns.RR
+}
+
+// newTestZone creates the zone with the records. A signed zone has a key,
+// the NSEC chain and the signatures of all record sets.
+func newTestZone(t *testing.T, name string, signed bool, records ...string) *testZone {
+	z := loadTestZone(t, name, records)
+	if !signed {
+		return z
+	}
+	priv := z.addKey(t)
+	types, names := z.types()
+	for i, owner := range names {
+		next := name
+		if i+1 < len(names) {
+			next = names[i+1]
+		}
+		bitmap := append(types[owner], dns.TypeRRSIG, dns.TypeNSEC)
+		sort.Slice(bitmap, func(i, j int) bool { return bitmap[i] < bitmap[j] })
+		z.rrs = append(z.rrs, &dns.NSEC{
+			Hdr:        dns.RR_Header{Name: owner, Rrtype: dns.TypeNSEC, Class: dns.ClassINET, Ttl: 60},
+			NextDomain: next,
+			TypeBitMap: bitmap,
+		})
+	}
+	z.sign(t, priv)
+	return z
+}
+
+// newNSEC3Zone creates a signed zone with a NSEC3 chain. In an opt-out zone
+// the delegations without DS records have no NSEC3 records.
+func newNSEC3Zone(t *testing.T, name string, optOut bool, records ...string) *testZone {
+	z := loadTestZone(t, name, records)
+	priv := z.addKey(t)
+	types, names := z.types()
+	// The empty non-terminals have NSEC3 records too.
+	for _, owner := range names {
+		for n := parentName(owner); dns.IsSubDomain(name, n) && !strings.EqualFold(n, name); n = parentName(n) {
+			if _, ok := types[n]; !ok {
+				types[n] = nil
+			}
+		}
+	}
+	var flags uint8
+	if optOut {
+		flags = 1
+	}
+	var hashes []string
+	for owner, bitmap := range types {
+		if optOut && hasType(bitmap, dns.TypeNS) && !hasType(bitmap, dns.TypeSOA) && !hasType(bitmap, dns.TypeDS) {
+			continue
+		}
+		hashes = append(hashes, dns.HashName(owner, dns.SHA1, 0, ""))
+	}
+	sort.Strings(hashes)
+	for i, hash := range hashes {
+		var bitmap []uint16
+		for owner, b := range types {
+			if dns.HashName(owner, dns.SHA1, 0, "") == hash && len(b) > 0 {
+				bitmap = append(b, dns.TypeRRSIG)
+			}
+		}
+		sort.Slice(bitmap, func(i, j int) bool { return bitmap[i] < bitmap[j] })
+		z.rrs = append(z.rrs, &dns.NSEC3{
+			Hdr:        dns.RR_Header{Name: strings.ToLower(hash) + "." + name, Rrtype: dns.TypeNSEC3, Class: dns.ClassINET, Ttl: 60},
+			Hash:       dns.SHA1,
+			Flags:      flags,
+			HashLength: 20,
+			NextDomain: hashes[(i+1)%len(hashes)],
+			TypeBitMap: bitmap,
+		})
+	}
+	z.sign(t, priv)
+	return z
+}
+
+// loadTestZone creates the zone with the records and a SOA record.
+func loadTestZone(t *testing.T, name string, records []string) *testZone {
+	z := &testZone{name: name}
+	records = append(records, name+" 3600 IN SOA ns."+name+" admin."+name+" 1 7200 900 1209600 60")
+	for _, record := range records {
+		rr, err := dns.NewRR(record)
+		if err != nil {
+			t.Fatal(err)
+		}
+		z.rrs = append(z.rrs, rr)
+	}
+	return z
+}
+
+// addKey adds the key of the zone and returns its private key.
+func (z *testZone) addKey(t *testing.T) crypto.PrivateKey {
+	z.key = &dns.DNSKEY{
+		Hdr:       dns.RR_Header{Name: z.name, Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 3600},
+		Flags:     dns.ZONE | dns.SEP,
+		Protocol:  3,
+		Algorithm: dns.ECDSAP256SHA256,
+	}
+	priv, err := z.key.Generate(256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	z.rrs = append(z.rrs, z.key)
+	return priv
+}
+
+// types returns the types of each name of the zone and the names in the
+// canonical order.
+func (z *testZone) types() (map[string][]uint16, []string) {
+	types := make(map[string][]uint16)
+	var names []string
+	for _, rr := range z.rrs {
+		h := rr.Header()
+		if _, ok := types[h.Name]; !ok {
+			names = append(names, h.Name)
+		}
+		types[h.Name] = append(types[h.Name], h.Rrtype)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		return canonicalLess(names[i], names[j])
+	})
+	return types, names
+}
+
+// sign signs all record sets of the zone.
+func (z *testZone) sign(t *testing.T, priv crypto.PrivateKey) {
+	for _, set := range rrsets(z.rrs) {
+		sig := &dns.RRSIG{
+			Hdr:        dns.RR_Header{Ttl: set.rrs[0].Header().Ttl},
+			Algorithm:  z.key.Algorithm,
+			Inception:  uint32(time.Now().Add(-time.Hour).Unix()),
+			Expiration: uint32(time.Now().Add(time.Hour).Unix()),
+			KeyTag:     z.key.KeyTag(),
+			SignerName: z.name,
+		}
+		if err := sig.Sign(priv.(crypto.Signer), set.rrs); err != nil {
+			t.Fatal(err)
+		}
+		z.rrs = append(z.rrs, sig)
+	}
+}
+
+// answer returns the records of name and type qtype, and their signatures.
+// A name exists if it or a name below it has records.
+func (z *testZone) answer(name string, qtype uint16) (rrs []dns.RR, exists bool) {
+	for _, rr := range z.rrs {
+		h := rr.Header()
+		if h.Rrtype != dns.TypeNSEC3 && dns.IsSubDomain(name, h.Name) {
+			exists = true
+		}
+		if !strings.EqualFold(h.Name, name) {
+			continue
+		}
+		exists = true
+		rrtype := h.Rrtype
+		if sig, ok := rr.(*dns.RRSIG); ok {
+			rrtype = sig.TypeCovered
+		}
+		if rrtype == qtype {
+			rrs = append(rrs, rr)
+		}
+	}
+	return rrs, exists
+}
+
+// wildcard returns the records of type qtype of the wildcard that expands
+// to name, renamed to name.
+func (z *testZone) wildcard(name string, qtype uint16) (rrs []dns.RR, exists bool) {
+	ce := parentName(name)
+	for ; dns.IsSubDomain(z.name, ce); ce = parentName(ce) {
+		if _, ok := z.answer(ce, qtype); ok {
+			break
+		}
+	}
+	wrrs, exists := z.answer(wildcard(ce), qtype)
+	for _, rr := range wrrs {
+		rr = dns.Copy(rr)
+		rr.Header().Name = name
+		rrs = append(rrs, rr)
+	}
+	return rrs, exists
+}
+
+// denial returns the SOA and the NSEC or NSEC3 records that match or cover
+// name, its closest encloser, the next closer name and the wildcard, and
+// their signatures.
+func (z *testZone) denial(name string) (rrs []dns.RR) {
+	ce, next := name, name
+	for _, exists := z.answer(ce, dns.TypeNone); !exists && !strings.EqualFold(ce, z.name); _, exists = z.answer(ce, dns.TypeNone) {
+		next, ce = ce, parentName(ce)
+	}
+	// The parent proves the delegations in opt-out spans.
+	names := []string{name, ce, next, wildcard(ce), parentName(ce)}
+	var owners []string
+	for _, rr := range z.rrs {
+		for _, n := range names {
+			switch rr := rr.(type) {
+			case *dns.NSEC:
+				if strings.EqualFold(rr.Hdr.Name, n) || covers(rr.Hdr.Name, rr.NextDomain, n) {
+					owners = append(owners, rr.Hdr.Name)
+				}
+			case *dns.NSEC3:
+				if rr.Match(n) || rr.Cover(n) {
+					owners = append(owners, rr.Hdr.Name)
+				}
+			}
+		}
+	}
+	soa, _ := z.answer(z.name, dns.TypeSOA)
+	rrs = append(rrs, soa...)
+	seen := make(map[string]bool)
+	for _, owner := range owners {
+		if seen[owner] {
+			continue
+		}
+		seen[owner] = true
+		nsec, _ := z.answer(owner, dns.TypeNSEC)
+		nsec3, _ := z.answer(owner, dns.TypeNSEC3)
+		rrs = append(rrs, append(nsec, nsec3...)...)
+	}
+	return rrs
+}
+
+// startSignedServer serves the zones. The DS queries are answered by the
+// parent zone.
+func startSignedServer(t *testing.T, do *int32, zones ...*testZone) (addr string, shutdown func()) {
+	return startServer(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(req)
+		q := req.Question[0]
+		if opt := req.IsEdns0(); opt != nil && opt.Do() {
+			atomic.AddInt32(do, 1)
+		}
+		name := q.Name
+		if q.Qtype == dns.TypeDS {
+			name = parentName(name)
+		}
+		var zone *testZone
+		for _, z := range zones {
+			if dns.IsSubDomain(z.name, name) && (zone == nil || len(z.name) > len(zone.name)) {
+				zone = z
+			}
+		}
+		if zone == nil {
+			m.Rcode = dns.RcodeRefused
+			w.WriteMsg(m)
+			return
+		}
+		rrs, exists := zone.answer(q.Name, q.Qtype)
+		expanded := false
+		if !exists {
+			rrs, expanded = zone.wildcard(q.Name, q.Qtype)
+			exists = expanded
+		}
+		switch {
+		case len(rrs) > 0:
+			m.Answer = rrs
+			if expanded {
+				// The proof that the name doesn't exist.
+				m.Ns = zone.denial(q.Name)
+			}
+		case exists:
+			m.Ns = zone.denial(q.Name)
+		default:
+			m.Rcode = dns.RcodeNameError
+			m.Ns = zone.denial(q.Name)
+		}
+		w.WriteMsg(m)
+	})
+}
+func TestDNSSEC(t *testing.T) {
+	sub := newTestZone(t, "sub.example.", true,
+		"www.sub.example. 60 IN A 192.0.2.2",
+		"www.sub.example. 60 IN AAAA 2001:db8::2",
+	)
+	insecure := newTestZone(t, "insecure.example.", false,
+		"host.insecure.example. 60 IN A 192.0.2.3",
+	)
+	ds := sub.key.ToDS(dns.SHA256)
+	ds.Hdr.Ttl = 60
+	zone := newTestZone(t, "example.", true,
+		"www.example. 60 IN A 192.0.2.1",
+		"bad.example. 60 IN A 192.0.2.99",
+		"stripped.example. 60 IN A 192.0.2.67",
+		"insecure.example. 60 IN NS ns.insecure.example.",
+		"evil.example. 60 IN A 192.0.2.5",
+		"forged.example. 60 IN A 192.0.2.7",
+		"*.wild.example. 60 IN A 192.0.2.8",
+		ds.String(),
+	)
+	// Forge an answer and strip the signatures of another. The NSEC of
+	// forged.example. claims an insecure delegation.
+	rrs := zone.rrs[:0]
+	for _, rr := range zone.rrs {
+		switch rr := rr.(type) {
+		case *dns.A:
+			if rr.Hdr.Name == "bad.example." {
+				rr.A = net.ParseIP("192.0.2.66")
+			}
+		case *dns.NSEC:
+			if rr.Hdr.Name == "forged.example." {
+				rr.TypeBitMap = []uint16{dns.TypeNS, dns.TypeRRSIG, dns.TypeNSEC}
+			}
+		case *dns.RRSIG:
+			if (rr.Hdr.Name == "stripped.example." || rr.Hdr.Name == "forged.example.") && rr.TypeCovered == dns.TypeA {
+				continue
+			}
+		}
+		rrs = append(rrs, rr)
+	}
+	zone.rrs = rrs
+	// A zone of the attacker signs evil.example. with its own key.
+	evil := newTestZone(t, "evil.example.", true, "evil.example. 60 IN A 6.6.6.6")
+
+	var do int32
+	addr, shutdown := startSignedServer(t, &do, zone, sub, insecure, evil)
+	defer shutdown()
+	host, port, _ := net.SplitHostPort(addr)
+
+	anchor := zone.key.ToDS(dns.SHA256)
+	r, err := NewResolver(WithServers(host), WithPort(port), WithHostsFile(""), WithDNSSEC(anchor))
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+	defer r.Close()
+	ctx := context.Background()
+
+	rrs, status, err := r.LookupRecordsSecure(ctx, "www.example.", dns.TypeA)
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+	if status != Secure || len(rrs) != 1 {
+		t.Fatal("wrong answer", status, rrs)
+	}
+
+	addrs, status, err := r.LookupHostSecure(ctx, "www.sub.example.")
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+	if status != Secure || len(addrs) != 2 {
+		t.Fatal("wrong answer", status, addrs)
+	}
+
+	addrs, status, err = r.LookupHostSecure(ctx, "host.insecure.example.")
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+	if status != Insecure || len(addrs) != 1 || addrs[0] != "192.0.2.3" {
+		t.Fatal("wrong answer", status, addrs)
+	}
+
+	for _, name := range []string{"bad.example.", "stripped.example.", "evil.example.", "forged.example."} {
+		rrs, status, err = r.LookupRecordsSecure(ctx, name, dns.TypeA)
+		if status != Bogus || !e.Equal(err, ErrBogus) || rrs != nil {
+			t.Fatal(name, "must be bogus", status, err)
+		}
+	}
+
+	rrs, status, err = r.LookupRecordsSecure(ctx, "a.wild.example.", dns.TypeA)
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+	if status != Secure || len(rrs) != 1 || rrs[0].Header().Name != "a.wild.example." {
+		t.Fatal("wrong wildcard answer", status, rrs)
+	}
+	for _, name := range []string{"a.wild.example.", "wild.example."} {
+		_, status, err = r.LookupRecordsSecure(ctx, name, dns.TypeAAAA)
+		if status != Secure || Kind(err) != ErrNoData {
+			t.Fatal("wrong nodata", name, status, err)
+		}
+	}
+	// The wildcard expansion without the proof that the name doesn't exist.
+	resp, err := r.querySecure(ctx, "a.wild.example.", dns.TypeA)
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+	resp.Ns = nil
+	if status, _ = newValidator(ctx, r).response(resp.Msg); status != Bogus {
+		t.Fatal("wildcard expansion without proof must be bogus", status)
+	}
+
+	_, status, err = r.LookupRecordsSecure(ctx, "nope.example.", dns.TypeA)
+	if status != Secure || Kind(err) != ErrNXDomain {
+		t.Fatal("wrong nxdomain", status, err)
+	}
+	_, status, err = r.LookupRecordsSecure(ctx, "www.example.", dns.TypeAAAA)
+	if status != Secure || Kind(err) != ErrNoData {
+		t.Fatal("wrong nodata", status, err)
+	}
+
+	n := atomic.LoadInt32(&do)
+	_, err = r.LookupHostContext(ctx, "www.example.")
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+	if atomic.LoadInt32(&do) == n {
+		t.Fatal("the do bit isn't set")
+	}
+
+	// Other key for the anchor.
+	other := newTestZone(t, "example.", true)
+	r2, err := NewResolver(WithServers(host), WithPort(port), WithHostsFile(""), WithDNSSEC(other.key.ToDS(dns.SHA256)))
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+	defer r2.Close()
+	_, status, err = r2.LookupRecordsSecure(ctx, "www.example.", dns.TypeA)
+	if status != Bogus || !e.Equal(err, ErrBogus) {
+		t.Fatal("wrong anchor must be bogus", status, err)
+	}
+
+	r3, err := NewResolver(WithServers(host), WithPort(port), WithHostsFile(""))
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+	defer r3.Close()
+	_, _, err = r3.LookupRecordsSecure(ctx, "www.example.", dns.TypeA)
+	if !e.Equal(err, ErrNoDNSSEC) {
+		t.Fatal("wrong error", err)
+	}
+
+	_, err = NewResolver(WithDNSSEC(), WithUDPSize(0))
+	if err == nil {
+		t.Fatal("dnssec without edns0 accepted")
+	}
+}
+
+func TestDNSSECNSEC3(t *testing.T) {
+	optout := newTestZone(t, "optout.nsec3.example.", false,
+		"host.optout.nsec3.example. 60 IN A 192.0.2.12",
+	)
+	nsec3 := newNSEC3Zone(t, "nsec3.example.", true,
+		"www.nsec3.example. 60 IN A 192.0.2.10",
+		"*.wild.nsec3.example. 60 IN A 192.0.2.11",
+		"optout.nsec3.example. 60 IN NS ns.optout.nsec3.example.",
+	)
+	ds := nsec3.key.ToDS(dns.SHA256)
+	ds.Hdr.Ttl = 60
+	zone := newTestZone(t, "example.", true, ds.String())
+
+	var do int32
+	addr, shutdown := startSignedServer(t, &do, zone, nsec3, optout)
+	defer shutdown()
+	host, port, _ := net.SplitHostPort(addr)
+	r, err := NewResolver(WithServers(host), WithPort(port), WithHostsFile(""), WithDNSSEC(zone.key.ToDS(dns.SHA256)))
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+	defer r.Close()
+	ctx := context.Background()
+
+	tests := []struct {
+		name   string
+		qtype  uint16
+		status Security
+		err    string
+	}{
+		{"www.nsec3.example.", dns.TypeA, Secure, ""},
+		{"www.nsec3.example.", dns.TypeAAAA, Secure, ErrNoData},
+		{"nope.nsec3.example.", dns.TypeA, Secure, ErrNXDomain},
+		{"a.wild.nsec3.example.", dns.TypeA, Secure, ""},
+		{"a.wild.nsec3.example.", dns.TypeAAAA, Secure, ErrNoData},
+		{"host.optout.nsec3.example.", dns.TypeA, Insecure, ""},
+	}
+	for _, test := range tests {
+		rrs, status, err := r.LookupRecordsSecure(ctx, test.name, test.qtype)
+		if status != test.status {
+			t.Fatal("wrong status", test.name, dns.TypeToString[test.qtype], status, err)
+		}
+		if test.err == "" && (err != nil || len(rrs) != 1) {
+			t.Fatal("wrong answer", test.name, rrs, err)
+		}
+		if test.err != "" && Kind(err) != test.err {
+			t.Fatal("wrong error", test.name, err)
+		}
+	}
+}
+
+func TestDelegated(t *testing.T) {
+	nsec := func(bitmap ...uint16) []proof {
+		return []proof{{
+			rr: &dns.NSEC{
+				Hdr:        dns.RR_Header{Name: "a.example.", Rrtype: dns.TypeNSEC, Class: dns.ClassINET},
+				NextDomain: "b.example.",
+				TypeBitMap: bitmap,
+			},
+			zone: "example.",
+		}}
+	}
+	tests := []struct {
+		proofs []proof
+		name   string
+		kind   int
+	}{
+		{nsec(dns.TypeA, dns.TypeRRSIG, dns.TypeNSEC), "a.example.", cutNone},
+		{nsec(dns.TypeNS, dns.TypeRRSIG, dns.TypeNSEC), "a.example.", cutInsecure},
+		{nsec(dns.TypeNS, dns.TypeSOA, dns.TypeRRSIG, dns.TypeNSEC), "a.example.", cutUnproved},
+		{nsec(dns.TypeNS, dns.TypeDS, dns.TypeRRSIG, dns.TypeNSEC), "a.example.", cutUnproved},
+		{nsec(dns.TypeNS, dns.TypeRRSIG, dns.TypeNSEC), "x.a.example.", cutUnproved},
+		{nsec(dns.TypeA, dns.TypeRRSIG, dns.TypeNSEC), "a.a.example.", cutUnproved},
+		{nil, "a.example.", cutUnproved},
+	}
+	for i, test := range tests {
+		if kind := delegated(test.proofs, test.name, false); kind != test.kind {
+			t.Fatal("wrong kind", i, kind)
+		}
+	}
+}
@@ -0,0 +1,366 @@
+// Copyright 2015 Felipe A. Cavani. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package dnstest runs an in-process DNS server with a programmable zone,
+// to test the lookups without the network.
+//
+// Point a resolver at the server with dns.WithServers(s.Host()) and
+// dns.WithPort(s.Port()), the .local names with
+// dns.WithMulticastAddrs(s.Addr) and the service browsing with
+// dns.WithBrowser(s).
+package dnstest
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/fcavani/e"
+	mdns "github.com/grandcat/zeroconf"
+	"github.com/miekg/dns"
+)
+
+// Maximum length of the CNAME chains followed by the server.
+const maxCNAME = 8
+
+// Server is a DNS server that answers from its zone, over UDP and TCP on
+// the same address. The zone can be changed while the server runs.
+type Server struct {
+	queries uint64
+	// Addr is the address of the server.
+	Addr string
+
+	lck     sync.Mutex
+	records []dns.RR
+	rcodes  map[string]int
+	servers []*dns.Server
+	// changed is closed when the zone changes.
+	changed chan struct{}
+}
+
+// NewServer starts a server on the loopback with the records, in the zone
+// file format.
+func NewServer(records ...string) (*Server, error) {
+	s := &Server{rcodes: make(map[string]int), changed: make(chan struct{})}
+	err := s.Add(records...)
+	if err != nil {
+		return nil, e.Forward(err)
+	}
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		return nil, e.New(err)
+	}
+	l, err := net.Listen("tcp", pc.LocalAddr().String())
+	if err != nil {
+		pc.Close()
+		return nil, e.New(err)
+	}
+	s.Addr = pc.LocalAddr().String()
+	for _, srv := range []*dns.Server{{PacketConn: pc, Handler: s}, {Listener: l, Handler: s}} {
+		started := make(chan struct{})
+		srv.NotifyStartedFunc = func() { close(started) }
+		go srv.ActivateAndServe()
+		<-started
+		s.servers = append(s.servers, srv)
+	}
+	return s, nil
+}
+
+// Host returns the ip address of the server.
+func (s *Server) Host() string {
+	host, _, _ := net.SplitHostPort(s.Addr)
+	return host
+}
+
+// Port returns the port of the server.
+func (s *Server) Port() string {
+	_, port, _ := net.SplitHostPort(s.Addr)
+	return port
+}
+
+// Close stops the server.
+func (s *Server) Close() error {
+	var err error
+	for _, srv := range s.servers {
+		if serr := srv.Shutdown(); serr != nil {
+			err = e.New(serr)
+		}
+	}
+	return err
+}
+
+// Add adds the records, in the zone file format, to the zone.
+func (s *Server) Add(records ...string) error {
+	rrs := make([]dns.RR, 0, len(records))
+	for _, record := range records {
+		rr, err := dns.NewRR(record)
+		if err != nil {
+			return e.Push(e.New(err), "invalid record")
+		}
+		if rr != nil {
+			rrs = append(rrs, rr)
+		}
+	}
+	s.AddRR(rrs...)
+	return nil
+}
+
+// AddRR adds the records to the zone.
+func (s *Server) AddRR(rrs ...dns.RR) {
+	s.lck.Lock()
+	defer s.lck.Unlock()
+	s.records = append(s.records, rrs...)
+	s.notify()
+}
+
+// Remove removes the records of name and type qtype from the zone.
+// dns.TypeANY removes all records of name.
+func (s *Server) Remove(name string, qtype uint16) {
+	s.lck.Lock()
+	defer s.lck.Unlock()
+	records := s.records[:0]
+	for _, rr := range s.records {
+		h := rr.Header()
+		if strings.EqualFold(h.Name, dns.Fqdn(name)) && (qtype == dns.TypeANY || h.Rrtype == qtype) {
+			continue
+		}
+		records = append(records, rr)
+	}
+	s.records = records
+	s.notify()
+}
+
+// RemoveRR removes the records equal to rrs, ignoring the TTL, from the
+// zone.
+func (s *Server) RemoveRR(rrs ...dns.RR) {
+	s.lck.Lock()
+	defer s.lck.Unlock()
+	records := s.records[:0]
+	for _, rr := range s.records {
+		duplicate := false
+		for _, r := range rrs {
+			if dns.IsDuplicate(rr, r) {
+				duplicate = true
+				break
+			}
+		}
+		if !duplicate {
+			records = append(records, rr)
+		}
+	}
+	s.records = records
+	s.notify()
+}
+
+// notify wakes up the browses, the lock must be held.
+func (s *Server) notify() {
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+// SetRcode makes the server answer the queries for name with rcode, like
+// dns.RcodeServerFailure. dns.RcodeSuccess answers from the zone again.
+func (s *Server) SetRcode(name string, rcode int) {
+	s.lck.Lock()
+	defer s.lck.Unlock()
+	name = strings.ToLower(dns.Fqdn(name))
+	if rcode == dns.RcodeSuccess {
+		delete(s.rcodes, name)
+		return
+	}
+	s.rcodes[name] = rcode
+}
+
+// Queries returns the number of queries answered.
+func (s *Server) Queries() uint64 {
+	return atomic.LoadUint64(&s.queries)
+}
+
+// lookup returns the records of name and type qtype.
+func (s *Server) lookup(name string, qtype uint16) (rrs []dns.RR, exists bool) {
+	for _, rr := range s.records {
+		h := rr.Header()
+		if !strings.EqualFold(h.Name, name) {
+			continue
+		}
+		exists = true
+		if qtype == dns.TypeANY || h.Rrtype == qtype {
+			rrs = append(rrs, rr)
+		}
+	}
+	return rrs, exists
+}
+
+// soa returns the SOA record of the closest zone of name.
+func (s *Server) soa(name string) dns.RR {
+	var soa dns.RR
+	for _, rr := range s.records {
+		h := rr.Header()
+		if h.Rrtype != dns.TypeSOA || !dns.IsSubDomain(h.Name, name) {
+			continue
+		}
+		if soa == nil || len(h.Name) > len(soa.Header().Name) {
+			soa = rr
+		}
+	}
+	return soa
+}
+
+// ServeDNS answers req from the zone. The CNAME chains are followed in the
+// zone, a name without records is NXDOMAIN and a name without records of
+// the type is NODATA, with the SOA record of the zone if there is one.
+func (s *Server) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
+	atomic.AddUint64(&s.queries, 1)
+	m := new(dns.Msg)
+	m.SetReply(req)
+	m.Authoritative = true
+	if len(req.Question) != 1 {
+		m.Rcode = dns.RcodeFormatError
+		w.WriteMsg(m)
+		return
+	}
+	q := req.Question[0]
+
+	s.lck.Lock()
+	rcode, ok := s.rcodes[strings.ToLower(q.Name)]
+	if ok {
+		m.Rcode = rcode
+	} else {
+		m.Rcode = s.answer(m, q.Name, q.Qtype)
+	}
+	s.lck.Unlock()
+
+	if opt := req.IsEdns0(); opt != nil {
+		m.SetEdns0(opt.UDPSize(), false)
+	}
+	if _, udp := w.RemoteAddr().(*net.UDPAddr); udp {
+		size := dns.MinMsgSize
+		if opt := req.IsEdns0(); opt != nil && int(opt.UDPSize()) > size {
+			size = int(opt.UDPSize())
+		}
+		if m.Len() > size {
+			m.Truncated = true
+			m.Answer, m.Ns = nil, nil
+		}
+	}
+	w.WriteMsg(m)
+}
+
+// answer fills m with the records of name and returns the rcode.
+func (s *Server) answer(m *dns.Msg, name string, qtype uint16) int {
+	for i := 0; i <= maxCNAME; i++ {
+		rrs, exists := s.lookup(name, qtype)
+		if len(rrs) > 0 {
+			m.Answer = append(m.Answer, rrs...)
+			return dns.RcodeSuccess
+		}
+		cnames, _ := s.lookup(name, dns.TypeCNAME)
+		if len(cnames) > 0 && qtype != dns.TypeCNAME {
+			m.Answer = append(m.Answer, cnames[0])
+			name = cnames[0].(*dns.CNAME).Target
+			continue
+		}
+		if soa := s.soa(name); soa != nil {
+			m.Ns = append(m.Ns, soa)
+		}
+		if !exists {
+			return dns.RcodeNameError
+		}
+		return dns.RcodeSuccess
+	}
+	return dns.RcodeServerFailure
+}
+
+// Browse sends the instances of service in domain from the zone, it
+// implements the Browser of the dns package. The instances are the targets
+// of the PTR records of the service, with their SRV, TXT, A and AAAA
+// records. Until ctx is done the changes of the zone are sent too, the new
+// and changed instances, and the removed ones with TTL 0 like the goodbye
+// packets. entries is closed when ctx is done.
+func (s *Server) Browse(ctx context.Context, service, domain string, entries chan<- *mdns.ServiceEntry) error {
+	go func() {
+		defer close(entries)
+		sent := make(map[string]*mdns.ServiceEntry)
+		for {
+			s.lck.Lock()
+			changed := s.changed
+			s.lck.Unlock()
+
+			var send []*mdns.ServiceEntry
+			current := make(map[string]bool)
+			for _, entry := range s.entries(service, domain) {
+				current[entry.Instance] = true
+				if old, ok := sent[entry.Instance]; ok && reflect.DeepEqual(old, entry) {
+					continue
+				}
+				sent[entry.Instance] = entry
+				send = append(send, entry)
+			}
+			for instance, old := range sent {
+				if current[instance] {
+					continue
+				}
+				delete(sent, instance)
+				bye := *old
+				bye.TTL = 0
+				send = append(send, &bye)
+			}
+			for _, entry := range send {
+				select {
+				case entries <- entry:
+				case <-ctx.Done():
+					return
+				}
+			}
+
+			select {
+			case <-changed:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// entries finds the instances of service in domain.
+func (s *Server) entries(service, domain string) []*mdns.ServiceEntry {
+	s.lck.Lock()
+	defer s.lck.Unlock()
+	svc := dns.Fqdn(strings.Trim(service, ".") + "." + strings.Trim(domain, "."))
+	ptrs, _ := s.lookup(svc, dns.TypePTR)
+	found := make([]*mdns.ServiceEntry, 0, len(ptrs))
+	for _, rr := range ptrs {
+		ptr := rr.(*dns.PTR)
+		instance := strings.TrimSuffix(ptr.Ptr, "."+svc)
+		entry := mdns.NewServiceEntry(instance, service, domain)
+		entry.TTL = ptr.Hdr.Ttl
+		srvs, _ := s.lookup(ptr.Ptr, dns.TypeSRV)
+		for _, rr := range srvs {
+			srv := rr.(*dns.SRV)
+			entry.HostName = srv.Target
+			entry.Port = int(srv.Port)
+		}
+		txts, _ := s.lookup(ptr.Ptr, dns.TypeTXT)
+		for _, rr := range txts {
+			entry.Text = append(entry.Text, rr.(*dns.TXT).Txt...)
+		}
+		if entry.HostName != "" {
+			as, _ := s.lookup(entry.HostName, dns.TypeA)
+			for _, rr := range as {
+				entry.AddrIPv4 = append(entry.AddrIPv4, rr.(*dns.A).A)
+			}
+			aaaas, _ := s.lookup(entry.HostName, dns.TypeAAAA)
+			for _, rr := range aaaas {
+				entry.AddrIPv6 = append(entry.AddrIPv6, rr.(*dns.AAAA).AAAA)
+			}
+		}
+		found = append(found, entry)
+	}
+	return found
+}
@@ -0,0 +1,144 @@
+// Copyright 2015 Felipe A. Cavani. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dnstest
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/fcavani/e"
+	mdns "github.com/grandcat/zeroconf"
+	"github.com/miekg/dns"
+)
+
+func exchange(t *testing.T, s *Server, net, name string, qtype uint16) *dns.Msg {
+	c := &dns.Client{Net: net, Timeout: time.Second}
+	m := new(dns.Msg)
+	m.SetQuestion(name, qtype)
+	resp, _, err := c.Exchange(m, s.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func TestServer(t *testing.T) {
+	s, err := NewServer(
+		"example. 3600 IN SOA ns.example. admin.example. 1 7200 900 1209600 60",
+		"www.example. 60 IN A 192.0.2.1",
+		"alias.example. 60 IN CNAME www.example.",
+	)
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+	defer s.Close()
+
+	resp := exchange(t, s, "udp", "alias.example.", dns.TypeA)
+	if resp.Rcode != dns.RcodeSuccess || len(resp.Answer) != 2 {
+		t.Fatal("wrong answer", resp)
+	}
+	resp = exchange(t, s, "udp", "www.example.", dns.TypeAAAA)
+	if resp.Rcode != dns.RcodeSuccess || len(resp.Answer) != 0 || len(resp.Ns) != 1 {
+		t.Fatal("wrong nodata", resp)
+	}
+	resp = exchange(t, s, "udp", "nx.example.", dns.TypeA)
+	if resp.Rcode != dns.RcodeNameError || len(resp.Ns) != 1 {
+		t.Fatal("wrong nxdomain", resp)
+	}
+
+	s.SetRcode("www.example", dns.RcodeServerFailure)
+	resp = exchange(t, s, "udp", "www.example.", dns.TypeA)
+	if resp.Rcode != dns.RcodeServerFailure {
+		t.Fatal("wrong rcode", resp)
+	}
+	s.SetRcode("www.example", dns.RcodeSuccess)
+	s.Remove("www.example", dns.TypeA)
+	resp = exchange(t, s, "udp", "www.example.", dns.TypeA)
+	if resp.Rcode != dns.RcodeNameError {
+		t.Fatal("record not removed", resp)
+	}
+
+	for i := 1; i <= 100; i++ {
+		err = s.Add(fmt.Sprintf("big.example. 60 IN AAAA 2001:db8::%x", i))
+		if err != nil {
+			t.Fatal(e.Trace(e.Forward(err)))
+		}
+	}
+	resp = exchange(t, s, "udp", "big.example.", dns.TypeAAAA)
+	if !resp.Truncated {
+		t.Fatal("not truncated")
+	}
+	resp = exchange(t, s, "tcp", "big.example.", dns.TypeAAAA)
+	if resp.Truncated || len(resp.Answer) != 100 {
+		t.Fatal("wrong tcp answer", len(resp.Answer))
+	}
+	if s.Queries() != 7 {
+		t.Fatal("wrong number of queries", s.Queries())
+	}
+	rr, err := dns.NewRR("big.example. 300 IN AAAA 2001:db8::1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.RemoveRR(rr)
+	resp = exchange(t, s, "tcp", "big.example.", dns.TypeAAAA)
+	if len(resp.Answer) != 99 {
+		t.Fatal("record not removed", len(resp.Answer))
+	}
+
+	if err = s.Add("invalid"); err == nil {
+		t.Fatal("invalid record accepted")
+	}
+}
+
+func TestBrowse(t *testing.T) {
+	s, err := NewServer(
+		"_http._tcp.local. 120 IN PTR web._http._tcp.local.",
+		"web._http._tcp.local. 120 IN SRV 0 0 8080 host.local.",
+		`web._http._tcp.local. 120 IN TXT "path=/"`,
+		"host.local. 120 IN A 192.0.2.1",
+		"host.local. 120 IN AAAA 2001:db8::1",
+	)
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+	defer s.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	entries := make(chan *mdns.ServiceEntry)
+	err = s.Browse(ctx, "_http._tcp", "local.", entries)
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+	entry := <-entries
+	if entry.Instance != "web" || entry.HostName != "host.local." || entry.Port != 8080 || entry.TTL != 120 {
+		t.Fatal("wrong entry", entry)
+	}
+	if len(entry.Text) != 1 || len(entry.AddrIPv4) != 1 || len(entry.AddrIPv6) != 1 {
+		t.Fatal("wrong entry", entry)
+	}
+
+	err = s.Add("host.local. 120 IN A 192.0.2.2")
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+	entry = <-entries
+	if entry.Instance != "web" || len(entry.AddrIPv4) != 2 {
+		t.Fatal("wrong entry", entry)
+	}
+
+	s.Remove("_http._tcp.local.", dns.TypePTR)
+	entry = <-entries
+	if entry.Instance != "web" || entry.TTL != 0 {
+		t.Fatal("no goodbye", entry)
+	}
+
+	cancel()
+	for entry := range entries {
+		t.Fatal("entry after cancel", entry)
+	}
+}
@@ -0,0 +1,141 @@
+// Copyright 2015 Felipe A. Cavani. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dns
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/fcavani/e"
+	"github.com/miekg/dns"
+)
+
+// NetHTTPS is DNS over HTTPS, RFC 8484.
+const NetHTTPS = "https"
+
+// Media type of the DNS messages in DNS over HTTPS.
+const dohMediaType = "application/dns-message"
+
+// Maximum size of a DNS over HTTPS response.
+const dohMaxSize = 65535
+
+// initHTTPS validates the DNS over HTTPS upstream and creates its http
+// client. The client is shared by all queries to reuse the connections.
+func (u *Upstream) initHTTPS() error {
+	if u.URL == "" {
+		return e.New("invalid upstream url")
+	}
+	uri, err := url.Parse(u.URL)
+	if err != nil {
+		return e.Push(e.New(err), "invalid upstream url")
+	}
+	if uri.Scheme != "https" || uri.Host == "" {
+		return e.New("invalid upstream url %v", u.URL)
+	}
+	switch u.Method {
+	case "":
+		u.Method = http.MethodPost
+	case http.MethodGet, http.MethodPost:
+	default:
+		return e.New("invalid method %v", u.Method)
+	}
+	u.Addr = uri.Host
+	if u.HTTPClient != nil && (len(u.Pins) > 0 || u.ServerName != "" || u.TLSConfig != nil) {
+		// The TLS configuration of the caller's client can't be changed.
+		return e.New("pins, server name and tls config can't be used with an http client")
+	}
+
+	err = u.initTLS(uri.Hostname())
+	if err != nil {
+		return e.Forward(err)
+	}
+	if u.HTTPClient == nil {
+		u.HTTPClient = &http.Client{
+			Transport: &http.Transport{
+				Proxy:               http.ProxyFromEnvironment,
+				TLSClientConfig:     u.tls,
+				TLSHandshakeTimeout: DialTimeout,
+				MaxIdleConnsPerHost: 8,
+				IdleConnTimeout:     90 * time.Second,
+			},
+		}
+	}
+	return nil
+}
+
+// exchangeHTTPS sends m to the DNS over HTTPS server and waits for the
+// response. The message id is zero in the request, as RFC 8484 recommends
+// to make the responses cacheable.
+func (u *Upstream) exchangeHTTPS(ctx context.Context, c *dns.Client, m *dns.Msg) (r *dns.Msg, rtt time.Duration, err error) {
+	if err = ctx.Err(); err != nil {
+		return nil, 0, e.Forward(err)
+	}
+	ctx, cancel := context.WithTimeout(ctx, c.DialTimeout+c.WriteTimeout+c.ReadTimeout)
+	defer cancel()
+
+	// m may be in use by other goroutines.
+	id := m.Id
+	q := m.Copy()
+	q.Id = 0
+	buf, err := q.Pack()
+	if err != nil {
+		return nil, 0, e.Forward(err)
+	}
+
+	var req *http.Request
+	if u.Method == http.MethodGet {
+		sep := "?"
+		if strings.Contains(u.URL, "?") {
+			sep = "&"
+		}
+		uri := u.URL + sep + "dns=" + base64.RawURLEncoding.EncodeToString(buf)
+		req, err = http.NewRequest(http.MethodGet, uri, nil)
+	} else {
+		req, err = http.NewRequest(http.MethodPost, u.URL, bytes.NewReader(buf))
+		if err == nil {
+			req.Header.Set("Content-Type", dohMediaType)
+		}
+	}
+	if err != nil {
+		return nil, 0, e.New(err)
+	}
+	req.Header.Set("Accept", dohMediaType)
+	req = req.WithContext(ctx)
+
+	t := time.Now()
+	resp, err := u.HTTPClient.Do(req)
+	if err != nil {
+		return nil, 0, ctxErr(ctx, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(ioutil.Discard, io.LimitReader(resp.Body, dohMaxSize))
+		return nil, 0, e.New("server responded with %v", resp.Status)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != dohMediaType {
+		return nil, 0, e.New("invalid content type %v", ct)
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, dohMaxSize))
+	if err != nil {
+		return nil, 0, ctxErr(ctx, err)
+	}
+	r = new(dns.Msg)
+	err = r.Unpack(body)
+	if err != nil {
+		return nil, 0, e.Forward(err)
+	}
+	if r.Id != 0 && r.Id != id {
+		return nil, 0, e.New(dns.ErrId)
+	}
+	r.Id = id
+	return r, time.Since(t), nil
+}
@@ -0,0 +1,199 @@
+// Copyright 2015 Felipe A. Cavani. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dns
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/fcavani/e"
+	"github.com/fcavani/net/dns/dnstest"
+	"github.com/miekg/dns"
+)
+
+// startDoHServer starts a DNS over HTTPS server that answers the A and PTR
+// queries. conns counts the tcp connections.
+func startDoHServer(t *testing.T) (ts *httptest.Server, conns *int32) {
+	conns = new(int32)
+	ts = httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var buf []byte
+		var err error
+		switch req.Method {
+		case http.MethodGet:
+			buf, err = base64.RawURLEncoding.DecodeString(req.URL.Query().Get("dns"))
+		case http.MethodPost:
+			if req.Header.Get("Content-Type") != dohMediaType {
+				http.Error(w, "invalid content type", http.StatusUnsupportedMediaType)
+				return
+			}
+			buf, err = ioutil.ReadAll(req.Body)
+		}
+		q := new(dns.Msg)
+		if err != nil || q.Unpack(buf) != nil || len(q.Question) != 1 {
+			http.Error(w, "invalid query", http.StatusBadRequest)
+			return
+		}
+		m := new(dns.Msg)
+		m.SetReply(q)
+		switch q.Question[0].Qtype {
+		case dns.TypeA:
+			rr, _ := dns.NewRR(q.Question[0].Name + " 60 IN A 192.0.2.80")
+			m.Answer = append(m.Answer, rr)
+		case dns.TypePTR:
+			rr, _ := dns.NewRR(q.Question[0].Name + " 60 IN PTR doh.example.")
+			m.Answer = append(m.Answer, rr)
+		}
+		out, _ := m.Pack()
+		w.Header().Set("Content-Type", dohMediaType)
+		w.Write(out)
+	}))
+	ts.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(conns, 1)
+		}
+	}
+	ts.StartTLS()
+	return ts, conns
+}
+
+func TestDNSOverHTTPS(t *testing.T) {
+	ts, conns := startDoHServer(t)
+	defer ts.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ts.Certificate())
+
+	for _, method := range []string{http.MethodGet, http.MethodPost} {
+		atomic.StoreInt32(conns, 0)
+		r, err := NewResolver(
+			WithUpstreams(Upstream{
+				Net:       NetHTTPS,
+				URL:       ts.URL + "/dns-query",
+				Method:    method,
+				TLSConfig: &tls.Config{RootCAs: roots},
+			}),
+			WithReadTimeout(time.Second),
+		)
+		if err != nil {
+			t.Fatal(e.Trace(e.Forward(err)))
+		}
+		for _, host := range []string{"a.example", "b.example", "c.example"} {
+			addrs, err := r.LookupHostContext(context.Background(), host)
+			if err != nil {
+				t.Fatal(method, e.Trace(e.Forward(err)))
+			}
+			if len(addrs) != 1 || addrs[0] != "192.0.2.80" {
+				t.Fatal(method, "wrong addresses", addrs)
+			}
+			if h := r.Cache().Get(host); h == nil || len(h.Addrs) != 1 {
+				t.Fatal(method, "not cached", host)
+			}
+		}
+		name, err := r.LookupIpContext(context.Background(), "192.0.2.80")
+		if err != nil {
+			t.Fatal(method, e.Trace(e.Forward(err)))
+		}
+		if name != "doh.example" {
+			t.Fatal(method, "wrong name", name)
+		}
+		// A and AAAA are queried in parallel.
+		if n := atomic.LoadInt32(conns); n > 2 {
+			t.Fatal(method, "connections not reused", n)
+		}
+		r.Close()
+	}
+}
+
+func TestDNSOverHTTPSInit(t *testing.T) {
+	tests := []struct {
+		upstream Upstream
+		fail     bool
+	}{
+		{Upstream{Net: NetHTTPS, URL: "https://dns.example/dns-query"}, false},
+		{Upstream{Net: NetHTTPS, URL: "https://dns.example/dns-query", Method: "GET"}, false},
+		{Upstream{Net: NetHTTPS}, true},
+		{Upstream{Net: NetHTTPS, URL: "http://dns.example/dns-query"}, true},
+		{Upstream{Net: NetHTTPS, URL: "https://dns.example/dns-query", Method: "PUT"}, true},
+		{Upstream{Net: NetHTTPS, URL: "https://dns.example/dns-query", HTTPClient: http.DefaultClient}, false},
+		{Upstream{Net: NetHTTPS, URL: "https://dns.example/dns-query", HTTPClient: http.DefaultClient, Pins: []string{"x"}}, true},
+		{Upstream{Net: NetHTTPS, URL: "https://dns.example/dns-query", HTTPClient: http.DefaultClient, ServerName: "other.example"}, true},
+		{Upstream{Net: NetHTTPS, URL: "https://dns.example/dns-query", HTTPClient: http.DefaultClient, TLSConfig: &tls.Config{}}, true},
+	}
+	for i, test := range tests {
+		u := test.upstream
+		err := u.init()
+		if test.fail && err == nil {
+			t.Fatalf("%v: must fail", i)
+		} else if !test.fail && err != nil {
+			t.Fatalf("%v: %v", i, e.Trace(e.Forward(err)))
+		}
+		if !test.fail && (u.Addr != "dns.example" || u.tls.ServerName != "dns.example" || u.Method == "") {
+			t.Fatalf("%v: wrong defaults %v %v %v", i, u.Addr, u.tls.ServerName, u.Method)
+		}
+	}
+}
+
+func TestDNSOverHTTPSWithServers(t *testing.T) {
+	ts, _ := startDoHServer(t)
+	defer ts.Close()
+	roots := x509.NewCertPool()
+	roots.AddCert(ts.Certificate())
+
+	s, err := dnstest.NewServer("udp.example. 60 IN A 192.0.2.81")
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+	defer s.Close()
+
+	r, err := NewResolver(
+		WithServers(s.Host()),
+		WithPort(s.Port()),
+		WithHostsFile(""),
+		WithUpstreams(Upstream{
+			Net:       NetHTTPS,
+			URL:       ts.URL + "/dns-query",
+			TLSConfig: &tls.Config{RootCAs: roots},
+		}),
+		WithConfigServers(true),
+		WithReadTimeout(time.Second),
+	)
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+	defer r.Close()
+
+	upstreams := r.upstreamsFor(nil)
+	if len(upstreams) != 2 || upstreams[0].Net != NetHTTPS || upstreams[1].Addr != s.Addr {
+		t.Fatal("wrong upstreams", upstreams)
+	}
+	addrs, err := r.LookupHostContext(context.Background(), "a.example")
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+	if len(addrs) != 1 || addrs[0] != "192.0.2.80" {
+		t.Fatal("wrong addresses", addrs)
+	}
+
+	// The upstreams in quarantine are asked last.
+	for i := 0; i < QuarantineFailures; i++ {
+		r.health.failure(upstreams[0].String())
+	}
+	addrs, err = r.LookupHostContext(context.Background(), "udp.example")
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+	if len(addrs) != 1 || addrs[0] != "192.0.2.81" {
+		t.Fatal("wrong addresses", addrs)
+	}
+}
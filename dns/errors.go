@@ -0,0 +1,84 @@
+// Copyright 2015 Felipe A. Cavani. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dns
+
+import (
+	"net"
+
+	"github.com/fcavani/e"
+	"github.com/miekg/dns"
+)
+
+// Errors of the lookups. The errors of a negative answer are still
+// e.Equal to ErrCantResolve, with one of ErrNXDomain, ErrNoData,
+// ErrServerFailure or ErrRefused below it. Kind tells which one it is.
+const (
+	// ErrNXDomain means the name doesn't exist.
+	ErrNXDomain = "no such host"
+	// ErrNoData means the name exists but has no records of the type.
+	ErrNoData = "no records of the type"
+	// ErrServerFailure means the server failed to answer.
+	ErrServerFailure = "server failure"
+	// ErrRefused means the server refused to answer.
+	ErrRefused = "query refused"
+	// ErrTimeout means the server didn't answer in time.
+	ErrTimeout = "timeout"
+	// ErrNetwork means the exchange with the server failed.
+	ErrNetwork = "network error"
+)
+
+// negativeErr returns the error of a negative answer of kind.
+func negativeErr(kind string) error {
+	return e.Push(e.New(kind), ErrCantResolve)
+}
+
+// rcodeErr returns the error of a response with rcode.
+func rcodeErr(rcode int) error {
+	switch rcode {
+	case dns.RcodeNameError:
+		return negativeErr(ErrNXDomain)
+	case dns.RcodeRefused:
+		return negativeErr(ErrRefused)
+	case dns.RcodeSuccess:
+		return negativeErr(ErrNoData)
+	}
+	return negativeErr(ErrServerFailure)
+}
+
+// transportErr classifies the error of an exchange as ErrTimeout or
+// ErrNetwork.
+func transportErr(err error) error {
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return e.Push(e.New(err), ErrTimeout)
+	}
+	return e.Push(e.New(err), ErrNetwork)
+}
+
+// Kind returns the error constant of err, ErrNXDomain, ErrNoData,
+// ErrServerFailure, ErrRefused, ErrTimeout or ErrNetwork, empty if it is
+// none of them.
+func Kind(err error) string {
+	if err == nil {
+		return ""
+	}
+	for _, kind := range []string{ErrNXDomain, ErrNoData, ErrServerFailure, ErrRefused, ErrTimeout, ErrNetwork} {
+		if e.Find(err, kind) >= 0 {
+			return kind
+		}
+	}
+	return ""
+}
+
+// cantResolve returns true if err is a negative answer.
+func cantResolve(err error) bool {
+	return err != nil && e.Find(err, ErrCantResolve) >= 0
+}
+
+// definitive returns true if err says the records don't exist, unlike a
+// failure that may not happen again.
+func definitive(err error) bool {
+	kind := Kind(err)
+	return kind == ErrNXDomain || kind == ErrNoData
+}
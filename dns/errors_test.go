@@ -0,0 +1,102 @@
+// Copyright 2015 Felipe A. Cavani. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dns
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/fcavani/e"
+	"github.com/miekg/dns"
+)
+
+func TestErrors(t *testing.T) {
+	var count int32
+	addr, shutdown := startServer(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		atomic.AddInt32(&count, 1)
+		m := new(dns.Msg)
+		m.SetReply(req)
+		switch req.Question[0].Name {
+		case "nx.example.":
+			m.Rcode = dns.RcodeNameError
+		case "servfail.example.":
+			m.Rcode = dns.RcodeServerFailure
+		case "refused.example.":
+			m.Rcode = dns.RcodeRefused
+		case "timeout.example.":
+			return
+		}
+		w.WriteMsg(m)
+	})
+	defer shutdown()
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed := pc.LocalAddr().String()
+	pc.Close()
+
+	r, err := NewResolver(WithUpstreams(Upstream{Addr: addr}), WithAttempts(1), WithReadTimeout(100*time.Millisecond))
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+	defer r.Close()
+
+	tests := []struct {
+		host     string
+		err      string
+		negative bool
+	}{
+		{"nx.example.", ErrNXDomain, true},
+		{"nodata.example.", ErrNoData, true},
+		{"servfail.example.", ErrServerFailure, true},
+		{"refused.example.", ErrRefused, true},
+		{"timeout.example.", ErrTimeout, false},
+	}
+	for _, test := range tests {
+		_, _, err := r.queryDNS(context.Background(), test.host, true, nil)
+		if Kind(err) != test.err {
+			t.Fatal(test.host, "wrong error", err)
+		}
+		if e.Equal(err, ErrCantResolve) != test.negative {
+			t.Fatal(test.host, "wrong negative", err)
+		}
+		h := r.cache.Get(test.host)
+		if h == nil || !h.ServFail || h.Negative != test.err {
+			t.Fatal(test.host, "wrong cache entry", h)
+		}
+	}
+
+	// The definitive answers come from the cache, the failures are asked
+	// again.
+	n := atomic.LoadInt32(&count)
+	_, _, err = r.queryDNS(context.Background(), "nx.example.", true, nil)
+	if Kind(err) != ErrNXDomain || atomic.LoadInt32(&count) != n {
+		t.Fatal("nxdomain not cached", err)
+	}
+	_, _, err = r.queryDNS(context.Background(), "servfail.example.", true, nil)
+	if Kind(err) != ErrServerFailure || atomic.LoadInt32(&count) == n {
+		t.Fatal("server failure cached", err)
+	}
+
+	_, err = r.LookupIpContext(context.Background(), "192.0.2.1")
+	if Kind(err) != ErrNoData {
+		t.Fatal("wrong ptr error", err)
+	}
+
+	r2, err := NewResolver(WithUpstreams(Upstream{Addr: closed}), WithAttempts(1), WithReadTimeout(100*time.Millisecond))
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+	defer r2.Close()
+	_, _, err = r2.queryDNS(context.Background(), "network.example.", false, nil)
+	if !e.Equal(err, ErrNetwork) && !e.Equal(err, ErrTimeout) {
+		t.Fatal("wrong error", err)
+	}
+}
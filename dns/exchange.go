@@ -0,0 +1,121 @@
+// Copyright 2015 Felipe A. Cavani. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dns
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/fcavani/e"
+	"github.com/miekg/dns"
+)
+
+// exchange sends m to addr and waits for the response. Unlike
+// dns.Client.ExchangeContext, cancelling ctx interrupts the exchange, and
+// the deadline of ctx shortens the client's timeouts.
+func exchange(ctx context.Context, c *dns.Client, m *dns.Msg, addr string) (r *dns.Msg, rtt time.Duration, err error) {
+	if err = ctx.Err(); err != nil {
+		return nil, 0, e.Forward(err)
+	}
+
+	network := c.Net
+	if network == "" {
+		network = "udp"
+	}
+	useTLS := strings.HasSuffix(network, "-tls")
+	network = strings.TrimSuffix(network, "-tls")
+	d := net.Dialer{Timeout: c.DialTimeout}
+	conn, err := d.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, 0, ctxErr(ctx, err)
+	}
+	defer conn.Close()
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go func(conn net.Conn) {
+		select {
+		case <-ctx.Done():
+			// Unblocks the handshake, the read or the write.
+			conn.Close()
+		case <-stop:
+		}
+	}(conn)
+
+	if useTLS {
+		tlsConn := tls.Client(conn, c.TLSConfig)
+		tlsConn.SetDeadline(deadline(ctx, time.Now(), c.DialTimeout))
+		err = tlsConn.Handshake()
+		if err != nil {
+			return nil, 0, ctxErr(ctx, err)
+		}
+		conn = tlsConn
+	}
+	co := &dns.Conn{Conn: conn}
+
+	opt := m.IsEdns0()
+	if opt != nil && opt.UDPSize() >= dns.MinMsgSize {
+		co.UDPSize = opt.UDPSize()
+	}
+	if opt == nil && c.UDPSize >= dns.MinMsgSize {
+		co.UDPSize = c.UDPSize
+	}
+
+	t := time.Now()
+	co.SetWriteDeadline(deadline(ctx, t, c.WriteTimeout))
+	if err = co.WriteMsg(m); err != nil {
+		return nil, 0, ctxErr(ctx, err)
+	}
+
+	co.SetReadDeadline(deadline(ctx, time.Now(), c.ReadTimeout))
+	r, err = co.ReadMsg()
+	if err != nil {
+		return nil, 0, ctxErr(ctx, err)
+	}
+	if r.Id != m.Id {
+		return nil, 0, e.New(dns.ErrId)
+	}
+	return r, time.Since(t), nil
+}
+
+// deadline returns the earliest of now plus timeout and the ctx's deadline.
+func deadline(ctx context.Context, now time.Time, timeout time.Duration) time.Time {
+	t := now.Add(timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(t) {
+		return d
+	}
+	return t
+}
+
+// ctxErr returns the context's error if it is done, otherwise err
+// classified as ErrTimeout or ErrNetwork. The connection's deadline may
+// expire before the context's timer fires, so the deadline is also checked.
+func ctxErr(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return e.Forward(ctx.Err())
+	}
+	if ctxDone(ctx) {
+		return e.Forward(context.DeadlineExceeded)
+	}
+	if err == nil {
+		return nil
+	}
+	if _, ok := err.(*e.Error); ok {
+		return e.Forward(err)
+	}
+	return transportErr(err)
+}
+
+// ctxDone returns true if ctx is done or its deadline has passed.
+func ctxDone(ctx context.Context) bool {
+	if ctx.Err() != nil {
+		return true
+	}
+	d, ok := ctx.Deadline()
+	return ok && !time.Now().Before(d)
+}
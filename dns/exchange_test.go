@@ -0,0 +1,250 @@
+// Copyright 2015 Felipe A. Cavani. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dns
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/fcavani/e"
+	"github.com/miekg/dns"
+)
+
+// startServer starts a local udp dns server and returns its address.
+func startServer(t *testing.T, handler dns.HandlerFunc) (addr string, shutdown func()) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	started := make(chan struct{})
+	srv := &dns.Server{
+		PacketConn:        pc,
+		Handler:           handler,
+		NotifyStartedFunc: func() { close(started) },
+	}
+	go srv.ActivateAndServe()
+	<-started
+	return pc.LocalAddr().String(), func() { srv.Shutdown() }
+}
+
+func TestExchangeContext(t *testing.T) {
+	addr, shutdown := startServer(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		time.Sleep(2 * time.Second)
+		m := new(dns.Msg)
+		m.SetReply(req)
+		w.WriteMsg(m)
+	})
+	defer shutdown()
+
+	host, port, _ := net.SplitHostPort(addr)
+	r, err := NewResolver(WithServers(host), WithPort(port), WithReadTimeout(5*time.Second))
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+	defer r.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err = r.LookupHostContext(ctx, "slow.example")
+	if err == nil {
+		t.Fatal("lookup must fail")
+	}
+	if !e.Equal(err, context.DeadlineExceeded) {
+		t.Fatal("wrong error", err)
+	}
+	if time.Since(start) > time.Second {
+		t.Fatal("context was not honored", time.Since(start))
+	}
+	if r.cache.Get("slow.example") != nil {
+		t.Fatal("cancelled lookup was cached")
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	_, err = r.LookupIpContext(ctx, "192.0.2.1")
+	if !e.Equal(err, context.Canceled) {
+		t.Fatal("wrong error", err)
+	}
+}
+
+func TestQueryParallel(t *testing.T) {
+	addr, shutdown := startServer(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		time.Sleep(300 * time.Millisecond)
+		m := new(dns.Msg)
+		m.SetReply(req)
+		q := req.Question[0]
+		switch q.Qtype {
+		case dns.TypeA:
+			rr, _ := dns.NewRR(q.Name + " 60 IN A 127.0.0.2")
+			m.Answer = append(m.Answer, rr)
+		case dns.TypeAAAA:
+			rr, _ := dns.NewRR(q.Name + " 60 IN AAAA ::1")
+			m.Answer = append(m.Answer, rr)
+		}
+		w.WriteMsg(m)
+	})
+	defer shutdown()
+
+	host, port, _ := net.SplitHostPort(addr)
+	r, err := NewResolver(WithServers(host), WithPort(port), WithReadTimeout(2*time.Second))
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+	defer r.Close()
+
+	start := time.Now()
+	addrs, err := r.LookupHost("both.example")
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+	if time.Since(start) > 550*time.Millisecond {
+		t.Fatal("the queries aren't parallel", time.Since(start))
+	}
+	if len(addrs) != 2 {
+		t.Fatal("wrong addresses", addrs)
+	}
+}
+
+func TestQueryTTL(t *testing.T) {
+	addr, shutdown := startServer(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(req)
+		q := req.Question[0]
+		soa, _ := dns.NewRR("example. 3600 IN SOA ns.example. admin.example. 1 7200 900 1209600 120")
+		switch {
+		case q.Name == "nx.example.":
+			m.Rcode = dns.RcodeNameError
+			m.Ns = append(m.Ns, soa)
+		case q.Qtype == dns.TypeA:
+			rr1, _ := dns.NewRR(q.Name + " 300 IN A 192.0.2.1")
+			rr2, _ := dns.NewRR(q.Name + " 30 IN A 192.0.2.2")
+			m.Answer = append(m.Answer, rr1, rr2)
+		default:
+			m.Ns = append(m.Ns, soa)
+		}
+		w.WriteMsg(m)
+	})
+	defer shutdown()
+
+	host, port, _ := net.SplitHostPort(addr)
+	r, err := NewResolver(WithServers(host), WithPort(port))
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+	defer r.Close()
+
+	_, _, err = r.queryDNS(context.Background(), "ttl.example", false, nil)
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+	h := r.cache.Get("ttl.example")
+	if h == nil {
+		t.Fatal("not cached")
+	}
+	if d := time.Until(h.Expire); d > 30*time.Second || d < 29*time.Second {
+		t.Fatal("wrong ttl", d)
+	}
+
+	_, _, err = r.queryDNS(context.Background(), "nx.example", false, nil)
+	if !e.Equal(err, ErrCantResolve) {
+		t.Fatal("wrong error", err)
+	}
+	h = r.cache.Get("nx.example")
+	if h == nil || !h.ServFail || h.Negative != ErrNXDomain {
+		t.Fatal("negative entry not cached")
+	}
+	if d := time.Until(h.Expire); d > 120*time.Second || d < 119*time.Second {
+		t.Fatal("wrong negative ttl", d)
+	}
+}
+
+// startDualServer starts a local dns server listening on udp and tcp at the
+// same address.
+func startDualServer(t *testing.T, handler dns.HandlerFunc) (addr string, shutdown func()) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", pc.LocalAddr().String())
+	if err != nil {
+		pc.Close()
+		t.Skip("can't listen on tcp:", err)
+	}
+	var srvs []*dns.Server
+	for _, srv := range []*dns.Server{{PacketConn: pc, Handler: handler}, {Listener: l, Handler: handler}} {
+		started := make(chan struct{})
+		srv.NotifyStartedFunc = func() { close(started) }
+		go srv.ActivateAndServe()
+		<-started
+		srvs = append(srvs, srv)
+	}
+	return pc.LocalAddr().String(), func() {
+		for _, srv := range srvs {
+			srv.Shutdown()
+		}
+	}
+}
+
+func TestTruncated(t *testing.T) {
+	var size uint32
+	addr, shutdown := startDualServer(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(req)
+		if _, ok := w.RemoteAddr().(*net.UDPAddr); ok {
+			if opt := req.IsEdns0(); opt != nil {
+				atomic.StoreUint32(&size, uint32(opt.UDPSize()))
+			}
+			m.Truncated = true
+			w.WriteMsg(m)
+			return
+		}
+		if req.Question[0].Qtype == dns.TypeAAAA {
+			for i := 1; i <= 100; i++ {
+				rr, _ := dns.NewRR(fmt.Sprintf("%v 60 IN AAAA 2001:db8::%x", req.Question[0].Name, i))
+				m.Answer = append(m.Answer, rr)
+			}
+		}
+		w.WriteMsg(m)
+	})
+	defer shutdown()
+
+	host, port, _ := net.SplitHostPort(addr)
+	r, err := NewResolver(WithServers(host), WithPort(port), WithUDPSize(4096))
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+	defer r.Close()
+
+	addrs, err := r.LookupHostContext(context.Background(), "big.example")
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+	if len(addrs) != 100 {
+		t.Fatal("wrong number of addresses", len(addrs))
+	}
+	if n := atomic.LoadUint32(&size); n != 4096 {
+		t.Fatal("wrong udp size", n)
+	}
+
+	m := new(dns.Msg)
+	m.SetQuestion("big.example.", dns.TypeAAAA)
+	resp, err := r.Exchange(context.Background(), m)
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+	if resp.Net != NetTCP || resp.Server != addr || len(resp.Answer) != 100 {
+		t.Fatal("wrong response", resp.Net, resp.Server, len(resp.Answer))
+	}
+
+	_, err = NewResolver(WithUDPSize(100))
+	if err == nil {
+		t.Fatal("invalid udp size accepted")
+	}
+}
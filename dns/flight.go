@@ -0,0 +1,70 @@
+// Copyright 2015 Felipe A. Cavani. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dns
+
+import (
+	"context"
+	"sync"
+
+	"github.com/fcavani/e"
+)
+
+// flight suppresses duplicated calls. Only the first caller with a given
+// key runs the function, the others wait for its result.
+type flight struct {
+	lck sync.Mutex
+	m   map[string]*flightCall
+}
+
+type flightCall struct {
+	done chan struct{}
+	val  interface{}
+	err  error
+}
+
+// do calls fn once for all the concurrent callers with the same key. A
+// caller stops waiting when its ctx is done. shared is true if the result
+// came from a call started by other caller.
+func (f *flight) do(ctx context.Context, key string, fn func() (interface{}, error)) (val interface{}, err error, shared bool) {
+	f.lck.Lock()
+	if f.m == nil {
+		f.m = make(map[string]*flightCall)
+	}
+	if c, found := f.m[key]; found {
+		f.lck.Unlock()
+		select {
+		case <-c.done:
+			return c.val, c.err, true
+		case <-ctx.Done():
+			return nil, e.Forward(ctx.Err()), true
+		}
+	}
+	c := &flightCall{done: make(chan struct{})}
+	f.m[key] = c
+	f.lck.Unlock()
+
+	c.val, c.err = fn()
+
+	f.lck.Lock()
+	delete(f.m, key)
+	f.lck.Unlock()
+	close(c.done)
+
+	return c.val, c.err, false
+}
+
+// inFlight returns true if there is a call with key running.
+func (f *flight) inFlight(key string) bool {
+	f.lck.Lock()
+	defer f.lck.Unlock()
+	_, found := f.m[key]
+	return found
+}
+
+// isCtxErr returns true if err is the error of a cancelled or expired
+// context.
+func isCtxErr(err error) bool {
+	return e.Equal(err, context.Canceled) || e.Equal(err, context.DeadlineExceeded)
+}
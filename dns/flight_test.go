@@ -0,0 +1,158 @@
+// Copyright 2015 Felipe A. Cavani. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dns
+
+import (
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/fcavani/e"
+	"github.com/miekg/dns"
+)
+
+// countingServer answers A queries with ttl and counts the queries.
+func countingServer(t *testing.T, ttl int, delay time.Duration) (r *Resolver, count *int32, shutdown func()) {
+	count = new(int32)
+	addr, stop := startServer(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		n := atomic.AddInt32(count, 1)
+		time.Sleep(delay)
+		m := new(dns.Msg)
+		m.SetReply(req)
+		q := req.Question[0]
+		if q.Qtype == dns.TypeA {
+			rr := &dns.A{
+				Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: uint32(ttl)},
+				A:   net.IPv4(192, 0, 2, byte(n)),
+			}
+			m.Answer = append(m.Answer, rr)
+		}
+		w.WriteMsg(m)
+	})
+	host, port, _ := net.SplitHostPort(addr)
+	c := NewCache(NewMem(), DefaultExpire, Sleep, WithGrace(time.Hour), WithPrefetch(time.Minute, 2))
+	r, err := NewResolver(WithServers(host), WithPort(port), WithCache(c))
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+	return r, count, func() { c.Close(); stop() }
+}
+
+func TestSingleFlight(t *testing.T) {
+	r, count, shutdown := countingServer(t, 3600, 200*time.Millisecond)
+	defer shutdown()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			addrs, err := r.LookupHost("burst.example")
+			if err != nil || len(addrs) != 1 {
+				t.Error("lookup failed", addrs, err)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := atomic.LoadInt32(count); n != 2 {
+		t.Fatal("wrong number of queries", n)
+	}
+}
+
+func TestStaleWhileRevalidate(t *testing.T) {
+	r, count, shutdown := countingServer(t, 1, 0)
+	defer shutdown()
+
+	addrs, err := r.LookupHost("stale.example")
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+	first := addrs[0]
+	time.Sleep(1100 * time.Millisecond)
+
+	// Expired: the old address is returned and refreshed in background.
+	addrs, err = r.LookupHost("stale.example")
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+	if addrs[0] != first {
+		t.Fatal("stale entry not returned", addrs)
+	}
+	for i := 0; i < 100 && atomic.LoadInt32(count) < 4; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(10 * time.Millisecond)
+	addrs, err = r.LookupHost("stale.example")
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+	if addrs[0] == first {
+		t.Fatal("entry not refreshed", addrs)
+	}
+}
+
+func TestPrefetch(t *testing.T) {
+	r, count, shutdown := countingServer(t, 30, 0)
+	defer shutdown()
+
+	for i := 0; i < 3; i++ {
+		_, err := r.LookupHost("prefetch.example")
+		if err != nil {
+			t.Fatal(e.Trace(e.Forward(err)))
+		}
+	}
+	for i := 0; i < 100 && atomic.LoadInt32(count) < 4; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := atomic.LoadInt32(count); n != 4 {
+		t.Fatal("entry not prefetched", n)
+	}
+}
+
+func TestLookupConcurrent(t *testing.T) {
+	addr, shutdown := startServer(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(req)
+		q := req.Question[0]
+		if q.Qtype == dns.TypeA {
+			rr, _ := dns.NewRR(q.Name + " 0 IN A 192.0.2.1")
+			m.Answer = append(m.Answer, rr)
+		}
+		w.WriteMsg(m)
+	})
+	defer shutdown()
+
+	c := NewCache(NewMem(), DefaultExpire, time.Millisecond, WithGrace(time.Millisecond), WithPrefetch(time.Second, 1))
+	defer c.Close()
+	host, port, _ := net.SplitHostPort(addr)
+	r, err := NewResolver(WithServers(host), WithPort(port), WithCache(c))
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for n := 0; n < 200; n++ {
+				name := "host" + strconv.Itoa(n%10) + ".example"
+				if i%2 == 0 {
+					c.PutAddrs(name, []string{"192.0.2.2"})
+					continue
+				}
+				_, err := r.LookupHost(name)
+				if err != nil {
+					t.Error(e.Trace(e.Forward(err)))
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,236 @@
+// Copyright 2015 Felipe A. Cavani. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dns
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fcavani/e"
+	log "github.com/fcavani/slog"
+	"github.com/miekg/dns"
+)
+
+// Strategy selects the order in which the upstream servers are asked.
+type Strategy int
+
+const (
+	// Sequential asks the servers in the configuration order.
+	Sequential Strategy = iota
+	// RoundRobin starts each query at the server after the one where the
+	// previous query started.
+	RoundRobin
+	// Fastest asks the servers with the lowest round trip time first.
+	Fastest
+	// Parallel asks all servers at the same time, the first answer wins.
+	Parallel
+)
+
+// QuarantineFailures is the number of consecutive failures that puts a
+// server in quarantine for QuarantineTime. The servers in quarantine are
+// asked only after the others.
+var QuarantineFailures = 3
+var QuarantineTime = 30 * time.Second
+
+// ewmaWeight is the weight of a new sample in the RTT average.
+const ewmaWeight = 0.3
+
+// WithStrategy sets the order in which the upstream servers are asked. The
+// default is Sequential.
+func WithStrategy(s Strategy) Option {
+	return func(r *Resolver) error {
+		if s < Sequential || s > Parallel {
+			return e.New("invalid strategy")
+		}
+		r.strategy = s
+		return nil
+	}
+}
+
+// ServerHealth is the health of an upstream server.
+type ServerHealth struct {
+	Server string `json:"server"`
+	// Rtt is the exponentially weighted moving average of the round trip
+	// time.
+	Rtt      time.Duration `json:"rtt"`
+	Queries  uint64        `json:"queries"`
+	Failures uint64        `json:"failures"`
+	// Consecutive is the number of failures since the last success.
+	Consecutive int `json:"consecutive"`
+	// Quarantine is the end of the quarantine, zero if the server isn't in
+	// quarantine.
+	Quarantine time.Time `json:"quarantine,omitempty"`
+}
+
+// healthTable holds the health of the servers by Upstream.String.
+type healthTable struct {
+	lck sync.Mutex
+	m   map[string]*ServerHealth
+}
+
+func (t *healthTable) get(server string) *ServerHealth {
+	if t.m == nil {
+		t.m = make(map[string]*ServerHealth)
+	}
+	h, ok := t.m[server]
+	if !ok {
+		h = &ServerHealth{Server: server}
+		t.m[server] = h
+	}
+	return h
+}
+
+func (t *healthTable) success(server string, rtt time.Duration) {
+	t.lck.Lock()
+	defer t.lck.Unlock()
+	h := t.get(server)
+	h.Queries++
+	h.Consecutive = 0
+	h.Quarantine = time.Time{}
+	if h.Rtt == 0 {
+		h.Rtt = rtt
+	} else {
+		h.Rtt = time.Duration(ewmaWeight*float64(rtt) + (1-ewmaWeight)*float64(h.Rtt))
+	}
+}
+
+func (t *healthTable) failure(server string) {
+	t.lck.Lock()
+	defer t.lck.Unlock()
+	h := t.get(server)
+	h.Queries++
+	h.Failures++
+	h.Consecutive++
+	if h.Consecutive >= QuarantineFailures {
+		if h.Quarantine.IsZero() {
+			log.DebugLevel().Tag("dns", "health").Printf("Server %v in quarantine after %v failures", server, h.Consecutive)
+		}
+		h.Quarantine = time.Now().Add(QuarantineTime)
+	}
+}
+
+// state returns the rtt of server and if it is in quarantine.
+func (t *healthTable) state(server string, now time.Time) (rtt time.Duration, quarantine bool) {
+	h, ok := t.m[server]
+	if !ok {
+		return 0, false
+	}
+	return h.Rtt, now.Before(h.Quarantine)
+}
+
+// Health returns the health of the servers the resolver asked.
+func (r *Resolver) Health() []ServerHealth {
+	r.health.lck.Lock()
+	defer r.health.lck.Unlock()
+	now := time.Now()
+	hs := make([]ServerHealth, 0, len(r.health.m))
+	for _, h := range r.health.m {
+		s := *h
+		if !now.Before(s.Quarantine) {
+			s.Quarantine = time.Time{}
+		}
+		hs = append(hs, s)
+	}
+	sort.Slice(hs, func(i, j int) bool {
+		return hs[i].Server < hs[j].Server
+	})
+	return hs
+}
+
+// order returns the upstreams in the order of the strategy, with the
+// servers in quarantine at the end.
+func (r *Resolver) order(upstreams []*Upstream) []*Upstream {
+	n := len(upstreams)
+	out := make([]*Upstream, n)
+	if r.strategy == RoundRobin && n > 0 {
+		start := int(atomic.AddUint64(&r.next, 1) % uint64(n))
+		copy(out, upstreams[start:])
+		copy(out[n-start:], upstreams[:start])
+	} else {
+		copy(out, upstreams)
+	}
+
+	rtts := make(map[*Upstream]time.Duration, n)
+	quarantine := make(map[*Upstream]bool, n)
+	now := time.Now()
+	r.health.lck.Lock()
+	for _, u := range out {
+		rtts[u], quarantine[u] = r.health.state(u.String(), now)
+	}
+	r.health.lck.Unlock()
+
+	sort.SliceStable(out, func(i, j int) bool {
+		if quarantine[out[i]] != quarantine[out[j]] {
+			return !quarantine[out[i]]
+		}
+		// Servers without samples come first to be measured.
+		return r.strategy == Fastest && rtts[out[i]] < rtts[out[j]]
+	})
+	return out
+}
+
+// answered returns true if the server answered the query, even if the
+// answer is that the name doesn't exist.
+func answered(resp *Response) bool {
+	return resp != nil && resp.Rcode != dns.RcodeServerFailure && resp.Rcode != dns.RcodeRefused
+}
+
+// race asks the upstreams out of quarantine at the same time and returns
+// the first answer. The other queries are cancelled.
+func (r *Resolver) race(ctx context.Context, upstreams []*Upstream, m *dns.Msg) (*Response, error) {
+	now := time.Now()
+	healthy := make([]*Upstream, 0, len(upstreams))
+	r.health.lck.Lock()
+	for _, u := range upstreams {
+		if _, q := r.health.state(u.String(), now); !q {
+			healthy = append(healthy, u)
+		}
+	}
+	r.health.lck.Unlock()
+	if len(healthy) == 0 {
+		healthy = upstreams
+	}
+	if len(healthy) == 0 {
+		return nil, e.New("no servers")
+	}
+
+	type result struct {
+		resp *Response
+		err  error
+	}
+	rctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	results := make(chan result, len(healthy))
+	for _, u := range healthy {
+		go func(u *Upstream) {
+			resp, err := r.try(rctx, u, m)
+			results <- result{resp, err}
+		}(u)
+	}
+
+	var last *Response
+	var err error
+	for range healthy {
+		res := <-results
+		if res.err != nil {
+			err = res.err
+			continue
+		}
+		if answered(res.resp) {
+			return res.resp, nil
+		}
+		last, err = res.resp, nil
+	}
+	if last != nil {
+		return last, nil
+	}
+	if ctxDone(ctx) {
+		return nil, ctxErr(ctx, err)
+	}
+	return nil, e.Forward(err)
+}
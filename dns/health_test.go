@@ -0,0 +1,160 @@
+// Copyright 2015 Felipe A. Cavani. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dns
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/fcavani/e"
+	"github.com/miekg/dns"
+)
+
+// healthServer starts a server that counts the queries, waits delay and
+// answers with rcode. A negative delay means no answer.
+func healthServer(t *testing.T, delay time.Duration, rcode int) (addr string, count *int32, shutdown func()) {
+	count = new(int32)
+	addr, shutdown = startServer(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		atomic.AddInt32(count, 1)
+		if delay < 0 {
+			return
+		}
+		time.Sleep(delay)
+		m := new(dns.Msg)
+		m.SetReply(req)
+		m.Rcode = rcode
+		if rcode == dns.RcodeSuccess {
+			rr, _ := dns.NewRR(req.Question[0].Name + " 60 IN A 192.0.2.1")
+			m.Answer = append(m.Answer, rr)
+		}
+		w.WriteMsg(m)
+	})
+	return addr, count, shutdown
+}
+
+func healthResolver(t *testing.T, s Strategy, addrs ...string) *Resolver {
+	ups := make([]Upstream, 0, len(addrs))
+	for _, addr := range addrs {
+		ups = append(ups, Upstream{Addr: addr})
+	}
+	r, err := NewResolver(WithUpstreams(ups...), WithStrategy(s), WithAttempts(1), WithReadTimeout(100*time.Millisecond))
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+	return r
+}
+
+func exchangeA(t *testing.T, r *Resolver) *Response {
+	m := new(dns.Msg)
+	m.SetQuestion("health.example.", dns.TypeA)
+	resp, err := r.Exchange(context.Background(), m)
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+	return resp
+}
+
+func TestQuarantine(t *testing.T) {
+	dead, deadCount, shutdown := healthServer(t, -1, dns.RcodeSuccess)
+	defer shutdown()
+	good, _, shutdown := healthServer(t, 0, dns.RcodeSuccess)
+	defer shutdown()
+	r := healthResolver(t, Sequential, dead, good)
+	defer r.Close()
+
+	for i := 0; i < QuarantineFailures; i++ {
+		if resp := exchangeA(t, r); resp.Server != good {
+			t.Fatal("wrong server", resp.Server)
+		}
+	}
+	start := time.Now()
+	exchangeA(t, r)
+	if time.Since(start) > 50*time.Millisecond || atomic.LoadInt32(deadCount) != int32(QuarantineFailures) {
+		t.Fatal("server not in quarantine", time.Since(start), atomic.LoadInt32(deadCount))
+	}
+	hs := r.Health()
+	if len(hs) != 2 || hs[0].Quarantine.IsZero() == hs[1].Quarantine.IsZero() {
+		t.Fatal("wrong health", hs)
+	}
+	for _, h := range hs {
+		if h.Server == "udp://"+good && (h.Rtt == 0 || h.Failures != 0) {
+			t.Fatal("wrong health", h)
+		}
+	}
+}
+
+func TestStrategies(t *testing.T) {
+	a, aCount, shutdown := healthServer(t, 0, dns.RcodeSuccess)
+	defer shutdown()
+	b, bCount, shutdown := healthServer(t, 0, dns.RcodeSuccess)
+	defer shutdown()
+	slow, slowCount, shutdown := healthServer(t, 30*time.Millisecond, dns.RcodeSuccess)
+	defer shutdown()
+	fail, _, shutdown := healthServer(t, 0, dns.RcodeServerFailure)
+	defer shutdown()
+
+	r := healthResolver(t, RoundRobin, a, b)
+	for i := 0; i < 10; i++ {
+		exchangeA(t, r)
+	}
+	r.Close()
+	if atomic.LoadInt32(aCount) != 5 || atomic.LoadInt32(bCount) != 5 {
+		t.Fatal("round robin", atomic.LoadInt32(aCount), atomic.LoadInt32(bCount))
+	}
+
+	r = healthResolver(t, Fastest, slow, a)
+	for i := 0; i < 5; i++ {
+		exchangeA(t, r)
+	}
+	r.Close()
+	if atomic.LoadInt32(slowCount) != 1 {
+		t.Fatal("fastest", atomic.LoadInt32(slowCount))
+	}
+
+	r = healthResolver(t, Parallel, slow, b)
+	resp := exchangeA(t, r)
+	r.Close()
+	if resp.Server != b {
+		t.Fatal("parallel", resp.Server)
+	}
+
+	r = healthResolver(t, Sequential, fail, a)
+	resp = exchangeA(t, r)
+	r.Close()
+	if resp.Server != a || resp.Rcode != dns.RcodeSuccess {
+		t.Fatal("server failure not skipped", resp.Server, resp.Rcode)
+	}
+
+	_, err := NewResolver(WithStrategy(Strategy(10)))
+	if err == nil {
+		t.Fatal("invalid strategy accepted")
+	}
+}
+
+func TestAttempts(t *testing.T) {
+	var count int32
+	addr, shutdown := startServer(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		// Drops the first query.
+		if atomic.AddInt32(&count, 1) == 1 {
+			return
+		}
+		m := new(dns.Msg)
+		m.SetReply(req)
+		w.WriteMsg(m)
+	})
+	defer shutdown()
+
+	r, err := NewResolver(WithUpstreams(Upstream{Addr: addr}), WithAttempts(2), WithReadTimeout(100*time.Millisecond))
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+	defer r.Close()
+	exchangeA(t, r)
+	if atomic.LoadInt32(&count) != 2 {
+		t.Fatal("wrong number of attempts", atomic.LoadInt32(&count))
+	}
+}
@@ -0,0 +1,162 @@
+// Copyright 2015 Felipe A. Cavani. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dns
+
+import (
+	"bufio"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fcavani/e"
+	log "github.com/fcavani/slog"
+)
+
+// HostsFile is the hosts file of the resolvers created without
+// WithHostsFile.
+var HostsFile = "/etc/hosts"
+
+// HostsCheck is the interval between the checks of the hosts file's
+// modification time.
+var HostsCheck = 5 * time.Second
+
+// hosts is a hosts file, reloaded when its modification time or size
+// changes.
+type hosts struct {
+	path  string
+	check time.Duration
+
+	lck     sync.Mutex
+	checked time.Time
+	mtime   time.Time
+	size    int64
+	// byName maps the lower case names to their addresses.
+	byName map[string][]string
+	// canonical maps the lower case names to the first name of their line.
+	canonical map[string]string
+	// byAddr maps the addresses to their names.
+	byAddr map[string][]string
+}
+
+func newHosts(path string) *hosts {
+	return &hosts{
+		path:  path,
+		check: HostsCheck,
+	}
+}
+
+// update reloads the file if it changed. Must be called with the lock.
+func (h *hosts) update() {
+	now := time.Now()
+	if h.byName != nil && now.Sub(h.checked) < h.check {
+		return
+	}
+	h.checked = now
+	fi, err := os.Stat(h.path)
+	if err != nil {
+		if h.byName == nil || h.size != -1 {
+			log.DebugLevel().Tag("dns", "hosts").Printf("Can't read hosts file %v: %v", h.path, err)
+		}
+		h.byName = map[string][]string{}
+		h.canonical = map[string]string{}
+		h.byAddr = map[string][]string{}
+		h.mtime = time.Time{}
+		h.size = -1
+		return
+	}
+	if h.byName != nil && fi.ModTime().Equal(h.mtime) && fi.Size() == h.size {
+		return
+	}
+	err = h.load()
+	if err != nil {
+		log.ErrorLevel().Tag("dns", "hosts").Printf("Can't load hosts file %v: %v", h.path, err)
+		return
+	}
+	h.mtime = fi.ModTime()
+	h.size = fi.Size()
+}
+
+// load parses the file. Must be called with the lock.
+func (h *hosts) load() error {
+	f, err := os.Open(h.path)
+	if err != nil {
+		return e.New(err)
+	}
+	defer f.Close()
+
+	byName := make(map[string][]string)
+	canonical := make(map[string]string)
+	byAddr := make(map[string][]string)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		ip := net.ParseIP(fields[0])
+		if ip == nil {
+			continue
+		}
+		addr := ip.String()
+		first := strings.TrimSuffix(fields[1], ".")
+		for _, name := range fields[1:] {
+			name = strings.TrimSuffix(name, ".")
+			key := strings.ToLower(name)
+			byName[key] = append(byName[key], addr)
+			if _, ok := canonical[key]; !ok {
+				canonical[key] = first
+			}
+			byAddr[addr] = append(byAddr[addr], name)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return e.New(err)
+	}
+	h.byName = byName
+	h.canonical = canonical
+	h.byAddr = byAddr
+	return nil
+}
+
+// lookupHost returns the canonical name and the addresses of host.
+func (h *hosts) lookupHost(host string) (canonical string, addrs []string) {
+	if h == nil {
+		return "", nil
+	}
+	key := strings.ToLower(strings.TrimSuffix(host, "."))
+	h.lck.Lock()
+	defer h.lck.Unlock()
+	h.update()
+	addrs = h.byName[key]
+	if len(addrs) == 0 {
+		return "", nil
+	}
+	return h.canonical[key], append([]string(nil), addrs...)
+}
+
+// lookupIp returns the first name of ip.
+func (h *hosts) lookupIp(ip string) string {
+	if h == nil {
+		return ""
+	}
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return ""
+	}
+	h.lck.Lock()
+	defer h.lck.Unlock()
+	h.update()
+	names := h.byAddr[addr.String()]
+	if len(names) == 0 {
+		return ""
+	}
+	return names[0]
+}
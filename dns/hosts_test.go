@@ -0,0 +1,170 @@
+// Copyright 2015 Felipe A. Cavani. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dns
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/fcavani/e"
+	"github.com/miekg/dns"
+)
+
+func TestHosts(t *testing.T) {
+	var count int32
+	addr, shutdown := startServer(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		atomic.AddInt32(&count, 1)
+		m := new(dns.Msg)
+		m.SetReply(req)
+		m.Rcode = dns.RcodeNameError
+		w.WriteMsg(m)
+	})
+	defer shutdown()
+
+	dir, err := ioutil.TempDir("", "hosts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "hosts")
+	err = ioutil.WriteFile(path, []byte("# comment\n192.0.2.1 app.test app # alias\n2001:db8::1 app.test\n192.0.2.2 db.test.\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	host, port, _ := net.SplitHostPort(addr)
+	r, err := NewResolver(WithServers(host), WithPort(port), WithHostsFile(path))
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+	defer r.Close()
+	r.hosts.check = 0
+	ctx := context.Background()
+
+	canonical, addrs, err := r.LookupCanonical(ctx, "APP.Test")
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+	if canonical != "app.test" || len(addrs) != 2 || addrs[0] != "192.0.2.1" || addrs[1] != "2001:db8::1" {
+		t.Fatal("wrong answer", canonical, addrs)
+	}
+	canonical, addrs, err = r.LookupCanonical(ctx, "app")
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+	if canonical != "app.test" || len(addrs) != 1 {
+		t.Fatal("wrong alias", canonical, addrs)
+	}
+	name, err := r.LookupIpContext(ctx, "192.0.2.2")
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+	if name != "db.test" {
+		t.Fatal("wrong name", name)
+	}
+	name, err = r.LookupIpContext(ctx, "2001:0db8::0001")
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+	if name != "app.test" {
+		t.Fatal("wrong name", name)
+	}
+	if atomic.LoadInt32(&count) != 0 {
+		t.Fatal("the network was used")
+	}
+
+	err = ioutil.WriteFile(path, []byte("192.0.2.3 app.test\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Now().Add(time.Minute)
+	err = os.Chtimes(path, mtime, mtime)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addrs, err = r.LookupHostContext(ctx, "app.test")
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+	if len(addrs) != 1 || addrs[0] != "192.0.2.3" {
+		t.Fatal("hosts file not reloaded", addrs)
+	}
+	_, err = r.LookupIpContext(ctx, "192.0.2.2")
+	if err == nil {
+		t.Fatal("removed entry was found")
+	}
+}
+
+func TestHostsBeforeCache(t *testing.T) {
+	addr, shutdown := startServer(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(req)
+		m.Rcode = dns.RcodeNameError
+		w.WriteMsg(m)
+	})
+	defer shutdown()
+
+	dir, err := ioutil.TempDir("", "hosts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "hosts")
+	err = ioutil.WriteFile(path, []byte("192.0.2.1 app.test\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	host, port, _ := net.SplitHostPort(addr)
+	r, err := NewResolver(WithServers(host), WithPort(port), WithHostsFile(path))
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+	defer r.Close()
+	r.hosts.check = 0
+	ctx := context.Background()
+
+	_, err = r.LookupHostContext(ctx, "new.test.")
+	if Kind(err) != ErrNXDomain {
+		t.Fatal("wrong error", err)
+	}
+	_, err = r.LookupIpContext(ctx, "192.0.2.4")
+	if Kind(err) != ErrNXDomain {
+		t.Fatal("wrong error", err)
+	}
+	if r.Cache().Get("new.test.") == nil || r.Cache().Get("192.0.2.4") == nil {
+		t.Fatal("negative answers not cached")
+	}
+
+	err = ioutil.WriteFile(path, []byte("192.0.2.1 app.test\n192.0.2.4 new.test\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Now().Add(time.Minute)
+	err = os.Chtimes(path, mtime, mtime)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addrs, err := r.LookupHostContext(ctx, "new.test.")
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+	if len(addrs) != 1 || addrs[0] != "192.0.2.4" {
+		t.Fatal("hosts file hidden by the cache", addrs)
+	}
+	name, err := r.LookupIpContext(ctx, "192.0.2.4")
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+	if name != "new.test" {
+		t.Fatal("hosts file hidden by the cache", name)
+	}
+}
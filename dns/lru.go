@@ -0,0 +1,144 @@
+// Copyright 2015 Felipe A. Cavani. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dns
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/fcavani/e"
+)
+
+// LRU is a Storer that keeps at most a maximum number of entries and an
+// estimate of the memory used by them. When one of the limits is reached
+// the least recently used entries are evicted.
+type LRU struct {
+	max       int
+	maxBytes  int64
+	bytes     int64
+	evictions uint64
+	l         *list.List
+	m         map[string]*list.Element
+	lck       sync.Mutex
+}
+
+type lruEntry struct {
+	key  string
+	data *Host
+	size int64
+}
+
+// NewLRU creates a LRU storer with at most max entries using about maxBytes
+// of memory. Zero disables the respective limit.
+func NewLRU(max int, maxBytes int64) *LRU {
+	return &LRU{
+		max:      max,
+		maxBytes: maxBytes,
+		l:        list.New(),
+		m:        make(map[string]*list.Element),
+	}
+}
+
+// hostSize estimates the memory used by one entry.
+func hostSize(key string, h *Host) int64 {
+	// Map and list overhead, the Host struct and the strings headers.
+	size := int64(128 + len(key))
+	for _, addr := range h.Addrs {
+		size += int64(16 + len(addr))
+	}
+	return size
+}
+
+func (l *LRU) Get(key string) (*Host, error) {
+	l.lck.Lock()
+	defer l.lck.Unlock()
+	elem, found := l.m[key]
+	if !found {
+		return nil, e.New(ErrNotFound)
+	}
+	l.l.MoveToFront(elem)
+	return elem.Value.(*lruEntry).data, nil
+}
+
+func (l *LRU) Put(key string, data *Host) error {
+	l.lck.Lock()
+	defer l.lck.Unlock()
+	_, found := l.m[key]
+	if found {
+		return e.New(ErrDupEntry)
+	}
+	entry := &lruEntry{
+		key:  key,
+		data: data,
+		size: hostSize(key, data),
+	}
+	l.m[key] = l.l.PushFront(entry)
+	l.bytes += entry.size
+	for l.l.Len() > 1 && ((l.max > 0 && l.l.Len() > l.max) || (l.maxBytes > 0 && l.bytes > l.maxBytes)) {
+		l.remove(l.l.Back())
+		l.evictions++
+	}
+	return nil
+}
+
+func (l *LRU) Del(key string) error {
+	l.lck.Lock()
+	defer l.lck.Unlock()
+	elem, found := l.m[key]
+	if !found {
+		return e.New(ErrNotFound)
+	}
+	l.remove(elem)
+	return nil
+}
+
+func (l *LRU) remove(elem *list.Element) {
+	entry := l.l.Remove(elem).(*lruEntry)
+	delete(l.m, entry.key)
+	l.bytes -= entry.size
+}
+
+// Iter calls f for a copy of the entries, from the most to the least
+// recently used, so f can call the other methods. Iter doesn't change the
+// order of the entries.
+func (l *LRU) Iter(f func(key string, data *Host) error) error {
+	l.lck.Lock()
+	entries := make([]*lruEntry, 0, l.l.Len())
+	for elem := l.l.Front(); elem != nil; elem = elem.Next() {
+		entries = append(entries, elem.Value.(*lruEntry))
+	}
+	l.lck.Unlock()
+
+	for _, entry := range entries {
+		err := f(entry.key, entry.data)
+		if e.Equal(err, ErrIterStop) {
+			return nil
+		} else if err != nil {
+			return e.Forward(err)
+		}
+	}
+	return nil
+}
+
+// Len returns the number of entries.
+func (l *LRU) Len() int {
+	l.lck.Lock()
+	defer l.lck.Unlock()
+	return l.l.Len()
+}
+
+// Bytes returns the estimate of the memory used by the entries.
+func (l *LRU) Bytes() int64 {
+	l.lck.Lock()
+	defer l.lck.Unlock()
+	return l.bytes
+}
+
+// Evictions returns the number of entries evicted to respect the limits.
+func (l *LRU) Evictions() uint64 {
+	l.lck.Lock()
+	defer l.lck.Unlock()
+	return l.evictions
+}
@@ -0,0 +1,81 @@
+// Copyright 2015 Felipe A. Cavani. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dns
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/fcavani/e"
+)
+
+func TestLRU(t *testing.T) {
+	l := NewLRU(3, 0)
+	for i := 0; i < 3; i++ {
+		err := l.Put(strconv.Itoa(i), &Host{Addrs: []string{"192.0.2.1"}})
+		if err != nil {
+			t.Fatal(e.Trace(e.Forward(err)))
+		}
+	}
+	err := l.Put("0", &Host{})
+	if !e.Equal(err, ErrDupEntry) {
+		t.Fatal("wrong error", err)
+	}
+	// 0 is now the most recently used.
+	_, err = l.Get("0")
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+	err = l.Put("3", &Host{Addrs: []string{"192.0.2.1"}})
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+	if _, err = l.Get("1"); !e.Equal(err, ErrNotFound) {
+		t.Fatal("1 wasn't evicted")
+	}
+	if l.Len() != 3 || l.Evictions() != 1 {
+		t.Fatal("wrong counters", l.Len(), l.Evictions())
+	}
+
+	keys := ""
+	err = l.Iter(func(key string, data *Host) error {
+		keys += key
+		return l.Del(key)
+	})
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+	if keys != "302" {
+		t.Fatal("wrong order", keys)
+	}
+	if l.Len() != 0 || l.Bytes() != 0 {
+		t.Fatal("not empty", l.Len(), l.Bytes())
+	}
+}
+
+func TestLRUBytes(t *testing.T) {
+	h := &Host{Addrs: []string{"192.0.2.1"}}
+	size := hostSize("00", h)
+	l := NewLRU(0, 2*size)
+	for i := 10; i < 20; i++ {
+		err := l.Put(strconv.Itoa(i), h)
+		if err != nil {
+			t.Fatal(e.Trace(e.Forward(err)))
+		}
+	}
+	if l.Len() != 2 || l.Bytes() > 2*size || l.Evictions() != 8 {
+		t.Fatal("wrong counters", l.Len(), l.Bytes(), l.Evictions())
+	}
+
+	c := NewCache(l, DefaultExpire, Sleep)
+	defer c.Close()
+	err := c.PutAddrs("lru.example", []string{"192.0.2.2"})
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+	if c.Get("lru.example") == nil {
+		t.Fatal("entry not found")
+	}
+}
@@ -0,0 +1,352 @@
+// Copyright 2015 Felipe A. Cavani. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dns
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fcavani/e"
+	log "github.com/fcavani/slog"
+	mdns "github.com/grandcat/zeroconf"
+	"github.com/miekg/dns"
+	"golang.org/x/net/ipv4"
+)
+
+// MulticastAddrs are the multicast DNS groups asked for the names in
+// .local.
+var MulticastAddrs = []string{"224.0.0.251:5353", "[ff02::fb]:5353"}
+
+// After the first address is found the other responses are waited for
+// multicastGrace.
+const multicastGrace = 250 * time.Millisecond
+
+// WithMulticastAddrs sends the multicast DNS queries to addrs instead of
+// MulticastAddrs. With an unicast address, like the one of a
+// dnstest.Server, the .local names are resolved without the network.
+func WithMulticastAddrs(addrs ...string) Option {
+	return func(r *Resolver) error {
+		if len(addrs) == 0 {
+			return e.New("no multicast addresses")
+		}
+		r.mdnsAddrs = make([]*net.UDPAddr, 0, len(addrs))
+		for _, addr := range addrs {
+			udp, err := net.ResolveUDPAddr("udp", addr)
+			if err != nil {
+				return e.Push(e.New(err), "invalid multicast address")
+			}
+			r.mdnsAddrs = append(r.mdnsAddrs, udp)
+		}
+		return nil
+	}
+}
+
+// WithMulticastInterfaces selects the interfaces used by the multicast
+// queries and by the service browsing.
+func WithMulticastInterfaces(ifs []net.Interface) Option {
+	return func(r *Resolver) error {
+		if len(ifs) == 0 {
+			return e.New("invalid interfaces")
+		}
+		r.setMulticastInterfaces(ifs)
+		return nil
+	}
+}
+
+// setMulticastInterfaces selects the interfaces, it may be called while
+// the resolver is in use.
+func (r *Resolver) setMulticastInterfaces(ifs []net.Interface) {
+	ifs = append([]net.Interface(nil), ifs...)
+	r.lck.Lock()
+	defer r.lck.Unlock()
+	r.mdnsIfaces = ifs
+	r.mdnsOpts = []mdns.ClientOption{mdns.SelectIfaces(ifs)}
+}
+
+// isLocal returns true if host is in the multicast DNS domain.
+func isLocal(host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	return strings.HasSuffix(host, ".local")
+}
+
+// querymDNS finds the addresses of host, a name in .local, with one-shot
+// multicast DNS queries (RFC 6762 section 5.1).
+func (r *Resolver) querymDNS(ctx context.Context, host string, useCache bool) (addrs []string, err error) {
+	start := time.Now()
+	defer func() {
+		log.DebugLevel().Tag("dns", "mdns").Printf("lookupHost %v took: %v", host, time.Since(start))
+	}()
+
+	if useCache {
+		h := r.cache.Get(host)
+		if h != nil {
+			addrs, err = h.ReturnAddrs()
+			if err == nil || definitive(err) {
+				return addrs, e.Forward(err)
+			}
+		}
+	}
+
+	for {
+		v, err, shared := r.flight.do(ctx, "mdns "+host, func() (interface{}, error) {
+			return r.resolveMulticast(ctx, host)
+		})
+		if shared && isCtxErr(err) && !ctxDone(ctx) {
+			// The first caller gave up, try again.
+			continue
+		}
+		if err != nil {
+			return nil, e.Forward(err)
+		}
+		return v.([]string), nil
+	}
+}
+
+// resolveMulticast asks the multicast groups for the A and AAAA records of
+// host for at most MulticastTimeout, and caches the addresses. It returns
+// when both types were answered, or shortly after the first address. The
+// responders don't answer for the names they don't have, so the misses
+// aren't cached and return ErrTimeout.
+func (r *Resolver) resolveMulticast(ctx context.Context, host string) (addrs []string, err error) {
+	var ttl uint32
+	defer func() {
+		if ctxDone(ctx) || len(addrs) == 0 {
+			return
+		} else if ttl == 0 {
+			r.cache.PutAddrs(host, addrs)
+			return
+		}
+		putAddrsTTL(r.cache, host, addrs, time.Duration(ttl)*time.Second)
+	}()
+
+	query, cancel := context.WithTimeout(ctx, MulticastTimeout)
+	defer cancel()
+
+	name := dns.Fqdn(host)
+	responses := make(chan *dns.Msg)
+	var wg sync.WaitGroup
+	for _, dst := range r.multicastDsts() {
+		for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+			wg.Add(1)
+			go func(dst multicastDst, qtype uint16) {
+				defer wg.Done()
+				err := multicastQuery(query, dst, name, qtype, responses)
+				if err != nil {
+					log.DebugLevel().Tag("dns", "mdns").Printf("Query %v %v to %v failed: %v", name, dns.TypeToString[qtype], dst, err)
+				}
+			}(dst, qtype)
+		}
+	}
+	go func() {
+		wg.Wait()
+		close(responses)
+	}()
+
+	seen := make(map[string]bool)
+	answered := make(map[uint16]bool)
+	var grace <-chan time.Time
+loop:
+	for {
+		select {
+		case resp, ok := <-responses:
+			if !ok {
+				break loop
+			}
+			for _, q := range resp.Question {
+				answered[q.Qtype] = true
+			}
+			for _, rr := range append(resp.Answer, resp.Extra...) {
+				h := rr.Header()
+				if !strings.EqualFold(h.Name, name) {
+					continue
+				}
+				var addr string
+				switch rr := rr.(type) {
+				case *dns.A:
+					addr = rr.A.String()
+				case *dns.AAAA:
+					addr = rr.AAAA.String()
+				default:
+					continue
+				}
+				answered[h.Rrtype] = true
+				if seen[addr] {
+					continue
+				}
+				seen[addr] = true
+				addrs = append(addrs, addr)
+				if ttl == 0 || h.Ttl < ttl {
+					ttl = h.Ttl
+				}
+			}
+			if answered[dns.TypeA] && answered[dns.TypeAAAA] {
+				break loop
+			}
+			if len(addrs) > 0 && grace == nil {
+				grace = time.After(multicastGrace)
+			}
+		case <-grace:
+			break loop
+		case <-query.Done():
+			break loop
+		}
+	}
+
+	if len(addrs) == 0 {
+		if ctxDone(ctx) {
+			return nil, ctxErr(ctx, nil)
+		}
+		if answered[dns.TypeA] && answered[dns.TypeAAAA] {
+			// A unicast responder answered without addresses.
+			return nil, negativeErr(ErrNXDomain)
+		}
+		return nil, e.Push(e.New("no multicast response for %v", host), ErrTimeout)
+	}
+	return addrs, nil
+}
+
+// multicastDst is an address the queries are sent to, and the interface
+// of the multicast groups.
+type multicastDst struct {
+	addr  *net.UDPAddr
+	iface *net.Interface
+}
+
+func (d multicastDst) String() string {
+	if d.iface == nil || d.addr.Zone != "" {
+		return d.addr.String()
+	}
+	return d.addr.String() + "%" + d.iface.Name
+}
+
+// multicastDsts returns the addresses the queries are sent to. The IPv4
+// groups and the link local IPv6 groups are asked in each interface.
+func (r *Resolver) multicastDsts() []multicastDst {
+	addrs := r.mdnsAddrs
+	if addrs == nil {
+		for _, addr := range MulticastAddrs {
+			udp, err := net.ResolveUDPAddr("udp", addr)
+			if err != nil {
+				log.ErrorLevel().Tag("dns", "mdns").Printf("Invalid multicast address %v: %v", addr, err)
+				continue
+			}
+			addrs = append(addrs, udp)
+		}
+	}
+	var ifs []net.Interface
+	dsts := make([]multicastDst, 0, len(addrs))
+	for _, addr := range addrs {
+		v4 := addr.IP.To4() != nil
+		if (v4 && !addr.IP.IsMulticast()) || (!v4 && (!addr.IP.IsLinkLocalMulticast() || addr.Zone != "")) {
+			dsts = append(dsts, multicastDst{addr: addr})
+			continue
+		}
+		if ifs == nil {
+			ifs = r.multicastInterfaces()
+		}
+		if v4 && len(ifs) == 0 {
+			// Let the routing table choose.
+			dsts = append(dsts, multicastDst{addr: addr})
+			continue
+		}
+		for i := range ifs {
+			dst := multicastDst{addr: addr, iface: &ifs[i]}
+			if !v4 {
+				zoned := *addr
+				zoned.Zone = ifs[i].Name
+				dst.addr = &zoned
+			}
+			dsts = append(dsts, dst)
+		}
+	}
+	return dsts
+}
+
+// multicastInterfaces returns the interfaces selected or the multicast
+// interfaces that are up.
+func (r *Resolver) multicastInterfaces() []net.Interface {
+	r.lck.Lock()
+	ifs := r.mdnsIfaces
+	r.lck.Unlock()
+	if len(ifs) > 0 {
+		return ifs
+	}
+	all, err := net.Interfaces()
+	if err != nil {
+		return nil
+	}
+	ifs = make([]net.Interface, 0, len(all))
+	for _, iface := range all {
+		if iface.Flags&net.FlagUp != 0 && iface.Flags&net.FlagMulticast != 0 {
+			ifs = append(ifs, iface)
+		}
+	}
+	return ifs
+}
+
+// multicastQuery sends a query for name from an ephemeral port, so the
+// responders answer with unicast responses, and sends the responses to
+// out until ctx is done. The IPv4 queries leave by the interface of dst.
+func multicastQuery(ctx context.Context, dst multicastDst, name string, qtype uint16, out chan<- *dns.Msg) error {
+	network := "udp4"
+	if dst.addr.IP.To4() == nil {
+		network = "udp6"
+	}
+	conn, err := net.ListenUDP(network, nil)
+	if err != nil {
+		return e.New(err)
+	}
+	defer conn.Close()
+	if dst.iface != nil && network == "udp4" {
+		err = ipv4.NewPacketConn(conn).SetMulticastInterface(dst.iface)
+		if err != nil {
+			return e.Push(e.New(err), "can't select the multicast interface")
+		}
+	}
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-stop:
+		}
+	}()
+
+	m := new(dns.Msg)
+	m.SetQuestion(name, qtype)
+	m.RecursionDesired = false
+	buf, err := m.Pack()
+	if err != nil {
+		return e.New(err)
+	}
+	_, err = conn.WriteToUDP(buf, dst.addr)
+	if err != nil {
+		return e.New(err)
+	}
+
+	buf = make([]byte, dns.MaxMsgSize)
+	for {
+		n, _, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			if ctxDone(ctx) {
+				return nil
+			}
+			return e.New(err)
+		}
+		resp := new(dns.Msg)
+		if resp.Unpack(buf[:n]) != nil || !resp.Response || (resp.Id != 0 && resp.Id != m.Id) {
+			continue
+		}
+		select {
+		case out <- resp:
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
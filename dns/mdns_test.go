@@ -0,0 +1,210 @@
+// Copyright 2015 Felipe A. Cavani. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dns
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fcavani/e"
+	"github.com/fcavani/net/dns/dnstest"
+	"github.com/miekg/dns"
+)
+
+func TestIsLocal(t *testing.T) {
+	tests := []struct {
+		host  string
+		local bool
+	}{
+		{"printer.local", true},
+		{"printer.local.", true},
+		{"Printer.LOCAL", true},
+		{"a.b.local", true},
+		{"local", false},
+		{"printer.localhost", false},
+		{"www.example.com", false},
+		{"_ipp._tcp", false},
+	}
+	for _, test := range tests {
+		if isLocal(test.host) != test.local {
+			t.Fatal("wrong result for", test.host)
+		}
+	}
+}
+
+func TestLookupLocalHost(t *testing.T) {
+	s, err := dnstest.NewServer(
+		"printer.local. 120 IN A 192.0.2.20",
+		"printer.local. 120 IN AAAA fe80::20",
+		"v4only.local. 120 IN A 192.0.2.21",
+	)
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+	defer s.Close()
+	defer useServer(t, s)()
+	ctx := context.Background()
+
+	start := time.Now()
+	addrs, err := LookupHostContext(ctx, "printer.local")
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+	if len(addrs) != 2 {
+		t.Fatal("wrong addresses", addrs)
+	}
+	if time.Since(start) >= MulticastTimeout {
+		t.Fatal("the lookup didn't finish with the responses")
+	}
+
+	n := s.Queries()
+	addrs, err = LookupHostContext(ctx, "printer.local")
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+	if len(addrs) != 2 || s.Queries() != n {
+		t.Fatal("not cached", addrs)
+	}
+
+	addrs, err = LookupHostContext(ctx, "v4only.local.")
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+	if len(addrs) != 1 || addrs[0] != "192.0.2.21" {
+		t.Fatal("wrong addresses", addrs)
+	}
+
+	start = time.Now()
+	_, err = LookupHostContext(ctx, "missing.local")
+	if e.Find(err, ErrNXDomain) < 0 {
+		t.Fatal("wrong error", err)
+	}
+	if time.Since(start) >= MulticastTimeout {
+		t.Fatal("the lookup didn't finish with the responses")
+	}
+	// The misses aren't cached.
+	err = s.Add("missing.local. 120 IN A 192.0.2.22")
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+	addrs, err = LookupHostContext(ctx, "missing.local")
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+	if len(addrs) != 1 || addrs[0] != "192.0.2.22" {
+		t.Fatal("wrong addresses", addrs)
+	}
+}
+
+func TestLookupLocalHostTimeout(t *testing.T) {
+	silent, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+	r, err := NewResolver(WithHostsFile(""), WithMulticastAddrs(silent.LocalAddr().String()))
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+	defer r.Close()
+	old := MulticastTimeout
+	MulticastTimeout = 100 * time.Millisecond
+	defer func() { MulticastTimeout = old }()
+
+	_, err = r.LookupHostContext(context.Background(), "silent.local")
+	if !e.Equal(err, ErrTimeout) {
+		t.Fatal("wrong error", err)
+	}
+	if h := r.cache.Get("silent.local"); h != nil {
+		t.Fatal("miss cached", h)
+	}
+}
+
+func TestMulticastDsts(t *testing.T) {
+	ifs := []net.Interface{{Index: 1, Name: "eth0"}, {Index: 2, Name: "eth1"}}
+	r, err := NewResolver(WithHostsFile(""), WithMulticastInterfaces(ifs))
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+	defer r.Close()
+
+	// Each group is asked in each selected interface.
+	var dsts []string
+	for _, dst := range r.multicastDsts() {
+		if dst.iface == nil {
+			t.Fatal("no interface", dst)
+		}
+		dsts = append(dsts, dst.String())
+	}
+	want := []string{"224.0.0.251:5353%eth0", "224.0.0.251:5353%eth1", "[ff02::fb%eth0]:5353", "[ff02::fb%eth1]:5353"}
+	if !reflect.DeepEqual(dsts, want) {
+		t.Fatal("wrong destinations", dsts)
+	}
+
+	r, err = NewResolver(WithHostsFile(""), WithMulticastInterfaces(ifs), WithMulticastAddrs("127.0.0.1:5353"))
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+	defer r.Close()
+	if d := r.multicastDsts(); len(d) != 1 || d[0].iface != nil {
+		t.Fatal("wrong destinations", d)
+	}
+}
+
+func TestMulticastQueryInterface(t *testing.T) {
+	lo, err := net.InterfaceByName("lo")
+	if err != nil {
+		t.Skip("no loopback interface:", err)
+	}
+	dst := multicastDst{addr: &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}, iface: &net.Interface{Index: 1 << 20, Name: "missing"}}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	err = multicastQuery(ctx, dst, "printer.local.", dns.TypeA, make(chan *dns.Msg))
+	if e.Find(err, "can't select the multicast interface") < 0 {
+		t.Fatal("query sent by a missing interface", err)
+	}
+	dst.iface = lo
+	err = multicastQuery(ctx, dst, "printer.local.", dns.TypeA, make(chan *dns.Msg))
+	if e.Find(err, "can't select the multicast interface") >= 0 {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+}
+
+func TestSetMulticastInterfaces(t *testing.T) {
+	s, err := dnstest.NewServer("printer.local. 120 IN A 192.0.2.20")
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+	defer s.Close()
+	defer useServer(t, s)()
+	lo, err := net.InterfaceByName("lo")
+	if err != nil {
+		t.Skip("no loopback interface:", err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			if err := MulticastDNSResolverConfig([]net.Interface{*lo}); err != nil {
+				t.Error(e.Trace(e.Forward(err)))
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			defaultResolver.multicastInterfaces()
+			defaultResolver.multicast()
+			if _, err := defaultResolver.querymDNS(context.Background(), "printer.local", false); err != nil {
+				t.Error(e.Trace(e.Forward(err)))
+			}
+		}()
+	}
+	wg.Wait()
+}
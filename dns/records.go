@@ -0,0 +1,290 @@
+// Copyright 2015 Felipe A. Cavani. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dns
+
+import (
+	"context"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/fcavani/e"
+	log "github.com/fcavani/slog"
+	"github.com/miekg/dns"
+)
+
+// SOA is a start of authority record.
+type SOA struct {
+	Ns      string
+	Mbox    string
+	Serial  uint32
+	Refresh uint32
+	Retry   uint32
+	Expire  uint32
+	Minttl  uint32
+}
+
+// CAA is a certification authority authorization record, RFC 8659.
+type CAA struct {
+	Flag  uint8
+	Tag   string
+	Value string
+}
+
+// recordKey is the cache key of the records of type qtype of name. The
+// slash never appears in host names or addresses, the keys of LookupHost
+// and LookupIp.
+func recordKey(name string, qtype uint16) string {
+	return strings.ToLower(dns.Fqdn(name)) + "/" + dns.TypeToString[qtype]
+}
+
+// parseRecordKey is the reverse of recordKey.
+func parseRecordKey(key string) (name string, qtype uint16, ok bool) {
+	i := strings.LastIndex(key, "/")
+	if i < 0 {
+		return "", 0, false
+	}
+	qtype, ok = dns.StringToType[key[i+1:]]
+	return key[:i], qtype, ok
+}
+
+// LookupRecords finds the records of type qtype of name. The records are
+// cached by name and type, the cache entry holds the records in the
+// presentation format.
+func (r *Resolver) LookupRecords(ctx context.Context, name string, qtype uint16) (rrs []dns.RR, err error) {
+	start := time.Now()
+	defer func() {
+		log.DebugLevel().Tag("dns").Printf("LookupRecords %v %v took: %v", name, dns.TypeToString[qtype], time.Since(start))
+	}()
+
+	if name == "" {
+		return nil, e.New("invalid name")
+	}
+	if _, ok := dns.TypeToString[qtype]; !ok {
+		return nil, e.New("invalid record type %v", qtype)
+	}
+
+	key := recordKey(name, qtype)
+	h := r.cache.Get(key)
+	if h != nil {
+		texts, err := h.ReturnAddrs()
+		if err == nil {
+			rrs, err = parseRecords(texts)
+			if err == nil {
+				return rrs, nil
+			}
+		} else if definitive(err) {
+			return nil, e.Forward(err)
+		}
+	}
+
+	for {
+		v, err, shared := r.flight.do(ctx, "records "+key, func() (interface{}, error) {
+			return r.resolveRecords(ctx, name, qtype)
+		})
+		if shared && isCtxErr(err) && !ctxDone(ctx) {
+			// The first caller gave up, try again.
+			continue
+		}
+		if err != nil {
+			return nil, e.Forward(err)
+		}
+		return v.([]dns.RR), nil
+	}
+}
+
+// resolveRecords asks the servers for the records of type qtype of name,
+// expanded with the search list like resolveDNS does, and caches the
+// result.
+func (r *Resolver) resolveRecords(ctx context.Context, name string, qtype uint16) ([]dns.RR, error) {
+	key := recordKey(name, qtype)
+	var resp *Response
+	err := negativeErr(ErrNXDomain)
+	for _, fqdn := range r.config().NameList(name) {
+		resp, err = r.query(ctx, nil, fqdn, qtype)
+		if err != nil {
+			if !ctxDone(ctx) {
+				putNegative(r.cache, key, Kind(err))
+			}
+			return nil, e.Forward(err)
+		}
+		if resp.Rcode != dns.RcodeSuccess {
+			err = rcodeErr(resp.Rcode)
+			continue
+		}
+
+		rrs := make([]dns.RR, 0, len(resp.Answer))
+		texts := make([]string, 0, len(resp.Answer))
+		for _, rr := range resp.Answer {
+			if rr.Header().Rrtype != qtype {
+				continue
+			}
+			rrs = append(rrs, rr)
+			texts = append(texts, rr.String())
+		}
+		if len(rrs) == 0 {
+			err = negativeErr(ErrNoData)
+			continue
+		}
+		ttl, _ := minTTL(rrs)
+		putAddrsTTL(r.cache, key, texts, ttl)
+		return rrs, nil
+	}
+	if resp != nil {
+		r.putNegative(key, err, resp.Msg)
+	}
+	return nil, e.Forward(err)
+}
+
+// parseRecords parses the records cached by resolveRecords.
+func parseRecords(texts []string) ([]dns.RR, error) {
+	rrs := make([]dns.RR, 0, len(texts))
+	for _, text := range texts {
+		rr, err := dns.NewRR(text)
+		if err != nil {
+			return nil, e.New(err)
+		}
+		if rr == nil {
+			return nil, e.New("empty record")
+		}
+		rrs = append(rrs, rr)
+	}
+	return rrs, nil
+}
+
+// LookupMX finds the mail exchangers of name sorted by preference.
+func (r *Resolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	rrs, err := r.LookupRecords(ctx, name, dns.TypeMX)
+	if err != nil {
+		return nil, e.Forward(err)
+	}
+	mxs := make([]*net.MX, 0, len(rrs))
+	for _, rr := range rrs {
+		if mx, ok := rr.(*dns.MX); ok {
+			mxs = append(mxs, &net.MX{Host: strings.TrimSuffix(mx.Mx, "."), Pref: mx.Preference})
+		}
+	}
+	sort.SliceStable(mxs, func(i, j int) bool {
+		return mxs[i].Pref < mxs[j].Pref
+	})
+	return mxs, nil
+}
+
+// LookupTXT finds the text records of name. The strings of each record are
+// concatenated.
+func (r *Resolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	rrs, err := r.LookupRecords(ctx, name, dns.TypeTXT)
+	if err != nil {
+		return nil, e.Forward(err)
+	}
+	txts := make([]string, 0, len(rrs))
+	for _, rr := range rrs {
+		if txt, ok := rr.(*dns.TXT); ok {
+			txts = append(txts, strings.Join(txt.Txt, ""))
+		}
+	}
+	return txts, nil
+}
+
+// LookupSRV finds the service records of _service._proto.name sorted by
+// priority and weight. If service and proto are empty name is queried
+// directly.
+func (r *Resolver) LookupSRV(ctx context.Context, service, proto, name string) ([]*net.SRV, error) {
+	target := name
+	if service != "" || proto != "" {
+		target = "_" + service + "._" + proto + "." + name
+	}
+	rrs, err := r.LookupRecords(ctx, target, dns.TypeSRV)
+	if err != nil {
+		return nil, e.Forward(err)
+	}
+	srvs := make([]*net.SRV, 0, len(rrs))
+	for _, rr := range rrs {
+		if srv, ok := rr.(*dns.SRV); ok {
+			srvs = append(srvs, &net.SRV{
+				Target:   strings.TrimSuffix(srv.Target, "."),
+				Port:     srv.Port,
+				Priority: srv.Priority,
+				Weight:   srv.Weight,
+			})
+		}
+	}
+	sort.SliceStable(srvs, func(i, j int) bool {
+		if srvs[i].Priority != srvs[j].Priority {
+			return srvs[i].Priority < srvs[j].Priority
+		}
+		return srvs[i].Weight > srvs[j].Weight
+	})
+	return srvs, nil
+}
+
+// LookupCNAME finds the target of the CNAME record of name.
+func (r *Resolver) LookupCNAME(ctx context.Context, name string) (string, error) {
+	rrs, err := r.LookupRecords(ctx, name, dns.TypeCNAME)
+	if err != nil {
+		return "", e.Forward(err)
+	}
+	for _, rr := range rrs {
+		if cname, ok := rr.(*dns.CNAME); ok {
+			return strings.TrimSuffix(cname.Target, "."), nil
+		}
+	}
+	return "", negativeErr(ErrNoData)
+}
+
+// LookupNS finds the name servers of name.
+func (r *Resolver) LookupNS(ctx context.Context, name string) ([]*net.NS, error) {
+	rrs, err := r.LookupRecords(ctx, name, dns.TypeNS)
+	if err != nil {
+		return nil, e.Forward(err)
+	}
+	nss := make([]*net.NS, 0, len(rrs))
+	for _, rr := range rrs {
+		if ns, ok := rr.(*dns.NS); ok {
+			nss = append(nss, &net.NS{Host: strings.TrimSuffix(ns.Ns, ".")})
+		}
+	}
+	return nss, nil
+}
+
+// LookupSOA finds the start of authority of the zone name.
+func (r *Resolver) LookupSOA(ctx context.Context, name string) (*SOA, error) {
+	rrs, err := r.LookupRecords(ctx, name, dns.TypeSOA)
+	if err != nil {
+		return nil, e.Forward(err)
+	}
+	for _, rr := range rrs {
+		if soa, ok := rr.(*dns.SOA); ok {
+			return &SOA{
+				Ns:      strings.TrimSuffix(soa.Ns, "."),
+				Mbox:    strings.TrimSuffix(soa.Mbox, "."),
+				Serial:  soa.Serial,
+				Refresh: soa.Refresh,
+				Retry:   soa.Retry,
+				Expire:  soa.Expire,
+				Minttl:  soa.Minttl,
+			}, nil
+		}
+	}
+	return nil, negativeErr(ErrNoData)
+}
+
+// LookupCAA finds the certification authority authorization records of
+// name. Like RFC 8659 says, the caller must climb the tree if name has
+// none.
+func (r *Resolver) LookupCAA(ctx context.Context, name string) ([]*CAA, error) {
+	rrs, err := r.LookupRecords(ctx, name, dns.TypeCAA)
+	if err != nil {
+		return nil, e.Forward(err)
+	}
+	caas := make([]*CAA, 0, len(rrs))
+	for _, rr := range rrs {
+		if caa, ok := rr.(*dns.CAA); ok {
+			caas = append(caas, &CAA{Flag: caa.Flag, Tag: caa.Tag, Value: caa.Value})
+		}
+	}
+	return caas, nil
+}
@@ -0,0 +1,131 @@
+// Copyright 2015 Felipe A. Cavani. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dns
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+
+	"github.com/fcavani/e"
+	"github.com/miekg/dns"
+)
+
+var testRecords = map[uint16][]string{
+	dns.TypeMX: {
+		"example.com. 300 IN MX 20 mx2.example.com.",
+		"example.com. 300 IN MX 10 mx1.example.com.",
+	},
+	dns.TypeTXT:   {`example.com. 300 IN TXT "v=spf1 " "-all"`},
+	dns.TypeCNAME: {"www.example.com. 300 IN CNAME example.com."},
+	dns.TypeNS:    {"example.com. 300 IN NS ns1.example.com."},
+	dns.TypeSOA:   {"example.com. 300 IN SOA ns1.example.com. admin.example.com. 2020010101 7200 3600 1209600 300"},
+	dns.TypeCAA:   {`example.com. 300 IN CAA 0 issue "ca.example"`},
+	dns.TypeSRV: {
+		"_sip._tcp.example.com. 300 IN SRV 20 0 5060 sip2.example.com.",
+		"_sip._tcp.example.com. 300 IN SRV 10 5 5060 sip1.example.com.",
+	},
+}
+
+func TestLookupRecords(t *testing.T) {
+	var count int32
+	addr, shutdown := startServer(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		atomic.AddInt32(&count, 1)
+		m := new(dns.Msg)
+		m.SetReply(req)
+		q := req.Question[0]
+		for _, text := range testRecords[q.Qtype] {
+			rr, _ := dns.NewRR(text)
+			if rr.Header().Name == q.Name {
+				m.Answer = append(m.Answer, rr)
+			}
+		}
+		if len(m.Answer) == 0 {
+			soa, _ := dns.NewRR(testRecords[dns.TypeSOA][0])
+			m.Ns = append(m.Ns, soa)
+		}
+		w.WriteMsg(m)
+	})
+	defer shutdown()
+
+	host, port, _ := net.SplitHostPort(addr)
+	r, err := NewResolver(WithServers(host), WithPort(port))
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+	defer r.Close()
+	ctx := context.Background()
+
+	mxs, err := r.LookupMX(ctx, "example.com")
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+	if len(mxs) != 2 || mxs[0].Host != "mx1.example.com" || mxs[0].Pref != 10 {
+		t.Fatal("wrong mx", mxs)
+	}
+	txts, err := r.LookupTXT(ctx, "example.com")
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+	if len(txts) != 1 || txts[0] != "v=spf1 -all" {
+		t.Fatal("wrong txt", txts)
+	}
+	srvs, err := r.LookupSRV(ctx, "sip", "tcp", "example.com")
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+	if len(srvs) != 2 || srvs[0].Target != "sip1.example.com" || srvs[0].Port != 5060 {
+		t.Fatal("wrong srv", srvs)
+	}
+	cname, err := r.LookupCNAME(ctx, "www.example.com")
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+	if cname != "example.com" {
+		t.Fatal("wrong cname", cname)
+	}
+	nss, err := r.LookupNS(ctx, "example.com")
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+	if len(nss) != 1 || nss[0].Host != "ns1.example.com" {
+		t.Fatal("wrong ns", nss)
+	}
+	soa, err := r.LookupSOA(ctx, "example.com")
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+	if soa.Ns != "ns1.example.com" || soa.Serial != 2020010101 || soa.Minttl != 300 {
+		t.Fatal("wrong soa", soa)
+	}
+	caas, err := r.LookupCAA(ctx, "example.com")
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+	if len(caas) != 1 || caas[0].Tag != "issue" || caas[0].Value != "ca.example" {
+		t.Fatal("wrong caa", caas)
+	}
+	_, err = r.LookupCNAME(ctx, "example.com")
+	if !e.Equal(err, ErrCantResolve) {
+		t.Fatal("wrong error", err)
+	}
+
+	// All answers came from the cache.
+	n := atomic.LoadInt32(&count)
+	_, err = r.LookupMX(ctx, "EXAMPLE.com.")
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+	if atomic.LoadInt32(&count) != n {
+		t.Fatal("mx not cached")
+	}
+	if r.Cache().Get("example.com./MX") == nil || r.Cache().Get("example.com./TXT") == nil {
+		t.Fatal("wrong cache keys")
+	}
+	if r.Cache().Get("example.com") != nil {
+		t.Fatal("records cached as addresses")
+	}
+}
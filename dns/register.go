@@ -0,0 +1,192 @@
+// Copyright 2015 Felipe A. Cavani. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dns
+
+import (
+	"context"
+	"net"
+	"sync"
+
+	"github.com/fcavani/e"
+	log "github.com/fcavani/slog"
+	mdns "github.com/grandcat/zeroconf"
+)
+
+const ErrNotRegistered = "service not registered"
+
+// Service is a multicast DNS service instance to announce.
+type Service struct {
+	// Instance is the name of the instance, like "Office printer".
+	Instance string
+	// Service is the type of the service, like "_ipp._tcp".
+	Service string
+	// Domain is the domain of the service. The default is "local.".
+	Domain string
+	// Port is the port of the service.
+	Port int
+	// Text are the TXT records, "key=value" strings.
+	Text []string
+	// Host and IPs announce a service of other host. If Host is empty the
+	// service is of this host, with the addresses of the interfaces.
+	Host string
+	IPs  []string
+	// Interfaces are the interfaces where the service is announced. If nil
+	// all multicast interfaces are used.
+	Interfaces []net.Interface
+}
+
+// Registrar announces the multicast DNS services. Register announces svc
+// until the Shutdown of the announcement.
+type Registrar interface {
+	Register(svc Service) (Announcement, error)
+}
+
+// Announcement is an announced service, like a zeroconf server.
+type Announcement interface {
+	// SetText replaces the TXT records and announces them.
+	SetText(text []string)
+	// Shutdown stops announcing the service and sends the goodbye packets.
+	Shutdown()
+}
+
+// WithRegistrar uses reg to announce the services instead of zeroconf, for
+// example to test without the network.
+func WithRegistrar(reg Registrar) Option {
+	return func(r *Resolver) error {
+		if reg == nil {
+			return e.New("invalid registrar")
+		}
+		r.registrar = reg
+		return nil
+	}
+}
+
+// zeroconfRegistrar announces the services with the zeroconf servers.
+type zeroconfRegistrar struct{}
+
+func (zeroconfRegistrar) Register(svc Service) (Announcement, error) {
+	if svc.Host != "" {
+		return mdns.RegisterProxy(svc.Instance, svc.Service, svc.Domain, svc.Port, svc.Host, svc.IPs, svc.Text, svc.Interfaces)
+	}
+	return mdns.Register(svc.Instance, svc.Service, svc.Domain, svc.Port, svc.Text, svc.Interfaces)
+}
+
+// Registration is a service announced by Register.
+type Registration struct {
+	lck    sync.Mutex
+	r      *Resolver
+	svc    Service
+	server Announcement
+}
+
+// registry has the registrations of a resolver not unregistered yet.
+type registry struct {
+	lck  sync.Mutex
+	regs map[*Registration]struct{}
+}
+
+// Register announces the service until it is unregistered.
+func (r *Resolver) Register(svc Service) (*Registration, error) {
+	if svc.Instance == "" || svc.Service == "" {
+		return nil, e.New("invalid service")
+	}
+	if svc.Port <= 0 || svc.Port > 65535 {
+		return nil, e.New("invalid port")
+	}
+	if svc.Domain == "" {
+		svc.Domain = "local."
+	}
+	svc.Text = append([]string(nil), svc.Text...)
+	svc.IPs = append([]string(nil), svc.IPs...)
+	svc.Interfaces = append([]net.Interface(nil), svc.Interfaces...)
+
+	registrar := r.registrar
+	if registrar == nil {
+		registrar = zeroconfRegistrar{}
+	}
+	server, err := registrar.Register(svc)
+	if err != nil {
+		return nil, e.Push(e.New(err), "failed to register the service")
+	}
+	log.DebugLevel().Tag("dns", "mdns").Printf("Registered %v.%v.%v port %v", svc.Instance, svc.Service, svc.Domain, svc.Port)
+
+	reg := &Registration{r: r, svc: svc, server: server}
+	r.registry.lck.Lock()
+	if r.registry.regs == nil {
+		r.registry.regs = make(map[*Registration]struct{})
+	}
+	r.registry.regs[reg] = struct{}{}
+	r.registry.lck.Unlock()
+	return reg, nil
+}
+
+// Service returns the registered service.
+func (reg *Registration) Service() Service {
+	reg.lck.Lock()
+	defer reg.lck.Unlock()
+	return reg.svc
+}
+
+// SetText replaces the TXT records and announces them.
+func (reg *Registration) SetText(text []string) error {
+	reg.lck.Lock()
+	defer reg.lck.Unlock()
+	if reg.server == nil {
+		return e.New(ErrNotRegistered)
+	}
+	reg.svc.Text = append([]string(nil), text...)
+	reg.server.SetText(reg.svc.Text)
+	return nil
+}
+
+// Unregister stops announcing the service. The goodbye packets tell the
+// other hosts to forget it.
+func (reg *Registration) Unregister() error {
+	reg.lck.Lock()
+	defer reg.lck.Unlock()
+	if reg.server == nil {
+		return e.New(ErrNotRegistered)
+	}
+	reg.server.Shutdown()
+	reg.server = nil
+
+	reg.r.registry.lck.Lock()
+	delete(reg.r.registry.regs, reg)
+	reg.r.registry.lck.Unlock()
+	log.DebugLevel().Tag("dns", "mdns").Printf("Unregistered %v.%v.%v", reg.svc.Instance, reg.svc.Service, reg.svc.Domain)
+	return nil
+}
+
+// UnregisterAll unregisters all services registered with the resolver, for
+// a graceful shutdown. It returns when all goodbye packets were sent or
+// when ctx is done.
+func (r *Resolver) UnregisterAll(ctx context.Context) error {
+	r.registry.lck.Lock()
+	regs := make([]*Registration, 0, len(r.registry.regs))
+	for reg := range r.registry.regs {
+		regs = append(regs, reg)
+	}
+	r.registry.lck.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		var wg sync.WaitGroup
+		for _, reg := range regs {
+			wg.Add(1)
+			go func(reg *Registration) {
+				defer wg.Done()
+				reg.Unregister()
+			}(reg)
+		}
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return e.Forward(ctx.Err())
+	}
+}
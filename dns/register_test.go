@@ -0,0 +1,200 @@
+// Copyright 2015 Felipe A. Cavani. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dns
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/fcavani/e"
+	"github.com/fcavani/net/dns/dnstest"
+	mdns "github.com/grandcat/zeroconf"
+	"github.com/miekg/dns"
+)
+
+// multicastIface returns the loopback interface if it supports multicast,
+// or other interface that does.
+func multicastIface(t *testing.T) net.Interface {
+	ifs, err := net.Interfaces()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var found *net.Interface
+	for i, iface := range ifs {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagMulticast == 0 {
+			continue
+		}
+		if iface.Flags&net.FlagLoopback != 0 {
+			return iface
+		}
+		if found == nil {
+			found = &ifs[i]
+		}
+	}
+	if found == nil {
+		t.Skip("no multicast interface")
+	}
+	return *found
+}
+
+// browse returns the instances of service found in timeout.
+func browse(t *testing.T, r *Resolver, service string, timeout time.Duration) []*mdns.ServiceEntry {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	entries := make(chan *mdns.ServiceEntry)
+	err := r.multicast().Browse(ctx, service, "local.", entries)
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+	var found []*mdns.ServiceEntry
+	for entry := range entries {
+		found = append(found, entry)
+	}
+	return found
+}
+
+func TestRegister(t *testing.T) {
+	iface := multicastIface(t)
+	r, err := NewResolver(WithMulticastOptions(mdns.SelectIfaces([]net.Interface{iface})))
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+	defer r.Close()
+
+	reg, err := r.Register(Service{
+		Instance:   "test",
+		Service:    "_fcavani-test._tcp",
+		Port:       8080,
+		Text:       []string{"path=/"},
+		Host:       "testhost",
+		IPs:        []string{"127.0.0.1"},
+		Interfaces: []net.Interface{iface},
+	})
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+	if reg.Service().Domain != "local." {
+		t.Fatal("wrong domain", reg.Service().Domain)
+	}
+
+	found := browse(t, r, "_fcavani-test._tcp", 2*time.Second)
+	if len(found) != 1 {
+		t.Fatal("service not found", found)
+	}
+	if found[0].Instance != "test" || found[0].Port != 8080 || len(found[0].Text) != 1 || found[0].Text[0] != "path=/" {
+		t.Fatal("wrong entry", found[0])
+	}
+
+	err = reg.Unregister()
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+	if err = reg.Unregister(); !e.Equal(err, ErrNotRegistered) {
+		t.Fatal("wrong error", err)
+	}
+	found = browse(t, r, "_fcavani-test._tcp", time.Second)
+	if len(found) != 0 {
+		t.Fatal("service still announced", found)
+	}
+
+	_, err = r.Register(Service{Instance: "test", Service: "_fcavani-test._tcp"})
+	if err == nil {
+		t.Fatal("service without port registered")
+	}
+}
+
+// testRegistrar announces the services in the zone of a dnstest server.
+type testRegistrar struct {
+	s *dnstest.Server
+}
+
+func (tr testRegistrar) Register(svc Service) (Announcement, error) {
+	service := dns.Fqdn(svc.Service + "." + svc.Domain)
+	name := escapeLabel(svc.Instance) + "." + service
+	a := &testAnnouncement{s: tr.s, rrs: []dns.RR{
+		&dns.PTR{Hdr: dns.RR_Header{Name: service, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: 120}, Ptr: name},
+		&dns.SRV{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeSRV, Class: dns.ClassINET, Ttl: 120}, Port: uint16(svc.Port), Target: dns.Fqdn(svc.Host)},
+	}}
+	tr.s.AddRR(a.rrs...)
+	a.SetText(svc.Text)
+	return a, nil
+}
+
+// testAnnouncement is a service in the zone of a dnstest server.
+type testAnnouncement struct {
+	s   *dnstest.Server
+	rrs []dns.RR
+	txt *dns.TXT
+}
+
+func (a *testAnnouncement) SetText(text []string) {
+	if a.txt != nil {
+		a.s.RemoveRR(a.txt)
+	}
+	a.txt = &dns.TXT{Hdr: dns.RR_Header{Name: a.rrs[1].Header().Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 120}, Txt: text}
+	a.s.AddRR(a.txt)
+}
+
+func (a *testAnnouncement) Shutdown() {
+	a.s.RemoveRR(append(a.rrs, a.txt)...)
+}
+
+func TestUnregisterAll(t *testing.T) {
+	s, err := dnstest.NewServer()
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+	defer s.Close()
+	r, err := NewResolver(WithHostsFile(""), WithBrowser(s), WithRegistrar(testRegistrar{s}))
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+	defer r.Close()
+
+	var regs []*Registration
+	for _, instance := range []string{"one", "two"} {
+		reg, err := r.Register(Service{
+			Instance: instance,
+			Service:  "_fcavani-all._tcp",
+			Port:     8080,
+			Host:     "testhost.local",
+			IPs:      []string{"127.0.0.1"},
+			Text:     []string{"path=/"},
+		})
+		if err != nil {
+			t.Fatal(e.Trace(e.Forward(err)))
+		}
+		regs = append(regs, reg)
+	}
+	if found := browse(t, r, "_fcavani-all._tcp", time.Second); len(found) != 2 {
+		t.Fatal("services not found", found)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	// The services of other resolvers aren't unregistered.
+	err = UnregisterAll(ctx)
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+	if found := browse(t, r, "_fcavani-all._tcp", time.Second); len(found) != 2 {
+		t.Fatal("services unregistered", found)
+	}
+
+	err = r.UnregisterAll(ctx)
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+	for _, reg := range regs {
+		if err := reg.SetText(nil); !e.Equal(err, ErrNotRegistered) {
+			t.Fatal("not unregistered", err)
+		}
+	}
+	if found := browse(t, r, "_fcavani-all._tcp", time.Second); len(found) != 0 {
+		t.Fatal("services still announced", found)
+	}
+}
@@ -0,0 +1,182 @@
+// Copyright 2015 Felipe A. Cavani. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dns
+
+import (
+	"os"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/fcavani/e"
+	log "github.com/fcavani/slog"
+	"github.com/miekg/dns"
+)
+
+// ReloadInterval is the interval between the checks of the configuration
+// file's modification time, for the resolvers created without WithReload.
+var ReloadInterval = 5 * time.Second
+
+// WithReload sets the interval between the checks of the configuration
+// file. The file is checked, and read again if its modification time or
+// size changed, by the lookups after the interval. A zero or negative
+// interval disables the reload. There is no reload for the resolvers created with
+// WithConfig.
+func WithReload(interval time.Duration) Option {
+	return func(r *Resolver) error {
+		r.reloadInterval = interval
+		if interval == 0 {
+			r.reloadInterval = -1
+		}
+		return nil
+	}
+}
+
+// WithConfigHook sets a function called after a reload changed the
+// configuration, like the name servers, with copies of the old and the new
+// configuration. It runs without the resolver's lock and may use the
+// resolver.
+func WithConfigHook(f func(old, new *dns.ClientConfig)) Option {
+	return func(r *Resolver) error {
+		if f == nil {
+			return e.New("invalid hook")
+		}
+		r.hook = f
+		return nil
+	}
+}
+
+// reloader tracks the configuration file.
+type reloader struct {
+	path     string
+	interval time.Duration
+
+	lck     sync.Mutex
+	checked time.Time
+	mtime   time.Time
+	size    int64
+}
+
+func newReloader(path string, interval time.Duration) *reloader {
+	if interval == 0 {
+		interval = ReloadInterval
+	}
+	rl := &reloader{
+		path:     path,
+		interval: interval,
+		checked:  time.Now(),
+		size:     -1,
+	}
+	if fi, err := os.Stat(path); err == nil {
+		rl.mtime = fi.ModTime()
+		rl.size = fi.Size()
+	}
+	return rl
+}
+
+// changed returns true if the file changed since the last check. If force
+// is false the file is checked only after the interval.
+func (rl *reloader) changed(force bool) bool {
+	rl.lck.Lock()
+	defer rl.lck.Unlock()
+	now := time.Now()
+	if !force && now.Sub(rl.checked) < rl.interval {
+		return false
+	}
+	rl.checked = now
+	fi, err := os.Stat(rl.path)
+	if err != nil {
+		// Keep the last configuration.
+		return false
+	}
+	if fi.ModTime().Equal(rl.mtime) && fi.Size() == rl.size {
+		return false
+	}
+	rl.mtime = fi.ModTime()
+	rl.size = fi.Size()
+	return true
+}
+
+// copyConfig returns a deep copy of cfg.
+func copyConfig(cfg *dns.ClientConfig) *dns.ClientConfig {
+	c := *cfg
+	c.Servers = append([]string(nil), cfg.Servers...)
+	c.Search = append([]string(nil), cfg.Search...)
+	return &c
+}
+
+// override applies the options that override the configuration file.
+func (r *Resolver) override(cfg *dns.ClientConfig) *dns.ClientConfig {
+	if len(r.servers) > 0 {
+		cfg.Servers = append([]string(nil), r.servers...)
+	}
+	if r.port != "" {
+		cfg.Port = r.port
+	}
+	if r.attempts > 0 {
+		cfg.Attempts = r.attempts
+	}
+	if r.timeout > 0 {
+		cfg.Timeout = r.timeout
+	} else {
+		cfg.Timeout = Timeout
+	}
+	return cfg
+}
+
+// config returns the current configuration, reloading it if it changed.
+func (r *Resolver) config() *dns.ClientConfig {
+	if r.reload != nil && r.reload.changed(false) {
+		r.load()
+	}
+	return r.conf.Load().(*dns.ClientConfig)
+}
+
+// configFor returns config or, if it is nil, the resolver's configuration.
+func (r *Resolver) configFor(config *dns.ClientConfig) *dns.ClientConfig {
+	if config != nil {
+		return config
+	}
+	return r.config()
+}
+
+// Config returns a copy of the resolver's current configuration.
+func (r *Resolver) Config() *dns.ClientConfig {
+	return copyConfig(r.config())
+}
+
+// Reload reads the configuration file again if it changed. It does nothing
+// for the resolvers created with WithConfig.
+func (r *Resolver) Reload() error {
+	if r.reload == nil || !r.reload.changed(true) {
+		return nil
+	}
+	return e.Forward(r.load())
+}
+
+// load reads the configuration file and swaps the configuration if it
+// changed.
+func (r *Resolver) load() error {
+	cfg, err := dns.ClientConfigFromFile(r.reload.path)
+	if err != nil {
+		log.ErrorLevel().Tag("dns", "config").Println("config reload failed:", err)
+		return e.Push(e.New(err), "config failed")
+	}
+	cfg = r.override(cfg)
+	r.lck.Lock()
+	old := r.conf.Load().(*dns.ClientConfig)
+	if reflect.DeepEqual(old, cfg) {
+		r.lck.Unlock()
+		return nil
+	}
+	r.conf.Store(cfg)
+	r.lck.Unlock()
+	log.DebugLevel().Tag("dns", "config").Printf("Configuration reloaded, servers: %v", cfg.Servers)
+	// The hook runs without the lock, it may use the resolver.
+	if r.hook != nil {
+		r.hook(copyConfig(old), copyConfig(cfg))
+	}
+	return nil
+}
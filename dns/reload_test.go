@@ -0,0 +1,192 @@
+// Copyright 2015 Felipe A. Cavani. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dns
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fcavani/e"
+	"github.com/miekg/dns"
+)
+
+// startServerAt starts a local udp dns server at addr that answers the A
+// queries with ip.
+func startServerAt(t *testing.T, addr, ip string) (shutdown func()) {
+	pc, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		t.Skip("can't listen:", err)
+	}
+	started := make(chan struct{})
+	srv := &dns.Server{
+		PacketConn: pc,
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+			m := new(dns.Msg)
+			m.SetReply(req)
+			if req.Question[0].Qtype == dns.TypeA {
+				rr, _ := dns.NewRR(req.Question[0].Name + " 60 IN A " + ip)
+				m.Answer = append(m.Answer, rr)
+			}
+			w.WriteMsg(m)
+		}),
+		NotifyStartedFunc: func() { close(started) },
+	}
+	go srv.ActivateAndServe()
+	<-started
+	return func() { srv.Shutdown() }
+}
+
+// writeConfig writes a resolv.conf and moves its modification time to the
+// future, the file system time may be too coarse to see the change.
+func writeConfig(t *testing.T, path, content string, mtime time.Time) {
+	err := ioutil.WriteFile(path, []byte(content), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Chtimes(path, mtime, mtime)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReload(t *testing.T) {
+	addr, shutdown := startServer(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(req)
+		if req.Question[0].Qtype == dns.TypeA {
+			rr, _ := dns.NewRR(req.Question[0].Name + " 60 IN A 192.0.2.1")
+			m.Answer = append(m.Answer, rr)
+		}
+		w.WriteMsg(m)
+	})
+	defer shutdown()
+	_, port, _ := net.SplitHostPort(addr)
+	defer startServerAt(t, net.JoinHostPort("127.0.0.2", port), "192.0.2.2")()
+
+	dir, err := ioutil.TempDir("", "reload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	conf := filepath.Join(dir, "resolv.conf")
+	writeConfig(t, conf, "nameserver 127.0.0.1\n", time.Now())
+
+	var lck sync.Mutex
+	var changes [][2]string
+	r, err := NewResolver(
+		WithConfigFile(conf),
+		WithPort(port),
+		WithReload(time.Hour),
+		WithConfigHook(func(old, new *dns.ClientConfig) {
+			lck.Lock()
+			defer lck.Unlock()
+			changes = append(changes, [2]string{old.Servers[0], new.Servers[0]})
+		}),
+	)
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+	defer r.Close()
+
+	addrs, err := r.LookupHostNoCache("a.example")
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+	if len(addrs) != 1 || addrs[0] != "192.0.2.1" {
+		t.Fatal("wrong addresses", addrs)
+	}
+
+	writeConfig(t, conf, "nameserver 127.0.0.2\nsearch example\n", time.Now().Add(time.Minute))
+	// Not yet, the interval is one hour.
+	if r.Config().Servers[0] != "127.0.0.1" {
+		t.Fatal("reloaded before the interval")
+	}
+	err = r.Reload()
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+	cfg := r.Config()
+	if cfg.Servers[0] != "127.0.0.2" || cfg.Port != port || len(cfg.Search) != 1 {
+		t.Fatal("wrong config", cfg)
+	}
+	addrs, err = r.LookupHostNoCache("a.example")
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+	if len(addrs) != 1 || addrs[0] != "192.0.2.2" {
+		t.Fatal("wrong addresses", addrs)
+	}
+	lck.Lock()
+	if len(changes) != 1 || changes[0] != [2]string{"127.0.0.1", "127.0.0.2"} {
+		t.Fatal("wrong hook calls", changes)
+	}
+	lck.Unlock()
+
+	// The lookups check the file after the interval.
+	r.reload.interval = 0
+	writeConfig(t, conf, "nameserver 127.0.0.1\n", time.Now().Add(2*time.Minute))
+	addrs, err = r.LookupHostNoCache("a.example")
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+	if len(addrs) != 1 || addrs[0] != "192.0.2.1" {
+		t.Fatal("wrong addresses", addrs)
+	}
+
+	// An invalid file keeps the configuration.
+	os.Remove(conf)
+	if r.Config().Servers[0] != "127.0.0.1" {
+		t.Fatal("configuration lost")
+	}
+}
+
+func TestReloadHookUsesResolver(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	conf := filepath.Join(dir, "resolv.conf")
+	writeConfig(t, conf, "nameserver 127.0.0.1\n", time.Now())
+
+	var r *Resolver
+	called := make(chan string, 1)
+	r, err = NewResolver(
+		WithConfigFile(conf),
+		WithReload(time.Hour),
+		WithHostsFile(""),
+		WithConfigHook(func(old, new *dns.ClientConfig) {
+			// The hook may use the resolver.
+			r.Reload()
+			r.multicast()
+			new.Servers[0] = "changed by the hook"
+			called <- r.Config().Servers[0]
+		}),
+	)
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+	defer r.Close()
+
+	writeConfig(t, conf, "nameserver 127.0.0.2\n", time.Now().Add(time.Minute))
+	done := make(chan error, 1)
+	go func() { done <- r.Reload() }()
+	select {
+	case err = <-done:
+		if err != nil {
+			t.Fatal(e.Trace(e.Forward(err)))
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("deadlock in the hook")
+	}
+	if server := <-called; server != "127.0.0.2" {
+		t.Fatal("the hook changed the configuration", server)
+	}
+}
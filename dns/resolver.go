@@ -0,0 +1,942 @@
+// Copyright 2015 Felipe A. Cavani. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build !windows
+
+package dns
+
+import (
+	"context"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fcavani/e"
+	utilNet "github.com/fcavani/net"
+	utilUrl "github.com/fcavani/net/url"
+	log "github.com/fcavani/slog"
+	mdns "github.com/grandcat/zeroconf"
+	"github.com/miekg/dns"
+)
+
+// Resolver holds the name servers, timeouts, cache and multicast DNS
+// configuration used to resolve names. Each Resolver is independent of
+// the others, use NewResolver to create one.
+type Resolver struct {
+	// next is the start of the next round robin, first for the 64 bits
+	// alignment.
+	next uint64
+	// conf holds the current *dns.ClientConfig.
+	conf      atomic.Value
+	reload    *reloader
+	hook      func(old, new *dns.ClientConfig)
+	lck       sync.Mutex
+	strategy  Strategy
+	health    healthTable
+	upstreams []*Upstream
+	// configServers asks the servers of the configuration with the
+	// upstreams.
+	configServers bool
+	cache         Cacher
+	ownCache      bool
+	mdnsOpts      []mdns.ClientOption
+	mdnsIfaces    []net.Interface
+	mdnsAddrs     []*net.UDPAddr
+	browser       Browser
+	registrar     Registrar
+	registry      registry
+	hosts         *hosts
+	flight        flight
+
+	dialTimeout  time.Duration
+	readTimeout  time.Duration
+	writeTimeout time.Duration
+	udpSize      int
+	maxCNAME     int
+	dnssec       bool
+	anchors      map[string][]dns.RR
+
+	// Used to assemble the configuration.
+	static         *dns.ClientConfig
+	configFile     string
+	reloadInterval time.Duration
+	hostsFile      string
+	noHosts        bool
+	servers        []string
+	port           string
+	attempts       int
+	timeout        int
+}
+
+// Option configures a Resolver in NewResolver.
+type Option func(r *Resolver) error
+
+// WithConfig uses cfg instead of reading ConfigurationFile. cfg is copied.
+func WithConfig(cfg *dns.ClientConfig) Option {
+	return func(r *Resolver) error {
+		if cfg == nil {
+			return e.New("invalid configuration")
+		}
+		r.static = copyConfig(cfg)
+		return nil
+	}
+}
+
+// WithConfigFile reads the configuration from path, a file in the
+// resolv.conf format, instead of ConfigurationFile.
+func WithConfigFile(path string) Option {
+	return func(r *Resolver) error {
+		if path == "" {
+			return e.New("invalid configuration file")
+		}
+		r.configFile = path
+		return nil
+	}
+}
+
+// WithHostsFile reads the hosts from path instead of HostsFile. An empty
+// path disables the hosts file.
+func WithHostsFile(path string) Option {
+	return func(r *Resolver) error {
+		r.hostsFile = path
+		r.noHosts = path == ""
+		return nil
+	}
+}
+
+// WithServers sets the name servers, ip addresses without the port.
+func WithServers(servers ...string) Option {
+	return func(r *Resolver) error {
+		if len(servers) == 0 {
+			return e.New("no servers")
+		}
+		r.servers = append([]string(nil), servers...)
+		return nil
+	}
+}
+
+// WithPort sets the port of the name servers.
+func WithPort(port string) Option {
+	return func(r *Resolver) error {
+		if port == "" {
+			return e.New("invalid port")
+		}
+		r.port = port
+		return nil
+	}
+}
+
+// WithAttempts sets the number of attempts.
+func WithAttempts(attempts int) Option {
+	return func(r *Resolver) error {
+		if attempts <= 0 {
+			return e.New("invalid number of attempts")
+		}
+		r.attempts = attempts
+		return nil
+	}
+}
+
+// WithTimeout sets the timeout of the configuration, in seconds.
+func WithTimeout(timeout int) Option {
+	return func(r *Resolver) error {
+		if timeout <= 0 {
+			return e.New("invalid timeout")
+		}
+		r.timeout = timeout
+		return nil
+	}
+}
+
+// WithDialTimeout sets the dial timeout. If not set DialTimeout is used.
+func WithDialTimeout(d time.Duration) Option {
+	return func(r *Resolver) error {
+		r.dialTimeout = d
+		return nil
+	}
+}
+
+// WithReadTimeout sets the read timeout. If not set ReadTimeout is used.
+func WithReadTimeout(d time.Duration) Option {
+	return func(r *Resolver) error {
+		r.readTimeout = d
+		return nil
+	}
+}
+
+// WithWriteTimeout sets the write timeout. If not set WriteTimeout is used.
+func WithWriteTimeout(d time.Duration) Option {
+	return func(r *Resolver) error {
+		r.writeTimeout = d
+		return nil
+	}
+}
+
+// WithUDPSize sets the UDP buffer size advertised with EDNS0. Zero
+// disables EDNS0. If not set UDPSize is used.
+func WithUDPSize(size int) Option {
+	return func(r *Resolver) error {
+		if size != 0 && (size < dns.MinMsgSize || size > dns.MaxMsgSize) {
+			return e.New("invalid udp size")
+		}
+		r.udpSize = size
+		if size == 0 {
+			r.udpSize = -1
+		}
+		return nil
+	}
+}
+
+// WithMaxCNAME sets the maximum length of a CNAME chain. If not set
+// MaxCNAME is used.
+func WithMaxCNAME(n int) Option {
+	return func(r *Resolver) error {
+		if n <= 0 {
+			return e.New("invalid cname chain length")
+		}
+		r.maxCNAME = n
+		return nil
+	}
+}
+
+// WithCache sets the cache. The resolver doesn't close a cache set this way.
+func WithCache(c Cacher) Option {
+	return func(r *Resolver) error {
+		if c == nil {
+			return e.New("invalid cache")
+		}
+		r.cache = c
+		return nil
+	}
+}
+
+// WithMulticastOptions sets the options of the multicast DNS resolver,
+// like the interfaces selected with zeroconf.SelectIfaces.
+func WithMulticastOptions(opts ...mdns.ClientOption) Option {
+	return func(r *Resolver) error {
+		r.mdnsOpts = append([]mdns.ClientOption(nil), opts...)
+		return nil
+	}
+}
+
+// NewResolver creates a new resolver. Without options the configuration
+// is read from ConfigurationFile, and read again when the file changes, and
+// a new cache is created.
+func NewResolver(opts ...Option) (*Resolver, error) {
+	r := new(Resolver)
+	for _, opt := range opts {
+		err := opt(r)
+		if err != nil {
+			return nil, e.Forward(err)
+		}
+	}
+
+	if r.dnssec && r.udpSize < 0 {
+		return nil, e.New("dnssec needs edns0")
+	}
+	if r.configServers {
+		for _, u := range r.upstreams {
+			if u.Net == NetTLS {
+				return nil, e.New("the configuration servers can't be asked with the tls upstream %v", u)
+			}
+		}
+	}
+
+	var cfg *dns.ClientConfig
+	path := r.configFile
+	if r.static != nil {
+		cfg = copyConfig(r.static)
+	} else if path != "" {
+		var err error
+		cfg, err = dns.ClientConfigFromFile(path)
+		if err != nil {
+			return nil, e.Push(e.New(err), "config failed")
+		}
+	} else {
+		cfg = defaultConfig()
+		path = ConfigurationFile
+	}
+	r.conf.Store(r.override(cfg))
+
+	if r.static == nil && r.reloadInterval >= 0 {
+		r.reload = newReloader(path, r.reloadInterval)
+	}
+
+	if !r.noHosts {
+		path := r.hostsFile
+		if path == "" {
+			path = HostsFile
+		}
+		r.hosts = newHosts(path)
+	}
+
+	if r.cache == nil {
+		r.cache = NewCache(NewMem(), DefaultExpire, Sleep)
+		r.cache.PutAddrs("localhost", []string{"127.0.0.1", "::1"})
+		r.cache.PutPtr("127.0.0.1", "localhost")
+		r.cache.PutPtr("::1", "localhost")
+		r.ownCache = true
+	}
+	if c, ok := r.cache.(Refresher); ok {
+		c.SetRefresh(r.refresh)
+	}
+
+	return r, nil
+}
+
+// defaultConfig reads ConfigurationFile. If it fails use the Google's
+// public servers.
+func defaultConfig() *dns.ClientConfig {
+	cfg, err := dns.ClientConfigFromFile(ConfigurationFile)
+	if err != nil {
+		log.ErrorLevel().Tag("dns", "config").Println("config failed:", err)
+		cfg = new(dns.ClientConfig)
+		cfg.Attempts = 3
+		cfg.Ndots = 1
+		cfg.Port = "53"
+		cfg.Servers = []string{"8.8.8.8", "8.8.4.4"}
+	}
+	return cfg
+}
+
+// Cache returns the resolver's cache.
+func (r *Resolver) Cache() Cacher {
+	return r.cache
+}
+
+// Close closes the cache if it was created by the resolver.
+func (r *Resolver) Close() error {
+	if !r.ownCache {
+		return nil
+	}
+	return e.Forward(r.cache.Close())
+}
+
+func (r *Resolver) client() *dns.Client {
+	c := new(dns.Client)
+	c.DialTimeout = r.dialTimeout
+	if c.DialTimeout == 0 {
+		c.DialTimeout = DialTimeout
+	}
+	c.ReadTimeout = r.readTimeout
+	if c.ReadTimeout == 0 {
+		c.ReadTimeout = ReadTimeout
+	}
+	c.WriteTimeout = r.writeTimeout
+	if c.WriteTimeout == 0 {
+		c.WriteTimeout = WriteTimeout
+	}
+	return c
+}
+
+// edns0 returns the UDP buffer size advertised with EDNS0, zero if EDNS0 is
+// disabled.
+func (r *Resolver) edns0() uint16 {
+	switch {
+	case r.udpSize < 0:
+		return 0
+	case r.udpSize > 0:
+		return uint16(r.udpSize)
+	}
+	return UDPSize
+}
+
+// LookupIp finds the name of the ip.
+func (r *Resolver) LookupIp(ip string) (host string, err error) {
+	return r.LookupIpContext(context.Background(), ip)
+}
+
+// LookupIpContext is like LookupIp but the lookup is bounded by ctx.
+func (r *Resolver) LookupIpContext(ctx context.Context, ip string) (host string, err error) {
+	start := time.Now()
+	defer func() {
+		log.DebugLevel().Tag("dns").Printf("LookupIp %v took: %v", ip, time.Since(start))
+	}()
+
+	// Like libc, the hosts file is read before the cache.
+	if name := r.hosts.lookupIp(ip); name != "" {
+		return name, nil
+	}
+
+	if ip == "127.0.0.1" || ip == "::1" {
+		return "localhost", nil
+	}
+
+	h := r.cache.Get(ip)
+	if h != nil {
+		return h.ReturnPtr()
+	}
+
+	if !utilNet.IsValidIpv4(ip) && !utilNet.IsValidIpv6(ip) {
+		return "", e.New("not a valid ip address")
+	}
+
+	for {
+		v, err, shared := r.flight.do(ctx, "ptr "+ip, func() (interface{}, error) {
+			return r.resolvePtr(ctx, ip)
+		})
+		if shared && isCtxErr(err) && !ctxDone(ctx) {
+			// The first caller gave up, try again.
+			continue
+		}
+		if err != nil {
+			return "", e.Forward(err)
+		}
+		return v.(string), nil
+	}
+}
+
+// resolvePtr asks the servers for the name of ip and caches the result.
+func (r *Resolver) resolvePtr(ctx context.Context, ip string) (string, error) {
+	rev, err := dns.ReverseAddr(ip)
+	if err != nil {
+		return "", e.Forward(err)
+	}
+	resp, err := r.query(ctx, nil, rev, dns.TypePTR)
+	if err != nil {
+		if !ctxDone(ctx) {
+			putNegative(r.cache, ip, Kind(err))
+		}
+		return "", e.Forward(err)
+	}
+	if resp.Rcode != dns.RcodeSuccess {
+		err = rcodeErr(resp.Rcode)
+		r.putNegative(ip, err, resp.Msg)
+		return "", e.Forward(err)
+	}
+
+	for _, a := range resp.Answer {
+		if ptr, ok := a.(*dns.PTR); ok {
+			ptraddr := strings.TrimSuffix(ptr.Ptr, ".")
+			putPtrTTL(r.cache, ip, ptraddr, time.Duration(ptr.Hdr.Ttl)*time.Second)
+			return ptraddr, nil
+		}
+	}
+	err = negativeErr(ErrNoData)
+	r.putNegative(ip, err, resp.Msg)
+	return "", e.Forward(err)
+}
+
+// LookupHost finds the addresses of host.
+func (r *Resolver) LookupHost(host string) (addrs []string, err error) {
+	return r.LookupHostContext(context.Background(), host)
+}
+
+// LookupHostContext is like LookupHost but the lookup is bounded by ctx.
+func (r *Resolver) LookupHostContext(ctx context.Context, host string) (addrs []string, err error) {
+	start := time.Now()
+	defer func() {
+		log.DebugLevel().Tag("dns").Printf("LookupHost %v took: %v", host, time.Since(start))
+	}()
+
+	_, addrs, err = r.lookupHost(ctx, host, true, nil)
+	if err != nil {
+		return nil, e.Forward(err)
+	}
+	return addrs, nil
+}
+
+// LookupCanonical finds the addresses of host and its canonical name, the
+// end of the CNAME chain that starts at host.
+func (r *Resolver) LookupCanonical(ctx context.Context, host string) (canonical string, addrs []string, err error) {
+	start := time.Now()
+	defer func() {
+		log.DebugLevel().Tag("dns").Printf("LookupCanonical %v took: %v", host, time.Since(start))
+	}()
+
+	canonical, addrs, err = r.lookupHost(ctx, host, true, nil)
+	if err != nil {
+		return "", nil, e.Forward(err)
+	}
+	return canonical, addrs, nil
+}
+
+// LookupCanonicalTTL is like LookupCanonical and returns the time of life
+// left of the cached addresses too, zero if it isn't known, like for the
+// names in the hosts file.
+func (r *Resolver) LookupCanonicalTTL(ctx context.Context, host string) (canonical string, addrs []string, ttl time.Duration, err error) {
+	canonical, addrs, err = r.LookupCanonical(ctx, host)
+	if err != nil {
+		return "", nil, 0, e.Forward(err)
+	}
+	if _, local := r.hosts.lookupHost(host); len(local) == 0 {
+		ttl, _ = remaining(r.cache, host)
+	}
+	return canonical, addrs, ttl, nil
+}
+
+// LookupHostNoCache is like LookupHost but ignores the cached entries.
+func (r *Resolver) LookupHostNoCache(host string) (addrs []string, err error) {
+	return r.LookupHostNoCacheContext(context.Background(), host)
+}
+
+// LookupHostNoCacheContext is like LookupHostNoCache but the lookup is
+// bounded by ctx.
+func (r *Resolver) LookupHostNoCacheContext(ctx context.Context, host string) (addrs []string, err error) {
+	start := time.Now()
+	defer func() {
+		log.DebugLevel().Tag("dns").Printf("LookupHostNoCache %v took: %v", host, time.Since(start))
+	}()
+
+	_, addrs, err = r.lookupHost(ctx, host, false, nil)
+	if err != nil {
+		return nil, e.Forward(err)
+	}
+	return addrs, nil
+}
+
+// LookupHostWithServers is like LookupHost but asks servers instead of the
+// resolver's name servers. timeout is in seconds.
+func (r *Resolver) LookupHostWithServers(host string, servers []string, attempts, timeout int) (addrs []string, err error) {
+	return r.LookupHostWithServersContext(context.Background(), host, servers, attempts, timeout)
+}
+
+// LookupHostWithServersContext is like LookupHostWithServers but the lookup
+// is bounded by ctx.
+func (r *Resolver) LookupHostWithServersContext(ctx context.Context, host string, servers []string, attempts, timeout int) (addrs []string, err error) {
+	start := time.Now()
+	defer func() {
+		log.DebugLevel().Tag("dns").Printf("LookupHostWithServers %v took: %v", host, time.Since(start))
+	}()
+
+	cfg := new(dns.ClientConfig)
+	cfg.Attempts = attempts
+	cfg.Ndots = r.config().Ndots
+	cfg.Port = r.config().Port
+	cfg.Servers = servers
+	cfg.Timeout = timeout
+
+	_, addrs, err = r.lookupHost(ctx, host, true, cfg)
+	if err != nil {
+		return nil, e.Forward(err)
+	}
+	return addrs, nil
+}
+
+// lookupHost finds the addresses of host with the name servers, or with
+// multicast DNS queries if host is in .local.
+func (r *Resolver) lookupHost(ctx context.Context, host string, useCache bool, config *dns.ClientConfig) (canonical string, addrs []string, err error) {
+	if !isLocal(host) {
+		canonical, addrs, err = r.queryDNS(ctx, host, useCache, config)
+		if err != nil {
+			return "", nil, e.Forward(err)
+		}
+		return canonical, addrs, nil
+	}
+	// The hosts file isn't used with other servers than the resolver's.
+	if config == nil {
+		canonical, addrs = r.hosts.lookupHost(host)
+		if len(addrs) > 0 {
+			return canonical, addrs, nil
+		}
+	}
+	addrs, err = r.querymDNS(ctx, host, useCache)
+	if err != nil {
+		return "", nil, e.Forward(err)
+	}
+	return host, addrs, nil
+}
+
+// hostAddrs is the result of resolveDNS.
+type hostAddrs struct {
+	canonical string
+	addrs     []string
+}
+
+func (r *Resolver) queryDNS(ctx context.Context, host string, useCache bool, config *dns.ClientConfig) (canonical string, addrs []string, err error) {
+	start := time.Now()
+	defer func() {
+		log.DebugLevel().Tag("dns").Printf("lookupHost %v took: %v", host, time.Since(start))
+	}()
+
+	if host == "localhost" {
+		return host, []string{"127.0.0.1", "::1"}, nil
+	}
+
+	// Like libc, the hosts file is read before the cache. It isn't used
+	// with other servers than the resolver's.
+	if config == nil {
+		canonical, addrs = r.hosts.lookupHost(host)
+		if len(addrs) > 0 {
+			return canonical, addrs, nil
+		}
+	}
+
+	if utilNet.IsValidIpv4(host) || utilNet.IsValidIpv6(host) {
+		return host, []string{host}, nil
+	}
+
+	if useCache {
+		h := r.cache.Get(host)
+		if h != nil {
+			addrs, err = h.ReturnAddrs()
+			if err == nil {
+				return r.cachedCanonical(host), addrs, nil
+			} else if definitive(err) {
+				return "", nil, e.Forward(err)
+			}
+		}
+	}
+
+	key := "addrs " + host
+	if config != nil {
+		key += " " + strings.Join(config.Servers, ",") + " " + config.Port
+	}
+	for {
+		v, err, shared := r.flight.do(ctx, key, func() (interface{}, error) {
+			return r.resolveDNS(ctx, host, config)
+		})
+		if shared && isCtxErr(err) && !ctxDone(ctx) {
+			// The first caller gave up, try again.
+			continue
+		}
+		if err != nil {
+			return "", nil, e.Forward(err)
+		}
+		res := v.(*hostAddrs)
+		return res.canonical, res.addrs, nil
+	}
+}
+
+// resolveDNS asks the servers in config for the addresses of host and
+// caches the result. Like glibc does, a name that isn't fully qualified is
+// tried with the domains of the search list, before the name alone if it
+// has less than ndots dots, and after it otherwise.
+func (r *Resolver) resolveDNS(ctx context.Context, host string, config *dns.ClientConfig) (res *hostAddrs, err error) {
+	var ttl, negTTL time.Duration
+	defer func() {
+		if ctxDone(ctx) {
+			return
+		}
+		if res == nil && negTTL > 0 {
+			putNegativeTTL(r.cache, host, Kind(err), negTTL)
+			return
+		} else if res == nil {
+			putNegative(r.cache, host, Kind(err))
+			return
+		}
+		putAddrsTTL(r.cache, host, res.addrs, ttl)
+	}()
+
+	err = e.New(ErrCantResolve)
+	for _, name := range r.configFor(config).NameList(host) {
+		var t time.Duration
+		res, ttl, t, err = r.resolveName(ctx, name, config)
+		if err == nil {
+			return res, nil
+		}
+		if t > 0 && (negTTL == 0 || t < negTTL) {
+			negTTL = t
+		}
+		if !cantResolve(err) {
+			break
+		}
+	}
+	return nil, e.Forward(err)
+}
+
+// resolveName asks the servers in config for the addresses of the fully
+// qualified name, following the CNAME chains, and caches the chains. ttl
+// is the time of life of the addresses and negTTL the negative TTL if
+// there are no addresses.
+func (r *Resolver) resolveName(ctx context.Context, name string, config *dns.ClientConfig) (res *hostAddrs, ttl, negTTL time.Duration, err error) {
+	var chains [2]*chain
+	defer func() {
+		if ctxDone(ctx) {
+			return
+		}
+		for _, c := range chains {
+			if c != nil {
+				r.putChain(c)
+			}
+		}
+	}()
+
+	// Ask A and AAAA at the same time.
+	var wg sync.WaitGroup
+	var errs [2]error
+	for i, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		wg.Add(1)
+		go func(i int, qtype uint16) {
+			defer wg.Done()
+			chains[i], errs[i] = r.queryChain(ctx, config, name, qtype)
+		}(i, qtype)
+	}
+	wg.Wait()
+
+	if ctxDone(ctx) {
+		return nil, 0, 0, ctxErr(ctx, nil)
+	}
+
+	canonical := strings.TrimSuffix(name, ".")
+	addrs := make([]string, 0, 10)
+	rrs := make([]dns.RR, 0, 10)
+	// The chain of the A query sets the canonical name.
+	for i := len(chains) - 1; i >= 0; i-- {
+		c := chains[i]
+		if c == nil || c.resp.Rcode != dns.RcodeSuccess {
+			continue
+		}
+		canonical = strings.TrimSuffix(c.name, ".")
+		rrs = append(rrs, c.cnames...)
+		for _, a := range c.rrs {
+			switch addr := a.(type) {
+			case *dns.A:
+				addrs = append(addrs, addr.A.String())
+				rrs = append(rrs, a)
+			case *dns.AAAA:
+				addrs = append(addrs, addr.AAAA.String())
+				rrs = append(rrs, a)
+			}
+		}
+	}
+	if len(addrs) == 0 {
+		for _, c := range chains {
+			if c == nil || (c.resp.Rcode != dns.RcodeSuccess && c.resp.Rcode != dns.RcodeNameError) {
+				continue
+			}
+			if t, ok := negativeTTL(c.resp.Msg); ok && (negTTL == 0 || t < negTTL) {
+				negTTL = t
+			}
+		}
+		for _, err := range errs {
+			if err != nil {
+				return nil, 0, negTTL, e.Forward(err)
+			}
+		}
+		// The name exists if one of the queries says so, and the failures
+		// hide the answer.
+		err = negativeErr(ErrNXDomain)
+		for _, c := range chains {
+			switch c.resp.Rcode {
+			case dns.RcodeNameError:
+			case dns.RcodeSuccess:
+				if definitive(err) {
+					err = negativeErr(ErrNoData)
+				}
+			default:
+				err = rcodeErr(c.resp.Rcode)
+			}
+		}
+		return nil, 0, negTTL, e.Forward(err)
+	}
+
+	ttl, _ = minTTL(rrs)
+	return &hostAddrs{canonical: canonical, addrs: sortAddrs(addrs)}, ttl, 0, nil
+}
+
+// refresh resolves key again, without the cache, to update its entry. key
+// is an address of a ptr query, a host name or a record key.
+func (r *Resolver) refresh(key string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(r.config().Timeout)*time.Second+MulticastTimeout)
+	defer cancel()
+	var err error
+	if name, qtype, ok := parseRecordKey(key); ok {
+		_, err, _ = r.flight.do(ctx, "records "+key, func() (interface{}, error) {
+			return r.resolveRecords(ctx, name, qtype)
+		})
+	} else if utilNet.IsValidIpv4(key) || utilNet.IsValidIpv6(key) {
+		_, err, _ = r.flight.do(ctx, "ptr "+key, func() (interface{}, error) {
+			return r.resolvePtr(ctx, key)
+		})
+	} else if isService(key) {
+		_, err, _ = r.flight.do(ctx, "service "+key, func() (interface{}, error) {
+			return r.browseService(ctx, key)
+		})
+	} else {
+		_, _, err = r.lookupHost(ctx, key, false, nil)
+	}
+	return e.Forward(err)
+}
+
+// putNegative caches err, the error of resp, for the negative TTL of resp
+// if it has one.
+func (r *Resolver) putNegative(key string, err error, resp *dns.Msg) {
+	if definitive(err) {
+		if ttl, ok := negativeTTL(resp); ok {
+			putNegativeTTL(r.cache, key, Kind(err), ttl)
+			return
+		}
+	}
+	putNegative(r.cache, key, Kind(err))
+}
+
+// Exchange sends m to the resolver's upstream servers, in order, until one
+// answers. Truncated UDP responses are retried over TCP. The response tells
+// which server and transport answered.
+func (r *Resolver) Exchange(ctx context.Context, m *dns.Msg) (*Response, error) {
+	if m == nil || len(m.Question) == 0 {
+		return nil, e.New("invalid message")
+	}
+	resp, err := r.exchange(ctx, nil, m)
+	if err != nil {
+		return nil, e.Forward(err)
+	}
+	return resp, nil
+}
+
+// query asks the upstream servers for config, in order, until one answers.
+// A nil config is the resolver's configuration.
+func (r *Resolver) query(ctx context.Context, config *dns.ClientConfig, name string, qtype uint16) (*Response, error) {
+	return r.exchange(ctx, config, r.question(name, qtype))
+}
+
+// question creates the query message, with EDNS0 and the DO bit if they
+// are enabled.
+func (r *Resolver) question(name string, qtype uint16) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetQuestion(name, qtype)
+	if size := r.edns0(); size > 0 {
+		m.SetEdns0(size, r.dnssec)
+	}
+	return m
+}
+
+// exchange sends m to the upstream servers for config, in the order of the
+// resolver's strategy, until one answers. The servers are tried
+// config.Attempts times. A server failure or a refused query is returned
+// only if no server answered better.
+func (r *Resolver) exchange(ctx context.Context, config *dns.ClientConfig, m *dns.Msg) (resp *Response, err error) {
+	upstreams := r.order(r.upstreamsFor(config))
+	attempts := r.configFor(config).Attempts
+	if attempts <= 0 {
+		attempts = 1
+	}
+	var last *Response
+	err = e.New("no servers")
+	for i := 0; i < attempts; i++ {
+		if r.strategy == Parallel {
+			resp, err = r.race(ctx, upstreams, m)
+		} else {
+			resp, err = r.sequential(ctx, upstreams, m)
+		}
+		if resp != nil {
+			last = resp
+		}
+		if err == nil && answered(resp) {
+			return resp, nil
+		}
+		if ctxDone(ctx) {
+			return nil, ctxErr(ctx, err)
+		}
+	}
+	if last != nil {
+		return last, nil
+	}
+	return nil, e.Forward(err)
+}
+
+// sequential tries the upstreams one by one. It returns the first answer,
+// or the last failed response or error.
+func (r *Resolver) sequential(ctx context.Context, upstreams []*Upstream, m *dns.Msg) (last *Response, err error) {
+	err = e.New("no servers")
+	for _, u := range upstreams {
+		resp, rerr := r.try(ctx, u, m)
+		if rerr != nil {
+			err = rerr
+			if ctxDone(ctx) {
+				return nil, e.Forward(err)
+			}
+			continue
+		}
+		if answered(resp) {
+			return resp, nil
+		}
+		last, err = resp, nil
+	}
+	return last, err
+}
+
+// try sends m to u and records the result in the server's health.
+func (r *Resolver) try(ctx context.Context, u *Upstream, m *dns.Msg) (*Response, error) {
+	q := m.Question[0]
+	resp, err := u.exchange(ctx, r, m)
+	if err != nil {
+		log.DebugLevel().Tag("dns").Printf("Lookup %v %v at %v fail: %v", q.Name, dns.TypeToString[q.Qtype], u, err)
+		if !ctxDone(ctx) {
+			r.health.failure(u.String())
+		}
+		return nil, e.Forward(err)
+	}
+	log.DebugLevel().Tag("dns").Printf("Lookup %v %v answered by %v over %v in %v", q.Name, dns.TypeToString[q.Qtype], resp.Server, resp.Net, resp.Rtt)
+	if !answered(resp) {
+		r.health.failure(u.String())
+	} else {
+		r.health.success(u.String(), resp.Rtt)
+	}
+	return resp, nil
+}
+
+// Resolve simple resolver one host name to one ip
+func (r *Resolver) Resolve(h string) (out string, err error) {
+	return r.ResolveContext(context.Background(), h)
+}
+
+// ResolveContext is like Resolve but the lookup is bounded by ctx.
+func (r *Resolver) ResolveContext(ctx context.Context, h string) (out string, err error) {
+	start := time.Now()
+	defer func() {
+		log.DebugLevel().Tag("dns").Printf("Resolve %v took: %v", h, time.Since(start))
+	}()
+
+	host, port, err := utilNet.SplitHostPort(h)
+	if err != nil && !e.Equal(err, utilNet.ErrCantFindPort) {
+		return "", e.Forward(err)
+	}
+
+	addrs, err := r.LookupHostContext(ctx, host)
+	if err != nil {
+		return "", e.Forward(err)
+	}
+	if len(addrs) == 0 {
+		return "", e.New(ErrHostNotResolved)
+	}
+
+	if strings.Contains(addrs[0], ":") {
+		out = "[" + addrs[0] + "]"
+	} else {
+		out = addrs[0]
+	}
+	if port != "" {
+		out += ":" + port
+	}
+	return
+}
+
+// ResolveUrl replaces the host name with the ip address. Supports ipv4 and ipv6.
+// If use in the place of host a path or a scheme for sockets, file or unix,
+// ResolveUrl will only copy the url.
+func (r *Resolver) ResolveUrl(url *url.URL) (*url.URL, error) {
+	return r.ResolveUrlContext(context.Background(), url)
+}
+
+// ResolveUrlContext is like ResolveUrl but the lookup is bounded by ctx.
+func (r *Resolver) ResolveUrlContext(ctx context.Context, url *url.URL) (*url.URL, error) {
+	if url.Scheme == "file" || url.Scheme == "socket" || url.Scheme == "unix" {
+		return utilUrl.Copy(url), nil
+	}
+	if len(url.Host) > 0 && url.Host[0] == '/' {
+		return utilUrl.Copy(url), nil
+	}
+	if len(url.Host) >= 3 && url.Host[1] == ':' && url.Host[2] == '/' {
+		return utilUrl.Copy(url), nil
+	}
+
+	mysqlNotation := regExpResolveUrl.FindAllString(url.Host, 1)
+	if len(mysqlNotation) >= 1 {
+		return utilUrl.Copy(url), nil
+	}
+
+	out := utilUrl.Copy(url)
+
+	host, err := r.ResolveContext(ctx, url.Host)
+	if err != nil {
+		return nil, e.Forward(err)
+	}
+	out.Host = host
+	return out, nil
+}
@@ -0,0 +1,80 @@
+// Copyright 2015 Felipe A. Cavani. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dns
+
+import (
+	"testing"
+	"time"
+
+	"github.com/fcavani/e"
+)
+
+func TestNewResolver(t *testing.T) {
+	r, err := NewResolver(
+		WithServers("127.0.0.1", "::1"),
+		WithPort("5353"),
+		WithAttempts(2),
+		WithTimeout(1),
+		WithDialTimeout(time.Second),
+	)
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+	defer r.Close()
+	if len(r.config().Servers) != 2 || r.config().Servers[0] != "127.0.0.1" {
+		t.Fatal("wrong servers", r.config().Servers)
+	}
+	if r.config().Port != "5353" || r.config().Attempts != 2 || r.config().Timeout != 1 {
+		t.Fatal("wrong config", r.config())
+	}
+	c := r.client()
+	if c.DialTimeout != time.Second || c.ReadTimeout != ReadTimeout {
+		t.Fatal("wrong timeouts")
+	}
+
+	_, err = NewResolver(WithServers())
+	if err == nil {
+		t.Fatal("no servers must fail")
+	}
+	_, err = NewResolver(WithConfigFile("/does/not/exist"))
+	if err == nil {
+		t.Fatal("missing configuration file must fail")
+	}
+}
+
+func TestResolverIsolation(t *testing.T) {
+	c := NewCache(NewMem(), DefaultExpire, Sleep)
+	defer c.Close()
+	c.PutAddrs("foo.example", []string{"192.0.2.1"})
+
+	r1, err := NewResolver(WithCache(c))
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+	defer r1.Close()
+	r2, err := NewResolver()
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+	defer r2.Close()
+
+	addrs, err := r1.LookupHost("foo.example")
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+	if len(addrs) != 1 || addrs[0] != "192.0.2.1" {
+		t.Fatal("wrong addresses", addrs)
+	}
+	if r2.cache.Get("foo.example") != nil {
+		t.Fatal("caches are shared")
+	}
+	addrs, err = r2.LookupHost("localhost")
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+	if len(addrs) != 2 {
+		t.Fatal("wrong addresses", addrs)
+	}
+}
@@ -0,0 +1,103 @@
+// Copyright 2015 Felipe A. Cavani. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dns
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/fcavani/e"
+	"github.com/miekg/dns"
+)
+
+func TestSearch(t *testing.T) {
+	zone := map[string]string{
+		"db.corp.example.":     "192.0.2.1",
+		"web.example.net.":     "192.0.2.2",
+		"x.y.z.":               "192.0.2.3",
+		"x.y.z.corp.example.":  "192.0.2.4",
+		"svc.ns.corp.example.": "192.0.2.5",
+		"svc.ns.":              "192.0.2.6",
+	}
+	var lck sync.Mutex
+	var queries []string
+	addr, shutdown := startServer(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		q := req.Question[0]
+		m := new(dns.Msg)
+		m.SetReply(req)
+		if q.Qtype == dns.TypeA {
+			lck.Lock()
+			queries = append(queries, q.Name)
+			lck.Unlock()
+			if a, ok := zone[q.Name]; ok {
+				rr, _ := dns.NewRR(q.Name + " 60 IN A " + a)
+				m.Answer = append(m.Answer, rr)
+			} else {
+				m.Rcode = dns.RcodeNameError
+			}
+		}
+		w.WriteMsg(m)
+	})
+	defer shutdown()
+
+	dir, err := ioutil.TempDir("", "search")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	conf := filepath.Join(dir, "resolv.conf")
+	err = ioutil.WriteFile(conf, []byte("nameserver 127.0.0.1\nsearch corp.example example.net\noptions ndots:2\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	host, port, _ := net.SplitHostPort(addr)
+	r, err := NewResolver(WithConfigFile(conf), WithServers(host), WithPort(port))
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+	defer r.Close()
+
+	tests := []struct {
+		host      string
+		canonical string
+		addr      string
+		queries   []string
+	}{
+		{"db", "db.corp.example", "192.0.2.1", []string{"db.corp.example."}},
+		{"web", "web.example.net", "192.0.2.2", []string{"web.corp.example.", "web.example.net."}},
+		// Enough dots, the name alone comes first.
+		{"x.y.z", "x.y.z", "192.0.2.3", []string{"x.y.z."}},
+		{"svc.ns", "svc.ns.corp.example", "192.0.2.5", []string{"svc.ns.corp.example."}},
+		{"nope", "", "", []string{"nope.corp.example.", "nope.example.net.", "nope."}},
+		// Fully qualified, no search.
+		{"db.", "", "", []string{"db."}},
+	}
+	for _, test := range tests {
+		lck.Lock()
+		queries = nil
+		lck.Unlock()
+		canonical, addrs, err := r.queryDNS(context.Background(), test.host, false, nil)
+		if test.addr == "" && !e.Equal(err, ErrCantResolve) {
+			t.Fatal(test.host, "wrong error", err)
+		} else if test.addr != "" && err != nil {
+			t.Fatal(test.host, e.Trace(e.Forward(err)))
+		}
+		if test.addr != "" && (canonical != test.canonical || len(addrs) != 1 || addrs[0] != test.addr) {
+			t.Fatal(test.host, "wrong answer", canonical, addrs)
+		}
+		lck.Lock()
+		if !reflect.DeepEqual(queries, test.queries) {
+			t.Fatal(test.host, "wrong queries", queries)
+		}
+		lck.Unlock()
+	}
+}
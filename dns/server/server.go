@@ -0,0 +1,499 @@
+// Copyright 2015 Felipe A. Cavani. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package server is a small caching DNS forwarder. It answers from a static
+// zone, then from the resolver's hosts file and cache, and forwards the
+// other queries through the resolver.
+//
+// The resolver must not use the server as its upstream, the queries would
+// loop.
+package server
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fcavani/e"
+	utilDns "github.com/fcavani/net/dns"
+	log "github.com/fcavani/slog"
+	"github.com/miekg/dns"
+)
+
+// Addr is the default address of the server.
+var Addr = ":53"
+
+// TTL is the default TTL of the answers from the hosts file, and the
+// maximum TTL of the forwarded answers.
+var TTL = time.Minute
+
+// QueryTimeout is the maximum time spent answering a query.
+var QueryTimeout = 10 * time.Second
+
+// Maximum length of the CNAME chains followed in the static zone.
+const maxCNAME = 8
+
+// Server serves DNS over UDP and TCP on the same address.
+type Server struct {
+	addr     string
+	resolver *utilDns.Resolver
+	zone     map[string][]dns.RR
+	ttl      time.Duration
+
+	lck     sync.Mutex
+	servers []*dns.Server
+	bound   string
+}
+
+// Option configures a Server in New.
+type Option func(s *Server) error
+
+// WithAddr sets the address of the server. If not set Addr is used.
+func WithAddr(addr string) Option {
+	return func(s *Server) error {
+		if addr == "" {
+			return e.New("invalid address")
+		}
+		s.addr = addr
+		return nil
+	}
+}
+
+// WithResolver sets the resolver used to forward the queries. If not set
+// the package's default resolver is used.
+func WithResolver(r *utilDns.Resolver) Option {
+	return func(s *Server) error {
+		if r == nil {
+			return e.New("invalid resolver")
+		}
+		s.resolver = r
+		return nil
+	}
+}
+
+// WithZone adds the records, in the zone file format, to the static zone.
+// The names below a SOA record of the zone that aren't in the zone don't
+// exist.
+func WithZone(records ...string) Option {
+	return func(s *Server) error {
+		for _, record := range records {
+			rr, err := dns.NewRR(record)
+			if err != nil {
+				return e.Push(e.New(err), "invalid record")
+			}
+			if rr == nil {
+				continue
+			}
+			name := strings.ToLower(rr.Header().Name)
+			s.zone[name] = append(s.zone[name], rr)
+		}
+		return nil
+	}
+}
+
+// WithTTL sets the TTL used instead of TTL.
+func WithTTL(ttl time.Duration) Option {
+	return func(s *Server) error {
+		if ttl <= 0 {
+			return e.New("invalid ttl")
+		}
+		s.ttl = ttl
+		return nil
+	}
+}
+
+// New creates a server. Start starts it.
+func New(opts ...Option) (*Server, error) {
+	s := &Server{
+		addr: Addr,
+		zone: make(map[string][]dns.RR),
+		ttl:  TTL,
+	}
+	for _, opt := range opts {
+		err := opt(s)
+		if err != nil {
+			return nil, e.Forward(err)
+		}
+	}
+	if s.resolver == nil {
+		s.resolver = utilDns.DefaultResolver()
+	}
+	return s, nil
+}
+
+// Start listens on the server's address and serves the queries in the
+// background.
+func (s *Server) Start() error {
+	s.lck.Lock()
+	defer s.lck.Unlock()
+	if s.servers != nil {
+		return e.New("server already started")
+	}
+	pc, err := net.ListenPacket("udp", s.addr)
+	if err != nil {
+		return e.New(err)
+	}
+	// The same port for tcp if the address has the port zero.
+	l, err := net.Listen("tcp", pc.LocalAddr().String())
+	if err != nil {
+		pc.Close()
+		return e.New(err)
+	}
+	s.bound = pc.LocalAddr().String()
+	for _, srv := range []*dns.Server{{PacketConn: pc, Handler: s}, {Listener: l, Handler: s}} {
+		started := make(chan struct{})
+		srv.NotifyStartedFunc = func() { close(started) }
+		go func(srv *dns.Server) {
+			err := srv.ActivateAndServe()
+			if err != nil {
+				log.ErrorLevel().Tag("dns", "server").Println("serve failed:", err)
+			}
+		}(srv)
+		<-started
+		s.servers = append(s.servers, srv)
+	}
+	log.InfoLevel().Tag("dns", "server").Println("Serving on", s.bound)
+	return nil
+}
+
+// Addr returns the address the server listens on.
+func (s *Server) Addr() string {
+	s.lck.Lock()
+	defer s.lck.Unlock()
+	return s.bound
+}
+
+// Close stops the server.
+func (s *Server) Close() error {
+	s.lck.Lock()
+	defer s.lck.Unlock()
+	var err error
+	for _, srv := range s.servers {
+		if serr := srv.Shutdown(); serr != nil {
+			err = e.New(serr)
+		}
+	}
+	s.servers = nil
+	return err
+}
+
+// ServeDNS answers a query and logs it with the tags dns and server.
+func (s *Server) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
+	start := time.Now()
+	m := new(dns.Msg)
+	m.SetReply(req)
+	m.RecursionAvailable = true
+
+	source := "invalid"
+	if len(req.Question) != 1 {
+		m.Rcode = dns.RcodeFormatError
+	} else if q := req.Question[0]; q.Qclass != dns.ClassINET {
+		m.Rcode = dns.RcodeNotImplemented
+	} else {
+		ctx, cancel := context.WithTimeout(context.Background(), QueryTimeout)
+		source = s.answer(ctx, m, q)
+		cancel()
+	}
+
+	if opt := req.IsEdns0(); opt != nil {
+		m.SetEdns0(utilDns.UDPSize, false)
+	}
+	if _, udp := w.RemoteAddr().(*net.UDPAddr); udp {
+		size := dns.MinMsgSize
+		if opt := req.IsEdns0(); opt != nil && int(opt.UDPSize()) > size {
+			size = int(opt.UDPSize())
+		}
+		if m.Len() > size {
+			m.Truncated = true
+			m.Answer, m.Ns = nil, nil
+		}
+	}
+	err := w.WriteMsg(m)
+
+	q := dns.Question{Name: "-"}
+	if len(req.Question) > 0 {
+		q = req.Question[0]
+	}
+	log.InfoLevel().Tag("dns", "server").Printf("Query %v %v from %v: %v with %v answers from the %v in %v", q.Name, dns.TypeToString[q.Qtype], w.RemoteAddr(), dns.RcodeToString[m.Rcode], len(m.Answer), source, time.Since(start))
+	if err != nil {
+		log.ErrorLevel().Tag("dns", "server").Printf("Response to %v failed: %v", w.RemoteAddr(), err)
+	}
+}
+
+// answer fills m with the answer to q and returns where the answer came
+// from.
+func (s *Server) answer(ctx context.Context, m *dns.Msg, q dns.Question) string {
+	target, ok := s.answerZone(m, q)
+	if ok {
+		m.Authoritative = true
+		return "zone"
+	}
+	source := "resolver"
+	if target != "" {
+		// The CNAME chain left the zone.
+		q.Name = target
+		source = "zone and resolver"
+	}
+	var err error
+	switch q.Qtype {
+	case dns.TypeA, dns.TypeAAAA:
+		err = s.answerHost(ctx, m, q)
+	case dns.TypePTR:
+		if ip := reverse(q.Name); ip != nil {
+			err = s.answerPtr(ctx, m, q, ip)
+			break
+		}
+		fallthrough
+	default:
+		err = s.answerRecords(ctx, m, q)
+	}
+	m.Rcode = rcode(err)
+	if err != nil && m.Rcode == dns.RcodeServerFailure {
+		log.DebugLevel().Tag("dns", "server").Printf("Lookup %v %v failed: %v", q.Name, dns.TypeToString[q.Qtype], err)
+	}
+	if name, ok := negative(m, q); ok {
+		s.answerSOA(ctx, m, name)
+	}
+	return source
+}
+
+// negative returns true if m is a NXDOMAIN or NODATA answer to q, with the
+// name that doesn't exist or has no records, the end of the CNAME chain.
+func negative(m *dns.Msg, q dns.Question) (name string, ok bool) {
+	if q.Qtype == dns.TypeANY || (m.Rcode != dns.RcodeSuccess && m.Rcode != dns.RcodeNameError) {
+		return "", false
+	}
+	name = q.Name
+	for _, rr := range m.Answer {
+		if rr.Header().Rrtype == q.Qtype {
+			return "", false
+		}
+		if cname, ok := rr.(*dns.CNAME); ok {
+			name = cname.Target
+		}
+	}
+	return name, true
+}
+
+// answerSOA puts the SOA record of the zone of name in the authority
+// section of a forwarded negative answer, so the clients can cache it (RFC
+// 2308 section 3). Its TTL is the negative TTL, at most the server's TTL.
+func (s *Server) answerSOA(ctx context.Context, m *dns.Msg, name string) {
+	for name = dns.Fqdn(name); ; {
+		rrs, err := s.resolver.LookupRecords(ctx, name, dns.TypeSOA)
+		if err == nil {
+			for _, rr := range rrs {
+				soa, ok := rr.(*dns.SOA)
+				if !ok {
+					continue
+				}
+				soa = dns.Copy(soa).(*dns.SOA)
+				if soa.Minttl < soa.Hdr.Ttl {
+					soa.Hdr.Ttl = soa.Minttl
+				}
+				if ttl := uint32(s.ttl / time.Second); soa.Hdr.Ttl > ttl {
+					soa.Hdr.Ttl = ttl
+				}
+				m.Ns = append(m.Ns, soa)
+				return
+			}
+			return
+		}
+		if kind := utilDns.Kind(err); (kind != utilDns.ErrNXDomain && kind != utilDns.ErrNoData) || name == "." {
+			return
+		}
+		i, _ := dns.NextLabel(name, 0)
+		name = name[i:]
+		if name == "" {
+			name = "."
+		}
+	}
+}
+
+// answerZone answers from the static zone, following the CNAME chains. It
+// returns false if the name isn't in the zone, with the target of the
+// chain if it left the zone.
+func (s *Server) answerZone(m *dns.Msg, q dns.Question) (target string, ok bool) {
+	name := q.Name
+	for i := 0; i <= maxCNAME; i++ {
+		rrs, found := s.zone[strings.ToLower(name)]
+		if !found {
+			if soa := s.soa(name); soa != nil {
+				m.Ns = append(m.Ns, soa)
+				m.Rcode = dns.RcodeNameError
+				return "", true
+			}
+			if i > 0 {
+				return name, false
+			}
+			return "", false
+		}
+		var cname *dns.CNAME
+		for _, rr := range rrs {
+			if rr.Header().Rrtype == q.Qtype || q.Qtype == dns.TypeANY {
+				m.Answer = append(m.Answer, dns.Copy(rr))
+			} else if c, isCNAME := rr.(*dns.CNAME); isCNAME {
+				cname = c
+			}
+		}
+		if cname == nil || q.Qtype == dns.TypeCNAME {
+			if len(m.Answer) == 0 {
+				if soa := s.soa(name); soa != nil {
+					m.Ns = append(m.Ns, soa)
+				}
+			}
+			return "", true
+		}
+		m.Answer = append(m.Answer, dns.Copy(cname))
+		name = cname.Target
+	}
+	m.Rcode = dns.RcodeServerFailure
+	return "", true
+}
+
+// soa returns the SOA record of the closest zone of name in the static
+// zone.
+func (s *Server) soa(name string) dns.RR {
+	var soa dns.RR
+	for zone, rrs := range s.zone {
+		if !dns.IsSubDomain(zone, name) || (soa != nil && len(zone) <= len(soa.Header().Name)) {
+			continue
+		}
+		for _, rr := range rrs {
+			if rr.Header().Rrtype == dns.TypeSOA {
+				soa = rr
+			}
+		}
+	}
+	return soa
+}
+
+// header returns the header of a record of name and type qtype with the
+// server's TTL.
+func (s *Server) header(name string, qtype uint16) dns.RR_Header {
+	return dns.RR_Header{Name: name, Rrtype: qtype, Class: dns.ClassINET, Ttl: uint32(s.ttl / time.Second)}
+}
+
+// answerHost answers the A and AAAA queries with the resolver's lookup, that
+// looks in the hosts file and the cache first. The name is fully qualified,
+// the search list isn't used. The canonical name of an alias is answered as
+// a CNAME record. The TTL is the time left of the cached addresses, at most
+// the server's TTL.
+func (s *Server) answerHost(ctx context.Context, m *dns.Msg, q dns.Question) error {
+	canonical, addrs, left, err := s.resolver.LookupCanonicalTTL(ctx, dns.Fqdn(q.Name))
+	if err != nil {
+		return e.Forward(err)
+	}
+	ttl := s.ttl
+	if left > 0 && left < ttl {
+		// Rounded up, zero would be no caching at all.
+		ttl = (left + time.Second - 1).Truncate(time.Second)
+	}
+	header := func(name string, qtype uint16) dns.RR_Header {
+		h := s.header(name, qtype)
+		h.Ttl = uint32(ttl / time.Second)
+		return h
+	}
+	name := q.Name
+	if canonical = dns.Fqdn(canonical); canonical != "." && !strings.EqualFold(canonical, name) {
+		m.Answer = append(m.Answer, &dns.CNAME{Hdr: header(name, dns.TypeCNAME), Target: canonical})
+		name = canonical
+	}
+	for _, addr := range addrs {
+		ip := net.ParseIP(addr)
+		switch {
+		case ip == nil:
+		case q.Qtype == dns.TypeA && ip.To4() != nil:
+			m.Answer = append(m.Answer, &dns.A{Hdr: header(name, dns.TypeA), A: ip.To4()})
+		case q.Qtype == dns.TypeAAAA && ip.To4() == nil:
+			m.Answer = append(m.Answer, &dns.AAAA{Hdr: header(name, dns.TypeAAAA), AAAA: ip})
+		}
+	}
+	return nil
+}
+
+// answerPtr answers the reverse queries with the resolver's lookup, that
+// looks in the hosts file and the cache first.
+func (s *Server) answerPtr(ctx context.Context, m *dns.Msg, q dns.Question, ip net.IP) error {
+	host, err := s.resolver.LookupIpContext(ctx, ip.String())
+	if err != nil {
+		return e.Forward(err)
+	}
+	m.Answer = append(m.Answer, &dns.PTR{Hdr: s.header(q.Name, dns.TypePTR), Ptr: dns.Fqdn(host)})
+	return nil
+}
+
+// answerRecords forwards the query through the resolver's cached record
+// lookup. If the records are of other name the name is an alias of it.
+func (s *Server) answerRecords(ctx context.Context, m *dns.Msg, q dns.Question) error {
+	rrs, err := s.resolver.LookupRecords(ctx, q.Name, q.Qtype)
+	if err != nil {
+		return e.Forward(err)
+	}
+	ttl := uint32(s.ttl / time.Second)
+	for i, rr := range rrs {
+		rr = dns.Copy(rr)
+		h := rr.Header()
+		if i == 0 && !strings.EqualFold(h.Name, q.Name) {
+			m.Answer = append(m.Answer, &dns.CNAME{Hdr: s.header(q.Name, dns.TypeCNAME), Target: h.Name})
+		}
+		if h.Ttl > ttl {
+			h.Ttl = ttl
+		}
+		m.Answer = append(m.Answer, rr)
+	}
+	return nil
+}
+
+// rcode returns the response code of the error of a lookup.
+func rcode(err error) int {
+	if err == nil {
+		return dns.RcodeSuccess
+	}
+	switch utilDns.Kind(err) {
+	case utilDns.ErrNoData:
+		return dns.RcodeSuccess
+	case utilDns.ErrNXDomain:
+		return dns.RcodeNameError
+	case utilDns.ErrRefused:
+		return dns.RcodeRefused
+	}
+	return dns.RcodeServerFailure
+}
+
+// reverse returns the ip address of a name in in-addr.arpa or ip6.arpa,
+// nil if name isn't one.
+func reverse(name string) net.IP {
+	name = strings.ToLower(dns.Fqdn(name))
+	switch {
+	case strings.HasSuffix(name, ".in-addr.arpa."):
+		labels := strings.Split(strings.TrimSuffix(name, ".in-addr.arpa."), ".")
+		if len(labels) != net.IPv4len {
+			return nil
+		}
+		for i, j := 0, len(labels)-1; i < j; i, j = i+1, j-1 {
+			labels[i], labels[j] = labels[j], labels[i]
+		}
+		return net.ParseIP(strings.Join(labels, ".")).To4()
+	case strings.HasSuffix(name, ".ip6.arpa."):
+		nibbles := strings.Split(strings.TrimSuffix(name, ".ip6.arpa."), ".")
+		if len(nibbles) != 2*net.IPv6len {
+			return nil
+		}
+		var b strings.Builder
+		for i := len(nibbles) - 1; i >= 0; i-- {
+			if len(nibbles[i]) != 1 {
+				return nil
+			}
+			b.WriteString(nibbles[i])
+			if i%4 == 0 && i > 0 {
+				b.WriteString(":")
+			}
+		}
+		return net.ParseIP(b.String())
+	}
+	return nil
+}
@@ -0,0 +1,171 @@
+// Copyright 2015 Felipe A. Cavani. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fcavani/e"
+	utilDns "github.com/fcavani/net/dns"
+	"github.com/fcavani/net/dns/dnstest"
+	"github.com/miekg/dns"
+)
+
+func TestServer(t *testing.T) {
+	up, err := dnstest.NewServer(
+		"example.com. 300 IN SOA ns.example.com. admin.example.com. 1 7200 900 1209600 120",
+		"www.example.com. 300 IN A 192.0.2.1",
+		"short.example.com. 5 IN A 192.0.2.6",
+		"alias.example.com. 300 IN CNAME www.example.com.",
+		"example.com. 300 IN MX 10 mail.example.com.",
+		"foo.com.corp.example. 300 IN A 192.0.2.5",
+	)
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+	defer up.Close()
+
+	dir, err := ioutil.TempDir("", "server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	hosts := filepath.Join(dir, "hosts")
+	err = ioutil.WriteFile(hosts, []byte("192.0.2.50 printer.home printer\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The search list doesn't apply to the queries, they are fully
+	// qualified.
+	cfg := &dns.ClientConfig{Search: []string{"corp.example."}, Ndots: 1, Port: "53", Attempts: 1, Timeout: 2}
+	r, err := utilDns.NewResolver(utilDns.WithConfig(cfg), utilDns.WithServers(up.Host()), utilDns.WithPort(up.Port()), utilDns.WithHostsFile(hosts), utilDns.WithBrowser(up))
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+	defer r.Close()
+
+	s, err := New(
+		WithAddr("127.0.0.1:0"),
+		WithResolver(r),
+		WithZone(
+			"lan. 3600 IN SOA ns.lan. admin.lan. 1 7200 900 1209600 60",
+			"router.lan. 3600 IN A 192.168.0.1",
+			"nas.lan. 3600 IN CNAME router.lan.",
+			"out.lan. 3600 IN CNAME www.example.com.",
+		),
+	)
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+	err = s.Start()
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+	defer s.Close()
+
+	tests := []struct {
+		net     string
+		name    string
+		qtype   uint16
+		rcode   int
+		answers int
+		auth    bool
+	}{
+		{"udp", "router.lan.", dns.TypeA, dns.RcodeSuccess, 1, true},
+		{"udp", "nas.lan.", dns.TypeA, dns.RcodeSuccess, 2, true},
+		{"udp", "missing.lan.", dns.TypeA, dns.RcodeNameError, 0, true},
+		{"udp", "out.lan.", dns.TypeA, dns.RcodeSuccess, 2, false},
+		{"udp", "printer.home.", dns.TypeA, dns.RcodeSuccess, 1, false},
+		{"udp", "printer.home.", dns.TypeAAAA, dns.RcodeSuccess, 0, false},
+		{"udp", "50.2.0.192.in-addr.arpa.", dns.TypePTR, dns.RcodeSuccess, 1, false},
+		{"udp", "alias.example.com.", dns.TypeA, dns.RcodeSuccess, 2, false},
+		{"tcp", "example.com.", dns.TypeMX, dns.RcodeSuccess, 1, false},
+		{"tcp", "nx.example.com.", dns.TypeA, dns.RcodeNameError, 0, false},
+		{"udp", "foo.com.", dns.TypeA, dns.RcodeNameError, 0, false},
+	}
+	for _, test := range tests {
+		c := &dns.Client{Net: test.net, Timeout: 2 * time.Second}
+		m := new(dns.Msg)
+		m.SetQuestion(test.name, test.qtype)
+		resp, _, err := c.Exchange(m, s.Addr())
+		if err != nil {
+			t.Fatal(test.name, err)
+		}
+		if resp.Rcode != test.rcode || len(resp.Answer) != test.answers || resp.Authoritative != test.auth {
+			t.Fatal(test.name, "wrong response", resp)
+		}
+		for _, rr := range resp.Answer {
+			// The records from the resolver.
+			if !strings.HasSuffix(rr.Header().Name, ".lan.") && rr.Header().Ttl > 60 {
+				t.Fatal(test.name, "wrong ttl", rr)
+			}
+		}
+	}
+
+	c := new(dns.Client)
+	m := new(dns.Msg)
+
+	// The forwarded negative answers have the SOA record of the zone with
+	// the negative TTL, at most the server's TTL.
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		name := "nx.example.com."
+		if qtype == dns.TypeAAAA {
+			name = "www.example.com."
+		}
+		m.SetQuestion(name, qtype)
+		resp, _, err := c.Exchange(m, s.Addr())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(resp.Answer) != 0 || len(resp.Ns) != 1 || resp.Ns[0].Header().Name != "example.com." || resp.Ns[0].Header().Ttl != 60 {
+			t.Fatal(name, "wrong authority", resp)
+		}
+	}
+
+	// The addresses don't live longer than their records.
+	m.SetQuestion("short.example.com.", dns.TypeA)
+	resp, _, err := c.Exchange(m, s.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Answer) != 1 || resp.Answer[0].Header().Ttl == 0 || resp.Answer[0].Header().Ttl > 5 {
+		t.Fatal("wrong ttl", resp)
+	}
+
+	// The forwarded answers are cached.
+	n := up.Queries()
+	m.SetQuestion("example.com.", dns.TypeMX)
+	resp, _, err = c.Exchange(m, s.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Answer) != 1 || up.Queries() != n {
+		t.Fatal("not cached", resp, up.Queries(), n)
+	}
+}
+
+func TestReverse(t *testing.T) {
+	tests := []struct {
+		name string
+		ip   string
+	}{
+		{"1.2.0.192.in-addr.arpa.", "192.0.2.1"},
+		{"1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa.", "2001:db8::1"},
+		{"2.0.192.in-addr.arpa.", ""},
+		{"example.com.", ""},
+	}
+	for _, test := range tests {
+		ip := reverse(test.name)
+		if (ip == nil && test.ip != "") || (ip != nil && ip.String() != test.ip) {
+			t.Fatal(test.name, "wrong ip", ip)
+		}
+	}
+}
@@ -0,0 +1,44 @@
+// Copyright 2015 Felipe A. Cavani. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dns
+
+import (
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// minTTL returns the minimum TTL of the records, ignoring the OPT
+// pseudo-record, and false if there are no records.
+func minTTL(rrs []dns.RR) (time.Duration, bool) {
+	found := false
+	var ttl uint32
+	for _, rr := range rrs {
+		if _, ok := rr.(*dns.OPT); ok {
+			continue
+		}
+		if !found || rr.Header().Ttl < ttl {
+			ttl = rr.Header().Ttl
+			found = true
+		}
+	}
+	return time.Duration(ttl) * time.Second, found
+}
+
+// negativeTTL returns the negative TTL of a NXDOMAIN or NODATA response,
+// the minimum between the SOA's TTL and the SOA's MINIMUM field (RFC 2308
+// section 5). Returns false if the response has no SOA record.
+func negativeTTL(m *dns.Msg) (time.Duration, bool) {
+	for _, rr := range m.Ns {
+		if soa, ok := rr.(*dns.SOA); ok {
+			ttl := soa.Hdr.Ttl
+			if soa.Minttl < ttl {
+				ttl = soa.Minttl
+			}
+			return time.Duration(ttl) * time.Second, true
+		}
+	}
+	return 0, false
+}
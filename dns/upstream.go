@@ -0,0 +1,252 @@
+// Copyright 2015 Felipe A. Cavani. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dns
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/fcavani/e"
+	log "github.com/fcavani/slog"
+	"github.com/miekg/dns"
+)
+
+// Networks of the upstream servers.
+const (
+	NetUDP = "udp"
+	NetTCP = "tcp"
+	// NetTLS is DNS over TLS, RFC 7858.
+	NetTLS = "tcp-tls"
+)
+
+const ErrPinMismatch = "server's public key doesn't match the pins"
+
+// Upstream is a name server used by the resolver.
+type Upstream struct {
+	// Addr is the address of the server, ip or ip:port. The default port
+	// is 53, or 853 for NetTLS.
+	Addr string
+	// Net is NetUDP, NetTCP, NetTLS or NetHTTPS. The default is NetUDP.
+	Net string
+	// URL is the url of a NetHTTPS server, like
+	// https://dns.example/dns-query.
+	URL string
+	// Method is the HTTP method used with NetHTTPS, GET or POST. The default
+	// is POST.
+	Method string
+	// HTTPClient is the client used with NetHTTPS. If nil a client is
+	// created for the upstream. ServerName, Pins and TLSConfig can't be set
+	// with HTTPClient, configure its transport instead.
+	HTTPClient *http.Client
+	// ServerName is the name used to verify the server's certificate.
+	ServerName string
+	// Pins are base64 encoded SHA-256 digests of the SubjectPublicKeyInfo
+	// of the server's certificates (RFC 7858 section 4.2). If set, one
+	// certificate of the chain must match one pin and the chain isn't
+	// verified against the root CAs.
+	Pins []string
+	// TLSConfig is the base TLS configuration, to set the root CAs or the
+	// client certificates.
+	TLSConfig *tls.Config
+
+	tls *tls.Config
+}
+
+// WithUpstreams makes the resolver ask the upstream servers instead of the
+// servers from the configuration. See WithConfigServers to ask both.
+func WithUpstreams(upstreams ...Upstream) Option {
+	return func(r *Resolver) error {
+		if len(upstreams) == 0 {
+			return e.New("no upstreams")
+		}
+		r.upstreams = make([]*Upstream, 0, len(upstreams))
+		for _, u := range upstreams {
+			u := u
+			err := u.init()
+			if err != nil {
+				return e.Forward(err)
+			}
+			r.upstreams = append(r.upstreams, &u)
+		}
+		return nil
+	}
+}
+
+// WithConfigServers makes the resolver with upstreams ask the servers from
+// the configuration too, in plain UDP after the upstreams, for example to
+// fall back from a DoH upstream. It can't be used with the NetTLS
+// upstreams, their queries would leak in clear text.
+func WithConfigServers(ask bool) Option {
+	return func(r *Resolver) error {
+		r.configServers = ask
+		return nil
+	}
+}
+
+// init validates the upstream and fills the defaults.
+func (u *Upstream) init() error {
+	switch u.Net {
+	case "":
+		u.Net = NetUDP
+	case NetUDP, NetTCP, NetTLS:
+	case NetHTTPS:
+		return e.Forward(u.initHTTPS())
+	default:
+		return e.New("invalid network %v", u.Net)
+	}
+	if u.Addr == "" {
+		return e.New("invalid upstream address")
+	}
+	if _, _, err := net.SplitHostPort(u.Addr); err != nil {
+		port := "53"
+		if u.Net == NetTLS {
+			port = "853"
+		}
+		u.Addr = net.JoinHostPort(u.Addr, port)
+	}
+	if u.Net != NetTLS {
+		return nil
+	}
+	host, _, _ := net.SplitHostPort(u.Addr)
+	return e.Forward(u.initTLS(host))
+}
+
+// initTLS creates the TLS configuration. host is the server name used if
+// ServerName is empty and there are no pins.
+func (u *Upstream) initTLS(host string) error {
+	if u.TLSConfig != nil {
+		u.tls = u.TLSConfig.Clone()
+	} else {
+		u.tls = new(tls.Config)
+	}
+	if u.ServerName != "" {
+		u.tls.ServerName = u.ServerName
+	}
+	if len(u.Pins) > 0 {
+		pins := make(map[string]bool, len(u.Pins))
+		for _, pin := range u.Pins {
+			raw, err := base64.StdEncoding.DecodeString(pin)
+			if err != nil || len(raw) != sha256.Size {
+				return e.New("invalid pin %v", pin)
+			}
+			pins[string(raw)] = true
+		}
+		u.tls.InsecureSkipVerify = true
+		u.tls.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			for _, raw := range rawCerts {
+				cert, err := x509.ParseCertificate(raw)
+				if err != nil {
+					return e.New(err)
+				}
+				sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+				if pins[string(sum[:])] {
+					return nil
+				}
+			}
+			return e.New(ErrPinMismatch)
+		}
+	} else if u.tls.ServerName == "" {
+		u.tls.ServerName = host
+	}
+	return nil
+}
+
+// client returns a client for the upstream based on the resolver's client.
+func (u *Upstream) client(r *Resolver) *dns.Client {
+	c := r.client()
+	c.Net = u.Net
+	c.TLSConfig = u.tls
+	return c
+}
+
+// Response is a DNS response and the server that answered it.
+type Response struct {
+	*dns.Msg
+	// Server is the address of the server, or the url for NetHTTPS.
+	Server string
+	// Net is the transport that carried the response. It is NetTCP for the
+	// truncated UDP responses retried over TCP.
+	Net string
+	// Rtt is the round trip time, including the retry over TCP.
+	Rtt time.Duration
+}
+
+// exchange sends m to the upstream and waits for the response. A truncated
+// UDP response is retried over TCP.
+func (u *Upstream) exchange(ctx context.Context, r *Resolver, m *dns.Msg) (*Response, error) {
+	resp, err := u.exchangeNet(ctx, r, m)
+	if err != nil && Kind(err) == "" && !isCtxErr(err) {
+		return nil, e.Push(err, ErrNetwork)
+	}
+	return resp, e.Forward(err)
+}
+
+func (u *Upstream) exchangeNet(ctx context.Context, r *Resolver, m *dns.Msg) (*Response, error) {
+	c := u.client(r)
+	if u.Net == NetHTTPS {
+		resp, rtt, err := u.exchangeHTTPS(ctx, c, m)
+		if err != nil {
+			return nil, e.Forward(err)
+		}
+		return &Response{Msg: resp, Server: u.URL, Net: NetHTTPS, Rtt: rtt}, nil
+	}
+	resp, rtt, err := exchange(ctx, c, m, u.Addr)
+	if err != nil {
+		return nil, e.Forward(err)
+	}
+	if !resp.Truncated || u.Net != NetUDP {
+		return &Response{Msg: resp, Server: u.Addr, Net: u.Net, Rtt: rtt}, nil
+	}
+	log.DebugLevel().Tag("dns").Printf("Response from %v truncated, retrying over tcp", u)
+	c.Net = NetTCP
+	tresp, trtt, err := exchange(ctx, c, m, u.Addr)
+	if err != nil {
+		return nil, e.Forward(err)
+	}
+	return &Response{Msg: tresp, Server: u.Addr, Net: NetTCP, Rtt: rtt + trtt}, nil
+}
+
+// String returns the network and the address of the upstream.
+func (u *Upstream) String() string {
+	if u.Net == NetHTTPS {
+		return u.URL
+	}
+	return u.Net + "://" + u.Addr
+}
+
+// Pin returns the pin of the certificate, the base64 encoded SHA-256 of its
+// SubjectPublicKeyInfo.
+func Pin(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// upstreamsFor returns the servers to ask. A nil config is the resolver's
+// configuration, whose servers are replaced by the resolver's upstreams,
+// or asked after them with WithConfigServers.
+func (r *Resolver) upstreamsFor(config *dns.ClientConfig) []*Upstream {
+	own := config == nil
+	if own && len(r.upstreams) > 0 && !r.configServers {
+		return r.upstreams
+	}
+	config = r.configFor(config)
+	upstreams := make([]*Upstream, 0, len(r.upstreams)+len(config.Servers))
+	if own {
+		upstreams = append(upstreams, r.upstreams...)
+	}
+	for _, server := range config.Servers {
+		upstreams = append(upstreams, &Upstream{
+			Addr: net.JoinHostPort(server, config.Port),
+			Net:  NetUDP,
+		})
+	}
+	return upstreams
+}
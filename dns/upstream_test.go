@@ -0,0 +1,152 @@
+// Copyright 2015 Felipe A. Cavani. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dns
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/fcavani/e"
+	"github.com/miekg/dns"
+)
+
+// selfSigned creates a certificate for name.
+func selfSigned(t *testing.T, name string) (tls.Certificate, *x509.Certificate) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		DNSNames:              []string{name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, cert
+}
+
+// startTLSServer starts a DNS over TLS server that answers the A queries.
+func startTLSServer(t *testing.T, cert tls.Certificate) (addr string, shutdown func()) {
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	started := make(chan struct{})
+	srv := &dns.Server{
+		Listener: l,
+		Net:      NetTLS,
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+			m := new(dns.Msg)
+			m.SetReply(req)
+			q := req.Question[0]
+			if q.Qtype == dns.TypeA {
+				rr, _ := dns.NewRR(q.Name + " 60 IN A 192.0.2.53")
+				m.Answer = append(m.Answer, rr)
+			}
+			w.WriteMsg(m)
+		}),
+		NotifyStartedFunc: func() { close(started) },
+	}
+	go srv.ActivateAndServe()
+	<-started
+	return l.Addr().String(), func() { srv.Shutdown() }
+}
+
+func TestDNSOverTLS(t *testing.T) {
+	tlsCert, cert := selfSigned(t, "dns.test")
+	addr, shutdown := startTLSServer(t, tlsCert)
+	defer shutdown()
+
+	_, other := selfSigned(t, "other.test")
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+
+	tests := []struct {
+		upstream Upstream
+		fail     bool
+	}{
+		{Upstream{Addr: addr, Net: NetTLS, Pins: []string{Pin(cert)}}, false},
+		{Upstream{Addr: addr, Net: NetTLS, Pins: []string{Pin(other)}}, true},
+		{Upstream{Addr: addr, Net: NetTLS, ServerName: "dns.test", TLSConfig: &tls.Config{RootCAs: roots}}, false},
+		{Upstream{Addr: addr, Net: NetTLS, ServerName: "wrong.test", TLSConfig: &tls.Config{RootCAs: roots}}, true},
+		{Upstream{Addr: addr, Net: NetTLS}, true},
+	}
+	for i, test := range tests {
+		r, err := NewResolver(WithUpstreams(test.upstream), WithReadTimeout(time.Second))
+		if err != nil {
+			t.Fatal(e.Trace(e.Forward(err)))
+		}
+		_, addrs, err := r.queryDNS(context.Background(), "tls.example", false, nil)
+		r.Close()
+		if test.fail && err == nil {
+			t.Fatalf("%v: must fail", i)
+		} else if !test.fail && err != nil {
+			t.Fatalf("%v: %v", i, e.Trace(e.Forward(err)))
+		}
+		if !test.fail && (len(addrs) != 1 || addrs[0] != "192.0.2.53") {
+			t.Fatalf("%v: wrong addresses %v", i, addrs)
+		}
+	}
+}
+
+func TestUpstreamInit(t *testing.T) {
+	u := Upstream{Addr: "192.0.2.1", Net: NetTLS}
+	if err := u.init(); err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+	if u.Addr != "192.0.2.1:853" || u.tls.ServerName != "192.0.2.1" {
+		t.Fatal("wrong defaults", u.Addr, u.tls.ServerName)
+	}
+	u = Upstream{Addr: "::1"}
+	if err := u.init(); err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+	if u.Addr != "[::1]:53" || u.Net != NetUDP {
+		t.Fatal("wrong defaults", u.Addr, u.Net)
+	}
+	u = Upstream{Addr: "192.0.2.1", Net: "sctp"}
+	if err := u.init(); err == nil {
+		t.Fatal("invalid network accepted")
+	}
+	u = Upstream{Addr: "192.0.2.1", Net: NetTLS, Pins: []string{"invalid"}}
+	if err := u.init(); err == nil {
+		t.Fatal("invalid pin accepted")
+	}
+
+	// The queries for the tls upstreams never go in clear text.
+	r, err := NewResolver(WithServers("192.0.2.2"), WithUpstreams(Upstream{Addr: "192.0.2.1", Net: NetTLS}))
+	if err != nil {
+		t.Fatal(e.Trace(e.Forward(err)))
+	}
+	defer r.Close()
+	if upstreams := r.upstreamsFor(nil); len(upstreams) != 1 || upstreams[0].Net != NetTLS {
+		t.Fatal("wrong upstreams", upstreams)
+	}
+	_, err = NewResolver(WithUpstreams(Upstream{Addr: "192.0.2.1", Net: NetTLS}), WithConfigServers(true))
+	if err == nil {
+		t.Fatal("configuration servers accepted with a tls upstream")
+	}
+}
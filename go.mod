@@ -7,4 +7,5 @@ require (
 	github.com/fcavani/text v0.0.0-20190114102719-023e76809b57
 	github.com/grandcat/zeroconf v0.0.0-20181220215047-ce4c7efa4b6b
 	github.com/miekg/dns v1.1.3
+	golang.org/x/net v0.0.0-20180724234803-3673e40ba225
 )